@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/octohelm/kube-agent/pkg/cmdutil"
+	"github.com/octohelm/kube-agent/pkg/kubeagent/credential"
+)
+
+func main() {
+	opt := credential.Opt{}
+
+	cmd := &cobra.Command{
+		Use:   "kube-agent-credential",
+		Short: "client-go exec credential plugin for kube-agent-gateway",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cred, err := credential.ExecCredential(context.Background(), opt)
+			if err != nil {
+				return err
+			}
+			return json.NewEncoder(os.Stdout).Encode(cred)
+		},
+	}
+
+	cmdutil.MustAddFlags(cmd.Flags(), &opt, "KUBE_AGENT")
+
+	if err := cmd.Execute(); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/octohelm/kube-agent/internal/version"
 
@@ -27,10 +30,7 @@ func main() {
 		Run: func(cmd *cobra.Command, args []string) {
 			gatewayOpt.IP = ip
 
-			g, err := kubeagent.NewGateway(gatewayOpt)
-			if err != nil {
-				panic(err)
-			}
+			var g *kubeagent.Gateway
 
 			injectContext := func(ctx context.Context) context.Context {
 				ctx = idgen.WithIDGen(ctx, idGen)
@@ -38,9 +38,15 @@ func main() {
 				return ctx
 			}
 
-			g.InjectContext = injectContext
+			g, err := kubeagent.NewGateway(gatewayOpt, kubeagent.WithInjectContext(injectContext))
+			if err != nil {
+				panic(err)
+			}
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
 
-			ctx := g.InjectContext(context.Background())
+			ctx = g.InjectContext(ctx)
 
 			if err := g.Serve(ctx); err != nil {
 				logr.FromContext(ctx).Warn(err)
@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/octohelm/kube-agent/internal/version"
 
@@ -10,6 +13,7 @@ import (
 
 	"github.com/octohelm/kube-agent/pkg/cmdutil"
 	"github.com/octohelm/kube-agent/pkg/kubeagent"
+	"github.com/octohelm/kube-agent/pkg/kubeagent/forward"
 )
 
 func main() {
@@ -25,7 +29,10 @@ func main() {
 				panic(err)
 			}
 
-			ctx := logr.WithLogger(context.Background(), log.WithValues("agent", agentOpt.Host, "version", version.Version))
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			ctx = logr.WithLogger(ctx, log.WithValues("version", version.Version))
 
 			if err := g.Serve(ctx); err != nil {
 				logr.FromContext(ctx).Warn(err)
@@ -35,6 +42,32 @@ func main() {
 
 	cmdutil.MustAddFlags(cmd.Flags(), &agentOpt, "KUBE_AGENT_GATEWAY")
 
+	forwardOpt := forward.Opt{}
+
+	forwardCmd := &cobra.Command{
+		Use:   "forward",
+		Short: "forward local connections to host:port through agent",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			f, err := forward.Listen(forwardOpt)
+			if err != nil {
+				return err
+			}
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			ctx = logr.WithLogger(ctx, log)
+
+			log.Info("forwarding %s to %s through %s", f.Addr(), forwardOpt.Target, forwardOpt.AgentHost)
+
+			return f.Serve(ctx)
+		},
+	}
+
+	cmdutil.MustAddFlags(forwardCmd.Flags(), &forwardOpt, "KUBE_AGENT_FORWARD")
+
+	cmd.AddCommand(forwardCmd)
+
 	if err := cmd.Execute(); err != nil {
 		panic(err)
 	}
@@ -47,7 +47,6 @@ release.#Release & {
 
 				_probe: {
 					httpGet: {
-						path:   "/.sys/status"
 						port:   #ports.http
 						scheme: "HTTP"
 					}
@@ -58,8 +57,9 @@ release.#Release & {
 					failureThreshold:    3
 				}
 
-				readinessProbe: _probe
-				livenessProbe:  _probe
+				// /_health fails during draining, to remove the pod from endpoints before shutdown
+				readinessProbe: _probe & {httpGet: path: "/_health"}
+				livenessProbe:  _probe & {httpGet: path: "/.sys/status"}
 			}
 
 			spec: replicas: 3
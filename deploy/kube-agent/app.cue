@@ -34,6 +34,7 @@ release.#Release & {
 					"--gateway-address=\(#values.gateway.address)",
 					"--bearer-token=\(#values.gateway.token)",
 					"--host=\(#values.agent.host)",
+					"--labels=\(#values.agent.labels)",
 					"--retry-interval=3s",
 				]
 			}
@@ -6,7 +6,8 @@ import (
 
 #values: {
 	agent: {
-		host: string
+		host:   string
+		labels: *"" | string
 	}
 
 	gateway: {
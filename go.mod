@@ -26,6 +26,7 @@ require (
 	k8s.io/apimachinery v0.22.1
 	k8s.io/apiserver v0.22.1
 	k8s.io/client-go v0.22.1
+	sigs.k8s.io/yaml v1.2.0
 )
 
 require (
@@ -77,5 +78,4 @@ require (
 	k8s.io/klog/v2 v2.9.0 // indirect
 	k8s.io/utils v0.0.0-20210820185131-d34e5cb4466e // indirect
 	sigs.k8s.io/structured-merge-diff/v4 v4.1.2 // indirect
-	sigs.k8s.io/yaml v1.2.0 // indirect
 )
@@ -2,10 +2,17 @@ package httputil
 
 import "net/http"
 
-func HealthCheckHandler() func(handler http.Handler) http.Handler {
+// HealthCheckHandler responds /_health, 503 when any of checks failed
+func HealthCheckHandler(checks ...func() error) func(handler http.Handler) http.Handler {
 	return func(nextHandler http.Handler) http.Handler {
 		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 			if (req.Method == http.MethodHead || req.Method == http.MethodGet) && req.URL.Path == "/_health" {
+				for _, check := range checks {
+					if err := check(); err != nil {
+						http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+						return
+					}
+				}
 				rw.WriteHeader(http.StatusNoContent)
 				return
 			}
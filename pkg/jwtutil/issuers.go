@@ -0,0 +1,189 @@
+package jwtutil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/octohelm/kube-agent/pkg/timeutil"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+// IssuersConfig could be loaded from json or yaml file
+//
+//	leeway: 30s
+//	issuers:
+//	- issuer: https://accounts.example.com
+//	  jwksURL: https://accounts.example.com/.well-known/jwks.json
+//	  audiences: [ kube-agent ]
+type IssuersConfig struct {
+	Issuers []IssuerConfig `json:"issuers"`
+	// Leeway for clock skew when checking exp, nbf and iat
+	Leeway timeutil.Duration `json:"leeway,omitempty"`
+}
+
+type IssuerConfig struct {
+	// Issuer matches the iss claim, empty means any issuer
+	Issuer string `json:"issuer"`
+	// one of JWKSURL, JWKSFile and JWKS is required
+	JWKSURL  string          `json:"jwksURL,omitempty"`
+	JWKSFile string          `json:"jwksFile,omitempty"`
+	JWKS     json.RawMessage `json:"jwks,omitempty"`
+	// Audiences accepted for user tokens, empty means any audience
+	Audiences []string `json:"audiences,omitempty"`
+}
+
+func IssuersConfigFromFile(filename string) (*IssuersConfig, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	c := &IssuersConfig{}
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, errors.Wrapf(err, "invalid issuers config %s", filename)
+	}
+	return c, nil
+}
+
+type Issuer struct {
+	IssuerConfig
+	KeySet *KeySet
+}
+
+func (i *Issuer) AcceptsAudience(audiences []string) bool {
+	if len(i.Audiences) == 0 {
+		return true
+	}
+	for _, accepted := range i.Audiences {
+		for _, aud := range audiences {
+			if aud == accepted {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func NewIssuers(c IssuersConfig, opts ...KeySetOption) (*Issuers, error) {
+	is := &Issuers{leeway: c.Leeway.AsDuration()}
+
+	for i := range c.Issuers {
+		ic := c.Issuers[i]
+
+		fetchSet, err := fetchSetOf(ic)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid issuer %q", ic.Issuer)
+		}
+
+		for _, existed := range is.issuers {
+			if existed.Issuer == ic.Issuer {
+				return nil, fmt.Errorf("duplicated issuer %q", ic.Issuer)
+			}
+		}
+
+		is.issuers = append(is.issuers, &Issuer{IssuerConfig: ic, KeySet: NewKeySet(fetchSet, opts...)})
+	}
+
+	return is, nil
+}
+
+func fetchSetOf(ic IssuerConfig) (FetchSet, error) {
+	switch {
+	case ic.JWKSURL != "" && ic.JWKSFile == "" && len(ic.JWKS) == 0:
+		return SyncRemote(ic.JWKSURL), nil
+	case ic.JWKSFile != "" && ic.JWKSURL == "" && len(ic.JWKS) == 0:
+		return SyncFile(ic.JWKSFile), nil
+	case len(ic.JWKS) != 0 && ic.JWKSURL == "" && ic.JWKSFile == "":
+		s, err := jwk.Parse(ic.JWKS)
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context) (jwk.Set, error) {
+			return s, nil
+		}, nil
+	}
+	return nil, errors.New("one of jwksURL, jwksFile and jwks is required")
+}
+
+// SyncFile reads the key set from local file, which may be updated for rotation
+func SyncFile(filename string) FetchSet {
+	return func(ctx context.Context) (jwk.Set, error) {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			keySetFetchFailures.WithLabelValues(filename).Inc()
+			return nil, err
+		}
+		s, err := jwk.Parse(data)
+		if err != nil {
+			keySetFetchFailures.WithLabelValues(filename).Inc()
+			return nil, err
+		}
+		keySetLastFetchedTimestamp.WithLabelValues(filename).SetToCurrentTime()
+		return s, nil
+	}
+}
+
+// Issuers validates tokens from multiple issuers, each with its own key set
+type Issuers struct {
+	issuers []*Issuer
+	leeway  time.Duration
+}
+
+func (is *Issuers) Lookup(iss string) (*Issuer, bool) {
+	var fallback *Issuer
+	for _, i := range is.issuers {
+		if i.Issuer == iss {
+			return i, true
+		}
+		if i.Issuer == "" {
+			fallback = i
+		}
+	}
+	return fallback, fallback != nil
+}
+
+func (is *Issuers) Validate(ctx context.Context, tokenStr string) (jwt.Token, *Issuer, error) {
+	// signature not verified, only to pick the key set of the issuer
+	unverified, err := jwt.ParseString(tokenStr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrTokenMalformed, err)
+	}
+
+	issuer, ok := is.Lookup(unverified.Issuer())
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %q", ErrIssuerNotAccepted, unverified.Issuer())
+	}
+
+	tok, err := issuer.KeySet.Parse(ctx, tokenStr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := ValidateClaims(tok, is.leeway); err != nil {
+		return nil, nil, err
+	}
+
+	return tok, issuer, nil
+}
+
+// Serve refreshes key sets of all issuers in background until ctx done
+func (is *Issuers) Serve(ctx context.Context) error {
+	wg := &sync.WaitGroup{}
+
+	for i := range is.issuers {
+		wg.Add(1)
+		go func(ks *KeySet) {
+			defer wg.Done()
+			_ = ks.Serve(ctx)
+		}(is.issuers[i].KeySet)
+	}
+
+	wg.Wait()
+	return nil
+}
@@ -0,0 +1,104 @@
+package jwtutil
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/octohelm/kube-agent/pkg/timeutil"
+	. "github.com/onsi/gomega"
+)
+
+func TestIssuers(t *testing.T) {
+	signingKeyOf := func(kid string) (jwk.Key, []byte) {
+		privateKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+		key, _ := jwk.New(privateKey)
+		_ = key.Set(jwk.KeyIDKey, kid)
+		_ = key.Set(jwk.AlgorithmKey, jwa.RS256)
+
+		publicKey, _ := jwk.PublicKeyOf(key)
+		s := jwk.NewSet()
+		s.Add(publicKey)
+		data, _ := json.Marshal(s)
+		return key, data
+	}
+
+	keyA, jwksA := signingKeyOf("a")
+	keyB, jwksB := signingKeyOf("b")
+
+	tmp, _ := ioutil.TempDir("", "jwks")
+	defer os.RemoveAll(tmp)
+	_ = ioutil.WriteFile(filepath.Join(tmp, "jwks.json"), jwksB, 0600)
+
+	issuers, err := NewIssuers(IssuersConfig{
+		Issuers: []IssuerConfig{
+			{Issuer: "a", JWKS: jwksA},
+			{Issuer: "b", JWKSFile: filepath.Join(tmp, "jwks.json")},
+		},
+	})
+	NewWithT(t).Expect(err).To(BeNil())
+
+	sign := func(key jwk.Key, claims map[string]interface{}) string {
+		tok := jwt.New()
+		_ = tok.Set(jwt.ExpirationKey, time.Now().Add(time.Hour))
+		for k, v := range claims {
+			_ = tok.Set(k, v)
+		}
+		data, _ := jwt.Sign(tok, jwa.RS256, key)
+		return string(data)
+	}
+
+	ctx := context.Background()
+
+	t.Run("each issuer with own key set", func(t *testing.T) {
+		_, issuer, err := issuers.Validate(ctx, sign(keyA, map[string]interface{}{jwt.IssuerKey: "a"}))
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(issuer.Issuer).To(Equal("a"))
+
+		_, issuer, err = issuers.Validate(ctx, sign(keyB, map[string]interface{}{jwt.IssuerKey: "b"}))
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(issuer.Issuer).To(Equal("b"))
+	})
+
+	t.Run("precise errors", func(t *testing.T) {
+		cases := map[error]string{
+			ErrIssuerNotAccepted:   sign(keyA, map[string]interface{}{jwt.IssuerKey: "c"}),
+			ErrKeyIDNotFound:       sign(keyB, map[string]interface{}{jwt.IssuerKey: "a"}),
+			ErrTokenMalformed:      "invalid",
+			ErrTokenExpired:        sign(keyA, map[string]interface{}{jwt.IssuerKey: "a", jwt.ExpirationKey: time.Now().Add(-time.Minute)}),
+			ErrTokenNotYetValid:    sign(keyA, map[string]interface{}{jwt.IssuerKey: "a", jwt.NotBeforeKey: time.Now().Add(time.Minute)}),
+			ErrTokenIssuedInFuture: sign(keyA, map[string]interface{}{jwt.IssuerKey: "a", jwt.IssuedAtKey: time.Now().Add(time.Minute)}),
+		}
+
+		for expected, token := range cases {
+			_, _, err := issuers.Validate(ctx, token)
+			NewWithT(t).Expect(errors.Is(err, expected)).To(BeTrue(), "%v", err)
+		}
+	})
+
+	t.Run("leeway for clock skew", func(t *testing.T) {
+		withLeeway, _ := NewIssuers(IssuersConfig{
+			Issuers: []IssuerConfig{{JWKS: jwksA}},
+			Leeway:  timeutil.Duration(2 * time.Minute),
+		})
+
+		_, _, err := withLeeway.Validate(ctx, sign(keyA, map[string]interface{}{jwt.NotBeforeKey: time.Now().Add(time.Minute)}))
+		NewWithT(t).Expect(err).To(BeNil())
+	})
+
+	t.Run("audiences", func(t *testing.T) {
+		issuer := &Issuer{IssuerConfig: IssuerConfig{Audiences: []string{"kube-agent"}}}
+		NewWithT(t).Expect(issuer.AcceptsAudience([]string{"other", "kube-agent"})).To(BeTrue())
+		NewWithT(t).Expect(issuer.AcceptsAudience([]string{"other"})).To(BeFalse())
+	})
+}
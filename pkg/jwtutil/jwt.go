@@ -4,80 +4,296 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jws"
 	"github.com/lestrrat-go/jwx/jwt"
 )
 
 var (
-	ErrKeyIDNotFound = errors.New("key id not exists")
-	ErrTokenExpired  = errors.New("token is expired")
+	ErrTokenMalformed      = errors.New("token is malformed")
+	ErrKeyIDNotFound       = errors.New("key id not exists")
+	ErrInvalidSignature    = errors.New("token signature is invalid")
+	ErrTokenExpired        = errors.New("token is expired")
+	ErrTokenNotYetValid    = errors.New("token is not valid yet")
+	ErrTokenIssuedInFuture = errors.New("token is issued in the future")
+	ErrIssuerNotAccepted   = errors.New("token issuer is not accepted")
+	ErrAudienceNotAccepted = errors.New("token audience is not accepted")
+	ErrKeySetNotFound      = errors.New("key set not found")
 )
 
-func NewKeySet(fetchSet FetchSet) *KeySet {
-	return &KeySet{
-		Set:      jwk.NewSet(),
-		fetchSet: fetchSet,
+const (
+	DefaultRefreshInterval    = 15 * time.Minute
+	DefaultMinRefetchInterval = 30 * time.Second
+)
+
+type KeySetOption = func(ks *KeySet)
+
+// WithRefreshInterval sets the interval of background refresh, when max-age of Cache-Control not provided
+func WithRefreshInterval(d time.Duration) KeySetOption {
+	return func(ks *KeySet) {
+		if d > 0 {
+			ks.refreshInterval = d
+		}
 	}
 }
 
-type FetchSet = func(ctx context.Context) (jwk.Set, error)
+// WithMinRefetchInterval sets the min interval between fetches, which triggered by unknown key id or failed refresh
+func WithMinRefetchInterval(d time.Duration) KeySetOption {
+	return func(ks *KeySet) {
+		if d > 0 {
+			ks.minRefetchInterval = d
+		}
+	}
+}
 
-func SyncRemote(remote string) FetchSet {
-	return func(ctx context.Context) (jwk.Set, error) {
-		return jwk.Fetch(context.Background(), remote)
+func NewKeySet(fetchSet FetchSet, opts ...KeySetOption) *KeySet {
+	ks := &KeySet{
+		set:                jwk.NewSet(),
+		fetchSet:           fetchSet,
+		refreshInterval:    DefaultRefreshInterval,
+		minRefetchInterval: DefaultMinRefetchInterval,
 	}
+
+	for i := range opts {
+		opts[i](ks)
+	}
+
+	return ks
 }
 
+// FetchSet fetches the full key set,
+// the returned set could implement interface{ MaxAge() time.Duration } to control when to refresh.
+type FetchSet = func(ctx context.Context) (jwk.Set, error)
+
 type KeySet struct {
-	jwk.Set
-	fetchSet FetchSet
+	fetchSet           FetchSet
+	refreshInterval    time.Duration
+	minRefetchInterval time.Duration
+
+	mu            sync.RWMutex
+	set           jwk.Set
+	lastFetchedAt time.Time
+	nextRefreshAt time.Time
+	// in-flight fetch shared by callers, nil when not fetching
+	fetching *fetching
+}
+
+type fetching struct {
+	done chan struct{}
+	err  error
+}
+
+// wait waits the fetch done, or gives up when ctx done, the fetch keeps going for others
+func (f *fetching) wait(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Keys returns the current key set
+func (c *KeySet) Keys() jwk.Set {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.set
 }
 
 func (c *KeySet) LookupKeyID(s string) (jwk.Key, bool) {
-	if key, ok := c.Set.LookupKeyID(s); ok {
+	return c.lookupKeyID(context.Background(), s)
+}
+
+func (c *KeySet) lookupKeyID(ctx context.Context, s string) (jwk.Key, bool) {
+	if key, ok := c.Keys().LookupKeyID(s); ok {
 		return key, ok
 	}
 
-	if err := c.Sync(context.Background()); err != nil {
+	// unknown key id may be a new rotated key, refetch with throttling
+	if err := c.syncIfAllowed(ctx); err != nil {
 		return nil, false
 	}
 
-	return c.Set.LookupKeyID(s)
+	return c.Keys().LookupKeyID(s)
 }
 
+func (c *KeySet) syncIfAllowed(ctx context.Context) error {
+	c.mu.Lock()
+
+	if c.fetching == nil && !c.lastFetchedAt.IsZero() && time.Since(c.lastFetchedAt) < c.minRefetchInterval {
+		c.mu.Unlock()
+		keySetRefetchThrottled.Inc()
+		return ErrKeyIDNotFound
+	}
+
+	f := c.startFetching()
+	c.mu.Unlock()
+
+	return f.wait(ctx)
+}
+
+// Sync fetches the key set, and replaces the current one when succeed,
+// the current one will be kept when failed.
+// Sync joins the in-flight fetch if exists, and returns when ctx done without waiting the fetch.
 func (c *KeySet) Sync(ctx context.Context) error {
-	s, err := c.fetchSet(ctx)
+	c.mu.Lock()
+	f := c.startFetching()
+	c.mu.Unlock()
+
+	return f.wait(ctx)
+}
+
+// startFetching starts a fetch unless one in flight, c.mu should be held.
+// the fetch runs without lock and not bound to ctx of any caller, remote fetches have their own timeout.
+func (c *KeySet) startFetching() *fetching {
+	if c.fetching != nil {
+		return c.fetching
+	}
+
+	f := &fetching{done: make(chan struct{})}
+	c.fetching = f
+
+	go func() {
+		s, err := c.fetchSet(context.Background())
+
+		c.mu.Lock()
+		c.update(s, err)
+		c.fetching = nil
+		c.mu.Unlock()
+
+		f.err = err
+		close(f.done)
+	}()
+
+	return f
+}
+
+// update swaps the key set by the fetched one, c.mu should be held
+func (c *KeySet) update(s jwk.Set, err error) {
+	now := time.Now()
+	c.lastFetchedAt = now
+
 	if err != nil {
-		return err
+		// stale while error, retry sooner
+		c.nextRefreshAt = now.Add(c.minRefetchInterval)
+		return
 	}
 
-	for i := 0; i < s.Len(); i++ {
-		if k, ok := s.Get(i); ok {
-			c.Add(k)
-		}
+	refreshInterval := c.refreshInterval
+	if m, ok := s.(interface{ MaxAge() time.Duration }); ok && m.MaxAge() > 0 {
+		refreshInterval = m.MaxAge()
+	}
+	if refreshInterval < c.minRefetchInterval {
+		refreshInterval = c.minRefetchInterval
 	}
 
-	return nil
+	c.set = s
+	c.nextRefreshAt = now.Add(refreshInterval)
 }
 
+func (c *KeySet) untilNextRefresh() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.nextRefreshAt.IsZero() {
+		return 0
+	}
+	return time.Until(c.nextRefreshAt)
+}
+
+// Serve refreshes the key set in background until ctx done
+func (c *KeySet) Serve(ctx context.Context) error {
+	for {
+		t := time.NewTimer(c.untilNextRefresh())
+
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil
+		case <-t.C:
+			_ = c.Sync(ctx)
+		}
+	}
+}
+
+// Validate verifies the signature and the time claims of the token
 func (c *KeySet) Validate(ctx context.Context, tokenStr string) (jwt.Token, error) {
-	tok, err := c.validate(tokenStr)
+	tok, err := c.Parse(ctx, tokenStr)
 	if err != nil {
 		return nil, err
 	}
+	if err := ValidateClaims(tok, 0); err != nil {
+		return nil, err
+	}
 	return tok, nil
 }
 
-func (c *KeySet) validate(tokenStr string) (jwt.Token, error) {
-	tok, err := jwt.ParseString(tokenStr, jwt.WithKeySet(c))
+// Parse parses the token and verifies its signature by the key of kid
+func (c *KeySet) Parse(ctx context.Context, tokenStr string) (jwt.Token, error) {
+	msg, err := jws.ParseString(tokenStr)
 	if err != nil {
-		fmt.Printf("%+v\n", err)
-		return nil, err
+		return nil, fmt.Errorf("%w: %s", ErrTokenMalformed, err)
+	}
+
+	sigs := msg.Signatures()
+	if len(sigs) != 1 {
+		return nil, fmt.Errorf("%w: expect one signature, but got %d", ErrTokenMalformed, len(sigs))
 	}
-	if time.Until(tok.Expiration()) < 0 {
-		return nil, ErrTokenExpired
+
+	kid := sigs[0].ProtectedHeaders().KeyID()
+	if kid == "" {
+		return nil, fmt.Errorf("%w: missing kid", ErrTokenMalformed)
+	}
+
+	if _, ok := c.lookupKeyID(ctx, kid); !ok {
+		return nil, fmt.Errorf("%w: %s", ErrKeyIDNotFound, kid)
+	}
+
+	tok, err := jwt.ParseString(tokenStr, jwt.WithKeySet(c.Keys()))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSignature, err)
 	}
 	return tok, nil
 }
+
+// TypeOf returns the typ header of the token, signature not verified
+func TypeOf(tokenStr string) (string, error) {
+	msg, err := jws.ParseString(tokenStr)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrTokenMalformed, err)
+	}
+
+	sigs := msg.Signatures()
+	if len(sigs) != 1 {
+		return "", fmt.Errorf("%w: expect one signature, but got %d", ErrTokenMalformed, len(sigs))
+	}
+
+	return sigs[0].ProtectedHeaders().Type(), nil
+}
+
+// ValidateClaims validates exp, nbf and iat of the token, with leeway for clock skew
+func ValidateClaims(tok jwt.Token, leeway time.Duration) error {
+	now := time.Now()
+
+	exp := tok.Expiration()
+	if exp.IsZero() {
+		return fmt.Errorf("%w: missing exp", ErrTokenExpired)
+	}
+	if now.After(exp.Add(leeway)) {
+		return fmt.Errorf("%w: expired at %s", ErrTokenExpired, exp.Format(time.RFC3339))
+	}
+
+	if nbf := tok.NotBefore(); !nbf.IsZero() && now.Add(leeway).Before(nbf) {
+		return fmt.Errorf("%w: not valid before %s", ErrTokenNotYetValid, nbf.Format(time.RFC3339))
+	}
+
+	if iat := tok.IssuedAt(); !iat.IsZero() && now.Add(leeway).Before(iat) {
+		return fmt.Errorf("%w: issued at %s", ErrTokenIssuedInFuture, iat.Format(time.RFC3339))
+	}
+
+	return nil
+}
@@ -2,10 +2,15 @@ package jwtutil
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/lestrrat-go/jwx/jwk"
+	. "github.com/onsi/gomega"
 )
 
 func Test(t *testing.T) {
@@ -17,3 +22,85 @@ func Test(t *testing.T) {
 	//spew.Dump(tok.Issuer())
 	//spew.Dump(tok.Subject())
 }
+
+func TestKeySetRefresh(t *testing.T) {
+	fetched := 0
+	failed := false
+
+	keyOf := func(kid string) jwk.Key {
+		key, _ := jwk.New([]byte(kid))
+		_ = key.Set(jwk.KeyIDKey, kid)
+		return key
+	}
+
+	ks := NewKeySet(func(ctx context.Context) (jwk.Set, error) {
+		fetched++
+		if failed {
+			return nil, errors.New("unavailable")
+		}
+		s := jwk.NewSet()
+		s.Add(keyOf(fmt.Sprintf("key-%d", fetched)))
+		return s, nil
+	}, WithMinRefetchInterval(time.Hour))
+
+	NewWithT(t).Expect(ks.Sync(context.Background())).To(Succeed())
+
+	t.Run("rotated key replaces the old one", func(t *testing.T) {
+		NewWithT(t).Expect(ks.Sync(context.Background())).To(Succeed())
+
+		_, ok := ks.Keys().LookupKeyID("key-1")
+		NewWithT(t).Expect(ok).To(BeFalse())
+		_, ok = ks.Keys().LookupKeyID("key-2")
+		NewWithT(t).Expect(ok).To(BeTrue())
+	})
+
+	t.Run("unknown key id refetch throttled", func(t *testing.T) {
+		_, ok := ks.LookupKeyID("unknown")
+		NewWithT(t).Expect(ok).To(BeFalse())
+		NewWithT(t).Expect(fetched).To(Equal(2))
+	})
+
+	t.Run("keep stale keys when fetch failed", func(t *testing.T) {
+		failed = true
+
+		NewWithT(t).Expect(ks.Sync(context.Background())).NotTo(Succeed())
+		_, ok := ks.Keys().LookupKeyID("key-2")
+		NewWithT(t).Expect(ok).To(BeTrue())
+	})
+}
+
+func TestKeySetHangingFetch(t *testing.T) {
+	release := make(chan struct{})
+	fetches := int32(0)
+
+	ks := NewKeySet(func(ctx context.Context) (jwk.Set, error) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		return nil, errors.New("unavailable")
+	})
+
+	t.Run("waiters give up when ctx done", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		_, err := ks.Parse(ctx, "eyJhbGciOiJSUzI1NiIsImtpZCI6IkNFaFRmRmQxdW53IiwidHlwIjoiSldUIn0.eyJzdWIiOiJLVUJFX0FHRU5UIn0.c2ln")
+		NewWithT(t).Expect(errors.Is(err, ErrKeyIDNotFound)).To(BeTrue())
+
+		NewWithT(t).Expect(ks.Sync(ctx)).To(Equal(context.DeadlineExceeded))
+	})
+
+	t.Run("in-flight fetch shared", func(t *testing.T) {
+		NewWithT(t).Expect(atomic.LoadInt32(&fetches)).To(Equal(int32(1)))
+		NewWithT(t).Expect(ks.Keys().Len()).To(Equal(0))
+	})
+
+	close(release)
+
+	NewWithT(t).Expect(ks.Sync(context.Background())).NotTo(Succeed())
+}
+
+func TestMaxAgeOf(t *testing.T) {
+	NewWithT(t).Expect(MaxAgeOf("public, max-age=600")).To(Equal(10 * time.Minute))
+	NewWithT(t).Expect(MaxAgeOf("no-cache")).To(Equal(time.Duration(0)))
+	NewWithT(t).Expect(MaxAgeOf("")).To(Equal(time.Duration(0)))
+}
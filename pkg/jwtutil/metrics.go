@@ -0,0 +1,32 @@
+package jwtutil
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	keySetFetchFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kube_agent",
+		Subsystem: "jwks",
+		Name:      "fetch_failures_total",
+		Help:      "Total number of failed jwks fetches",
+	}, []string{"endpoint"})
+
+	keySetLastFetchedTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "kube_agent",
+		Subsystem: "jwks",
+		Name:      "last_fetched_timestamp_seconds",
+		Help:      "Timestamp of the last succeed jwks fetch",
+	}, []string{"endpoint"})
+
+	keySetRefetchThrottled = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "kube_agent",
+		Subsystem: "jwks",
+		Name:      "refetch_throttled_total",
+		Help:      "Total number of refetches skipped for unknown key id, because of min refetch interval",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(keySetFetchFailures, keySetLastFetchedTimestamp, keySetRefetchThrottled)
+}
@@ -0,0 +1,93 @@
+package jwtutil
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+// SyncRemote fetches the key set from remote jwks endpoint, and honors max-age of Cache-Control
+func SyncRemote(remote string) FetchSet {
+	return func(ctx context.Context) (jwk.Set, error) {
+		s, err := fetchRemote(ctx, remote)
+		if err != nil {
+			keySetFetchFailures.WithLabelValues(remote).Inc()
+			return nil, err
+		}
+		keySetLastFetchedTimestamp.WithLabelValues(remote).SetToCurrentTime()
+		return s, nil
+	}
+}
+
+func fetchRemote(ctx context.Context, remote string) (jwk.Set, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, remote, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("fetch jwks from %s failed: %w", remote, ErrKeySetNotFound)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch jwks from %s failed: status %d", remote, resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := jwk.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &setWithMaxAge{Set: s, maxAge: MaxAgeOf(resp.Header.Get("Cache-Control"))}, nil
+}
+
+type setWithMaxAge struct {
+	jwk.Set
+	maxAge time.Duration
+}
+
+func (s *setWithMaxAge) MaxAge() time.Duration {
+	return s.maxAge
+}
+
+// MaxAgeOf returns max-age of Cache-Control, and zero when not provided or no-cache
+func MaxAgeOf(cacheControl string) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+
+		if directive == "no-cache" || directive == "no-store" {
+			return 0
+		}
+
+		if strings.HasPrefix(directive, "max-age=") {
+			seconds, err := strconv.ParseInt(strings.TrimPrefix(directive, "max-age="), 10, 64)
+			if err != nil || seconds < 0 {
+				return 0
+			}
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return 0
+}
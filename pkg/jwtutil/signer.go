@@ -0,0 +1,119 @@
+package jwtutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jws"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/pkg/errors"
+)
+
+// SigningKeyFromFile loads private key from pem or jwk file,
+// kid will be the thumbprint when not provided.
+func SigningKeyFromFile(filename string) (jwk.Key, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := jwk.ParseKey(data, jwk.WithPEM(true))
+	if err != nil {
+		key, err = jwk.ParseKey(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid signing key %s", filename)
+		}
+	}
+
+	if key.KeyID() == "" {
+		if err := jwk.AssignKeyID(key); err != nil {
+			return nil, err
+		}
+	}
+
+	if key.Algorithm() == "" {
+		alg, err := algorithmOf(key)
+		if err != nil {
+			return nil, err
+		}
+		_ = key.Set(jwk.AlgorithmKey, alg)
+	}
+
+	return key, nil
+}
+
+func algorithmOf(key jwk.Key) (jwa.SignatureAlgorithm, error) {
+	var raw interface{}
+	if err := key.Raw(&raw); err != nil {
+		return "", err
+	}
+
+	switch k := raw.(type) {
+	case *rsa.PrivateKey:
+		return jwa.RS256, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jwa.ES256, nil
+		case elliptic.P384():
+			return jwa.ES384, nil
+		case elliptic.P521():
+			return jwa.ES512, nil
+		}
+	}
+
+	return "", fmt.Errorf("unsupported signing key %T", raw)
+}
+
+func NewSigner(key jwk.Key) (*Signer, error) {
+	publicKey, err := jwk.PublicKeyOf(key)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKeys := jwk.NewSet()
+	publicKeys.Add(publicKey)
+
+	return &Signer{key: key, publicKeys: publicKeys}, nil
+}
+
+type Signer struct {
+	key        jwk.Key
+	publicKeys jwk.Set
+}
+
+func (s *Signer) Sign(tok jwt.Token) (string, error) {
+	data, err := jwt.Sign(tok, jwa.SignatureAlgorithm(s.key.Algorithm()), s.key)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// SignWithType signs the token with the typ header, to make tokens of different usages signed by the same key not interchangeable
+func (s *Signer) SignWithType(tok jwt.Token, typ string) (string, error) {
+	hdrs := jws.NewHeaders()
+	if err := hdrs.Set(jws.TypeKey, typ); err != nil {
+		return "", err
+	}
+	data, err := jwt.Sign(tok, jwa.SignatureAlgorithm(s.key.Algorithm()), s.key, jwt.WithHeaders(hdrs))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// PublicKeys returns the key set to verify tokens, which could be served as jwks
+func (s *Signer) PublicKeys() jwk.Set {
+	return s.publicKeys
+}
+
+func (s *Signer) MarshalJWKS() ([]byte, error) {
+	return json.Marshal(s.publicKeys)
+}
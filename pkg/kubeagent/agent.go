@@ -5,12 +5,10 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"os"
-	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
-	"syscall"
 	"time"
 
 	"github.com/octohelm/kube-agent/pkg/statuserr"
@@ -18,50 +16,139 @@ import (
 	"github.com/go-courier/logr"
 	"github.com/gorilla/websocket"
 	"github.com/octohelm/kube-agent/pkg/jwtutil"
+	"github.com/octohelm/kube-agent/pkg/kubeagent/auth"
 	"github.com/octohelm/kube-agent/pkg/timeutil"
+	"github.com/pkg/errors"
+	"k8s.io/client-go/rest"
 )
 
 type AgentOpt struct {
-	Host           string            `flag:"host,env"`
-	Secure         bool              `flag:"secure,env" desc:"secure"`
-	GatewayAddress string            `flag:"gateway-address,env" desc:"address of kube agent gateway"`
-	BearerToken    string            `flag:"bearer-token,env" desc:"bearer token for validation"`
-	RetryInterval  timeutil.Duration `flag:"retry-interval,env" default:"1s"  desc:"retry interval when worker Closed"`
+	Host                     string            `flag:"host,env"`
+	Kubeconfig               string            `flag:"kubeconfig,env" desc:"path of kubeconfig, in-cluster config or default kubeconfig used when empty"`
+	Context                  string            `flag:"context,env" desc:"kubeconfig context to serve, current context used when empty"`
+	Server                   string            `flag:"server,env" desc:"overrides the apiserver url of the cluster"`
+	ReloadInterval           timeutil.Duration `flag:"reload-interval,env" default:"30s" desc:"interval to check changes of kubeconfig and certificates on disk, proxy handler will be rebuilt when changed, disabled when 0"`
+	Contexts                 AgentContexts     `flag:"contexts,env" desc:"kubeconfig contexts to serve, each under its own agent host, like host-a=context-a,context-b"`
+	KubeconfigDir            string            `flag:"kubeconfig-dir,env" desc:"directory of kubeconfig files to serve, each under the agent host of its file name"`
+	Secure                   bool              `flag:"secure,env" desc:"secure"`
+	GatewayAddress           string            `flag:"gateway-address,env" desc:"address of kube agent gateway"`
+	BearerToken              string            `flag:"bearer-token,env" desc:"bearer token for validation"`
+	BearerTokenDir           string            `flag:"bearer-token-dir,env" desc:"directory of bearer token files named by agent host, bearer token used when file of agent host not exists"`
+	RetryInterval            timeutil.Duration `flag:"retry-interval,env" default:"1s"  desc:"retry interval when worker Closed"`
+	Labels                   AgentLabels       `flag:"labels,env" desc:"labels of agent, like env=staging,region=eu"`
+	PolicyFile               string            `flag:"policy-file,env" desc:"scope file of namespaces and rules, requests from gateway out of it will be denied by agent"`
+	ReadOnly                 bool              `flag:"read-only,env" desc:"only allow get, list and watch requests from gateway"`
+	SkipEnvelopeVerification bool              `flag:"skip-envelope-verification,env" desc:"run requests from gateway without verifying envelopes, which are verified by jwks of gateway at /.well-known/jwks.json by default and skipped only when gateway publishes no keys"`
+	EnvelopeIssuer           string            `flag:"envelope-issuer,env" default:"kube-agent" desc:"issuer of envelopes, should be the token issuer of gateway"`
+	ShutdownTimeout          timeutil.Duration `flag:"shutdown-timeout,env" default:"5s" desc:"max duration to wait in-flight requests done when shutdown, requests not done will be cut off"`
+	ServicesFile             string            `flag:"services-file,env" desc:"file of named upstream targets in cluster, like prometheus and grafana, proxied by gateway under /services/{agentHost}/{target}/"`
+	ForwardTargets           ForwardTargets    `flag:"forward-targets,env" desc:"host:port allowed to forward tcp streams to, glob supported, like *.db.svc:5432,redis:6379, forwarding disabled when empty"`
+	MetricsAddress           string            `flag:"metrics-address,env" desc:"address to serve metrics at /.sys/metrics, like :9090, disabled when empty"`
 }
 
-func NewAgent(opt AgentOpt) (*Agent, error) {
-	cfg, err := ResolveKubeConfig()
-	if err != nil {
-		return nil, err
+type AgentOption = func(a *Agent)
+
+// WithRestConfig proxies requests to the cluster of the config, instead of in-cluster config or kubeconfig
+func WithRestConfig(cfg *rest.Config) AgentOption {
+	return func(a *Agent) {
+		a.restConfig = cfg
+	}
+}
+
+func NewAgent(opt AgentOpt, opts ...AgentOption) (*Agent, error) {
+	a := &Agent{
+		opt:      opt,
+		receiver: make(chan *agentCluster),
+		close:    make(chan struct{}),
+	}
+
+	for i := range opts {
+		opts[i](a)
 	}
 
-	h, err := ProxyHandler(cfg)
+	configs, err := a.resolveClusterConfigs()
 	if err != nil {
 		return nil, err
 	}
 
-	return &Agent{
-		opt:      opt,
-		handler:  h,
-		receiver: make(chan struct{}),
-		close:    make(chan struct{}),
-	}, nil
+	policy := &AgentPolicy{ReadOnly: opt.ReadOnly}
+
+	if opt.PolicyFile != "" {
+		s, err := AgentPolicyFromFile(opt.PolicyFile)
+		if err != nil {
+			return nil, err
+		}
+		policy.Scope = s
+	}
+
+	a.policy = policy
+
+	services := ServiceTargets{}
+
+	if opt.ServicesFile != "" {
+		s, err := ServiceTargetsFromFile(opt.ServicesFile)
+		if err != nil {
+			return nil, err
+		}
+		services = s
+	}
+
+	if !opt.SkipEnvelopeVerification {
+		// one gateway, one key set for all clusters
+		a.keySet = jwtutil.NewKeySet(jwtutil.SyncRemote(fmt.Sprintf("%s://%s/.well-known/jwks.json", a.protocol("http"), opt.GatewayAddress)))
+	}
+
+	for _, c := range configs {
+		h, err := newReloadingProxy(c.load, c.files)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cluster %s", c.host)
+		}
+
+		cluster := &agentCluster{host: c.host, handler: h, services: map[string]http.Handler{}}
+
+		for name, target := range services.For(c.host) {
+			sh, err := target.Handler()
+			if err != nil {
+				return nil, errors.Wrapf(err, "service %s of cluster %s", name, c.host)
+			}
+			cluster.services[name] = sh
+		}
+
+		if a.keySet != nil {
+			cluster.envelopes = &EnvelopeVerifier{Issuer: opt.EnvelopeIssuer, AgentHost: c.host, KeySet: a.keySet}
+		}
+
+		a.clusters = append(a.clusters, cluster)
+	}
+
+	return a, nil
 }
 
 type Agent struct {
-	opt AgentOpt
-
-	handler  http.Handler
-	receiver chan struct{}
+	opt            AgentOpt
+	restConfig     *rest.Config
+	clusterConfigs []clusterConfig
+	policy         *AgentPolicy
+	keySet         *jwtutil.KeySet
 
-	InjectContext func(ctx context.Context) context.Context
+	clusters []*agentCluster
+	receiver chan *agentCluster
 
-	wg sync.WaitGroup
+	wg        sync.WaitGroup
+	inflight  sync.Map
+	receivers sync.Map
 
 	close  chan struct{}
 	closed int64
 }
 
+type inflightRequest struct {
+	Method    string
+	URL       string
+	StartedAt time.Time
+	cancel    context.CancelFunc
+}
+
 func (a *Agent) Closed() bool {
 	return atomic.LoadInt64(&a.closed) != int64(0)
 }
@@ -73,7 +160,7 @@ func (a *Agent) protocol(p string) string {
 	return p
 }
 
-func (a *Agent) Dial(ctx context.Context, path string, headers http.Header) (*websocket.Conn, error) {
+func (a *Agent) Dial(ctx context.Context, agentHost string, path string, headers http.Header) (*websocket.Conn, *http.Response, error) {
 	d := &websocket.Dialer{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
@@ -83,8 +170,13 @@ func (a *Agent) Dial(ctx context.Context, path string, headers http.Header) (*we
 		headers = http.Header{}
 	}
 
+	token, err := a.bearerToken(agentHost)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	auth := jwtutil.Authorizations{}
-	auth.Add("Bearer", a.opt.BearerToken)
+	auth.Add("Bearer", token)
 	headers.Set("Authorization", auth.String())
 
 	c, resp, err := d.DialContext(ctx, fmt.Sprintf("%s://%s%s", a.protocol("ws"), a.opt.GatewayAddress, path), headers)
@@ -93,14 +185,15 @@ func (a *Agent) Dial(ctx context.Context, path string, headers http.Header) (*we
 			logr.FromContext(ctx).Warn(statuserr.New(resp.StatusCode, err))
 		}
 	}
-	return c, err
+	return c, resp, err
 }
 
-func (a *Agent) Do(ctx context.Context, requestID string) {
+func (a *Agent) Do(ctx context.Context, cluster *agentCluster, requestID string, proof string) {
 	log := logr.FromContext(ctx)
 
-	c, err := a.Dial(ctx, fmt.Sprintf("/agents/%s/requests", a.opt.Host), http.Header{
-		HTTP_KUBE_AGENT_REQUEST_ID: {requestID},
+	c, _, err := a.Dial(ctx, cluster.host, fmt.Sprintf("/agents/%s/requests", cluster.host), http.Header{
+		HTTP_KUBE_AGENT_REQUEST_ID:    {requestID},
+		HTTP_KUBE_AGENT_REQUEST_PROOF: {proof},
 	})
 	if err != nil {
 		return
@@ -112,15 +205,12 @@ func (a *Agent) Do(ctx context.Context, requestID string) {
 		}
 	}()
 
-	if err := a.DoRequest(ctx, c, requestID); err != nil {
+	if err := a.DoRequest(ctx, cluster, c, requestID); err != nil {
 		log.Error(err)
 	}
 }
 
-func (a *Agent) DoRequest(ctx context.Context, c *websocket.Conn, requestID string) (finalErr error) {
-	a.wg.Add(1)
-	defer a.wg.Done()
-
+func (a *Agent) DoRequest(ctx context.Context, cluster *agentCluster, c *websocket.Conn, requestID string) (finalErr error) {
 	_, r, err := c.NextReader()
 	if err != nil {
 		return err
@@ -133,9 +223,99 @@ func (a *Agent) DoRequest(ctx context.Context, c *websocket.Conn, requestID stri
 
 	started := time.Now()
 	statusCode := 0
+	actor := ""
+
+	var denied error
+
+	// may dispatched before gateway received going away
+	if a.Closed() {
+		denied = statuserr.New(http.StatusServiceUnavailable, fmt.Errorf("agent %s is shutting down", cluster.host))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	a.inflight.Store(requestID, &inflightRequest{Method: req.Method, URL: req.URL.String(), StartedAt: started, cancel: cancel})
+	defer a.inflight.Delete(requestID)
+
+	req = req.WithContext(ctx)
+
+	// restriction decided by gateway, only trusted when signed in envelope
+	var restriction *auth.Restriction
+
+	if denied == nil && cluster.envelopes != nil {
+		e, err := cluster.envelopes.Open(ctx, req, requestID)
+		if err == nil {
+			actor = e.User
+			restriction, err = e.Restriction.Restriction()
+		}
+		if err != nil {
+			denied = statuserr.New(http.StatusForbidden, err)
+		}
+	}
+
+	dryRun := restriction != nil && restriction.DryRun
+
+	handler := cluster.handler
+	authorize := func() error {
+		return a.policy.Authorize(req)
+	}
+
+	if target, ok := serviceTarget(req.URL.Path, cluster.host); ok {
+		attrs := auth.ServiceRequestAttributesFromRequest(req, cluster.host, target)
+		handler = cluster.services[target]
+
+		authorize = func() error {
+			if handler == nil {
+				return statuserr.New(http.StatusNotFound, fmt.Errorf("service %s not found in %s", target, cluster.host))
+			}
+			return a.policy.AuthorizeService(attrs, req)
+		}
+
+		// dry-run could not be enforced on services
+		if dryRun && !auth.IsReadOnlyServiceVerb(attrs.GetVerb()) {
+			denied = statuserr.New(http.StatusForbidden, fmt.Errorf("only dry-run allowed, %s of service %s denied", attrs.GetVerb(), target))
+		}
+
+		req.URL.Path = attrs.ServicePath
+		req.URL.RawPath = ""
+	} else if target, ok := forwardTarget(req.URL.Path, cluster.host); ok {
+		attrs := auth.ForwardRequestAttributes(target)
+
+		handler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			a.forward(req.Context(), c, rw, target)
+		})
 
-	// trim agent host prefix
-	req.URL.Path = strings.TrimPrefix(req.URL.Path, "/proxies/"+a.opt.Host)
+		authorize = func() error {
+			if !a.opt.ForwardTargets.Allows(target) {
+				return statuserr.New(http.StatusForbidden, fmt.Errorf("forwarding to %s is not allowed by agent %s", target, cluster.host))
+			}
+			return a.policy.AuthorizeForward(attrs)
+		}
+
+		// tcp streams could not be dry-run
+		if dryRun {
+			denied = statuserr.New(http.StatusForbidden, fmt.Errorf("only dry-run allowed, forwarding to %s denied", target))
+		}
+	} else {
+		// trim agent host prefix
+		req.URL.Path = strings.TrimPrefix(req.URL.Path, "/proxies/"+cluster.host)
+
+		// enforce restriction of gateway again before reaching kube apiserver, like dry-run and namespaces of cluster-wide list
+		if !restriction.IsZero() {
+			attrs, err := auth.RequestAttributesFromRequest(req)
+			if err != nil {
+				denied = statuserr.New(http.StatusBadRequest, err)
+			} else if dryRun && auth.IsConnect(attrs) {
+				denied = statuserr.New(http.StatusForbidden, fmt.Errorf("only dry-run allowed, %s %s denied", attrs.GetVerb(), attrs.GetPath()))
+			} else {
+				filter := NewRestrictedFilter(restriction, attrs)
+				filter.WrapRequest(req)
+				// response filtered by the transport of proxy handler
+				req = req.WithContext(WithRestrictedFilter(req.Context(), filter))
+			}
+		}
+	}
 
 	// delete Authorization to make sure cluster token used
 	req.Header.Del("Authorization")
@@ -143,6 +323,7 @@ func (a *Agent) DoRequest(ctx context.Context, c *websocket.Conn, requestID stri
 	defer func() {
 		log := logr.FromContext(ctx).WithValues(
 			"requestId", requestID,
+			"user", actor,
 			"method", req.Method,
 			"status", statusCode,
 			"url", req.URL.String(),
@@ -156,29 +337,58 @@ func (a *Agent) DoRequest(ctx context.Context, c *websocket.Conn, requestID stri
 		}
 	}()
 
-	w, err := c.NextWriter(websocket.BinaryMessage)
-	if err != nil {
-		return err
-	}
+	w := &messageStreamWriter{conn: c}
 
 	rw := NewResponseWriter(w)
 
-	a.handler.ServeHTTP(rw, req)
+	if denied == nil {
+		denied = authorize()
+	}
+
+	if denied != nil {
+		statuserr.WriteToResp(rw, statuserr.New(http.StatusForbidden, denied))
+	} else {
+		handler.ServeHTTP(rw, req)
+	}
 
 	if s, ok := rw.(interface{ StatusCode() int }); ok {
 		statusCode = s.StatusCode()
 	}
 
+	agentRequests.WithLabelValues(cluster.host, strconv.Itoa(statusCode)).Inc()
+
 	return w.Close()
 }
 
-func (a *Agent) startReceiver(ctx context.Context) error {
-	c, err := a.Dial(ctx, fmt.Sprintf("/agents/%s/register", a.opt.Host), nil)
+func (a *Agent) startReceiver(ctx context.Context, cluster *agentCluster) error {
+	c, resp, err := a.Dial(ctx, cluster.host, fmt.Sprintf("/agents/%s/register", cluster.host), http.Header{
+		HTTP_HEADER_KUBE_AGENT_LABELS: {a.opt.Labels.String()},
+	})
 	if err != nil {
 		return err
 	}
 
-	r := NewReceiver(c, a.Do)
+	r := NewReceiver(c, resp.Header.Get(HTTP_KUBE_AGENT_TUNNEL_SECRET), func(ctx context.Context, requestID string, proof string) {
+		a.Do(ctx, cluster, requestID, proof)
+	})
+	r.InFlight = &a.wg
+
+	a.receivers.Store(r, true)
+	agentTunnels.WithLabelValues(cluster.host).Inc()
+
+	// renew once, when gateway asks to reconnect or the tunnel closed
+	renewed := int32(0)
+	renew := func() {
+		if atomic.CompareAndSwapInt32(&renewed, 0, 1) {
+			a.maybeRenewReceiver(ctx, cluster)
+		}
+	}
+
+	// keep the current tunnel until closed by gateway, requests may still be dispatched before the new one registered
+	r.OnReconnect = func() {
+		logr.FromContext(ctx).Info("gateway %s asks to reconnect", a.opt.GatewayAddress)
+		renew()
+	}
 
 	go func() {
 		<-a.close
@@ -189,58 +399,87 @@ func (a *Agent) startReceiver(ctx context.Context) error {
 
 	go func() {
 		r.Start(ctx)
-		a.maybeRenewReceiver(ctx)
+		a.receivers.Delete(r)
+		agentTunnels.WithLabelValues(cluster.host).Dec()
+		renew()
 	}()
 
 	return nil
 }
 
-func (r *Receiver) Close() error {
-	return r.conn.Close()
-}
-
-func (a *Agent) maybeRenewReceiver(ctx context.Context) {
+func (a *Agent) maybeRenewReceiver(ctx context.Context, cluster *agentCluster) {
 	if !a.Closed() {
 		go func() {
 			time.Sleep(a.opt.RetryInterval.AsDuration())
 
-			a.receiver <- struct{}{}
+			select {
+			case a.receiver <- cluster:
+			case <-a.close:
+			}
 		}()
 	}
 }
 
+// Serve serves until ctx canceled, then shutdowns in shutdown timeout
 func (a *Agent) Serve(ctx context.Context) error {
 	log := logr.FromContext(ctx)
 
-	a.InjectContext = func(ctx context.Context) context.Context {
-		ctx = logr.WithLogger(ctx, log.WithValues("agent", a.opt.Host))
-		return ctx
+	a.resolveEnvelopeVerification(ctx)
+
+	if a.opt.MetricsAddress != "" {
+		srv := &http.Server{Addr: a.opt.MetricsAddress, Handler: metricsHandler()}
+
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Error(err)
+			}
+		}()
+
+		defer func() {
+			_ = srv.Close()
+		}()
 	}
 
-	ctx = a.InjectContext(ctx)
+	// in-flight requests should not be canceled with ctx, but by Shutdown
+	runCtx := withoutCancel{Context: ctx}
+
+	clusterContexts := map[*agentCluster]context.Context{}
+	for _, cluster := range a.clusters {
+		clusterContexts[cluster] = logr.WithLogger(runCtx, log.WithValues("agent", cluster.host))
+
+		if interval := a.opt.ReloadInterval.AsDuration(); interval > 0 {
+			if p, ok := cluster.handler.(*reloadingProxy); ok {
+				go p.Watch(logr.WithLogger(ctx, log.WithValues("agent", cluster.host)), interval)
+			}
+		}
+	}
 
 	go func() {
-		for range a.receiver {
-			if err := a.startReceiver(ctx); err != nil {
-				log.Error(err)
-				a.maybeRenewReceiver(ctx)
-			} else {
-				log.Info("agent for %s at %s is ready", a.opt.Host, a.opt.GatewayAddress)
+		for {
+			select {
+			case <-a.close:
+				return
+			case cluster := <-a.receiver:
+				ctx := clusterContexts[cluster]
+
+				if err := a.startReceiver(ctx, cluster); err != nil {
+					logr.FromContext(ctx).Error(err)
+					a.maybeRenewReceiver(ctx, cluster)
+				} else {
+					logr.FromContext(ctx).Info("agent for %s at %s is ready", cluster.host, a.opt.GatewayAddress)
+				}
 			}
 		}
 	}()
 
-	//for i := 0; i < 1; i++ {
-	a.receiver <- struct{}{}
-	//}
-
-	stopCh := make(chan os.Signal, 1)
-	signal.Notify(stopCh, os.Interrupt, syscall.SIGTERM)
+	for _, cluster := range a.clusters {
+		a.receiver <- cluster
+	}
 
-	<-stopCh
+	<-ctx.Done()
 
-	timeout := 5 * time.Second
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	timeout := a.opt.ShutdownTimeout.AsDuration()
+	ctx, cancel := context.WithTimeout(runCtx, timeout)
 	defer cancel()
 
 	log.Info(fmt.Sprintf("shutdowning in %s", timeout))
@@ -248,13 +487,101 @@ func (a *Agent) Serve(ctx context.Context) error {
 	return a.Shutdown(ctx)
 }
 
+// resolveEnvelopeVerification keeps envelope verification only when gateway publishes signing keys,
+// gateways without keys never sign envelopes.
+func (a *Agent) resolveEnvelopeVerification(ctx context.Context) {
+	log := logr.FromContext(ctx)
+
+	if a.keySet == nil {
+		log.Warn(fmt.Errorf("envelope verification skipped, requests from gateway run without dry-run and namespace restrictions of gateway"))
+		return
+	}
+
+	for {
+		err := a.keySet.Sync(ctx)
+		if err == nil {
+			go func() {
+				_ = a.keySet.Serve(ctx)
+			}()
+			return
+		}
+
+		if errors.Is(err, jwtutil.ErrKeySetNotFound) {
+			log.Warn(fmt.Errorf("gateway publishes no signing keys, requests from gateway run without envelope verification"))
+
+			a.keySet = nil
+			for _, cluster := range a.clusters {
+				cluster.envelopes = nil
+			}
+			return
+		}
+
+		log.Warn(errors.Wrap(err, "fetch signing keys of gateway"))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(a.opt.RetryInterval.AsDuration()):
+		}
+	}
+}
+
+// Shutdown tells gateway the agent is going away, and waits in-flight requests done until ctx done,
+// requests not done will be canceled and reported.
 func (a *Agent) Shutdown(ctx context.Context) error {
-	atomic.AddInt64(&a.closed, 1)
+	if !atomic.CompareAndSwapInt64(&a.closed, 0, 1) {
+		return nil
+	}
+
+	log := logr.FromContext(ctx)
+
+	a.receivers.Range(func(key, value interface{}) bool {
+		if err := key.(*Receiver).GoingAway(); err != nil {
+			log.Warn(err)
+		}
+		return true
+	})
+
+	done := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = a.cutOff(ctx)
+	}
 
 	close(a.close)
-	close(a.receiver)
 
-	a.wg.Wait()
+	return err
+}
 
-	return nil
+func (a *Agent) cutOff(ctx context.Context) error {
+	log := logr.FromContext(ctx)
+
+	n := 0
+
+	a.inflight.Range(func(key, value interface{}) bool {
+		r := value.(*inflightRequest)
+		r.cancel()
+		n++
+
+		log.WithValues(
+			"requestId", key,
+			"method", r.Method,
+			"url", r.URL,
+			"cost", time.Since(r.StartedAt).String(),
+		).Warn(fmt.Errorf("cut off by shutdown"))
+		return true
+	})
+
+	if n == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d in-flight requests cut off by shutdown", n)
 }
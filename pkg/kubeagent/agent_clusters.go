@@ -0,0 +1,198 @@
+package kubeagent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// AgentContexts in format of host-a=context-a,context-b,
+// the context name will be used as agent host when host omitted
+type AgentContexts []AgentContext
+
+type AgentContext struct {
+	Host    string
+	Context string
+}
+
+func (c AgentContexts) String() string {
+	b := strings.Builder{}
+	for i, ctx := range c {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		if ctx.Host != ctx.Context {
+			b.WriteString(ctx.Host)
+			b.WriteString("=")
+		}
+		b.WriteString(ctx.Context)
+	}
+	return b.String()
+}
+
+func (c *AgentContexts) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		return nil
+	}
+
+	contexts := AgentContexts{}
+
+	for _, part := range strings.Split(string(text), ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		ctx := AgentContext{Host: part, Context: part}
+
+		if i := strings.Index(part, "="); i >= 0 {
+			ctx.Host, ctx.Context = part[0:i], part[i+1:]
+		}
+
+		if ctx.Host == "" || ctx.Context == "" {
+			return fmt.Errorf("invalid context %q, should be host=context or context", part)
+		}
+
+		contexts = append(contexts, ctx)
+	}
+
+	*c = contexts
+	return nil
+}
+
+func (c AgentContexts) MarshalText() (text []byte, err error) {
+	return []byte(c.String()), nil
+}
+
+// agentCluster is one cluster served by the agent under its own agent host
+type agentCluster struct {
+	host      string
+	handler   http.Handler
+	envelopes *EnvelopeVerifier
+	// services by target name
+	services map[string]http.Handler
+}
+
+type clusterConfig struct {
+	host string
+	load func() (*rest.Config, error)
+	// kubeconfig files to watch
+	files []string
+}
+
+// WithCluster serves the cluster of the config under the agent host, could be used multiple times
+func WithCluster(host string, cfg *rest.Config) AgentOption {
+	return func(a *Agent) {
+		a.clusterConfigs = append(a.clusterConfigs, clusterConfig{host: host, load: staticConfig(cfg)})
+	}
+}
+
+func staticConfig(cfg *rest.Config) func() (*rest.Config, error) {
+	return func() (*rest.Config, error) {
+		return rest.CopyConfig(cfg), nil
+	}
+}
+
+// resolveClusterConfigs collects clusters from options, contexts and kubeconfig dir,
+// falls back to the single cluster of in-cluster config or kubeconfig under opt.Host.
+func (a *Agent) resolveClusterConfigs() ([]clusterConfig, error) {
+	configs := append([]clusterConfig{}, a.clusterConfigs...)
+
+	for _, ctx := range a.opt.Contexts {
+		load, files := kubeConfigLoader(a.opt.Kubeconfig, ctx.Context, "")
+		configs = append(configs, clusterConfig{host: ctx.Host, load: load, files: files})
+	}
+
+	if a.opt.KubeconfigDir != "" {
+		dirConfigs, err := clusterConfigsFromDir(a.opt.KubeconfigDir)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, dirConfigs...)
+	}
+
+	if len(configs) == 0 {
+		if a.restConfig != nil {
+			return []clusterConfig{{host: a.opt.Host, load: staticConfig(a.restConfig)}}, nil
+		}
+		load, files := kubeConfigLoader(a.opt.Kubeconfig, a.opt.Context, a.opt.Server)
+		return []clusterConfig{{host: a.opt.Host, load: load, files: files}}, nil
+	}
+
+	if a.opt.Host != "" {
+		return nil, fmt.Errorf("host %s could not be used with multiple clusters, agent hosts are named by contexts or kubeconfig files", a.opt.Host)
+	}
+
+	if a.opt.Context != "" || a.opt.Server != "" {
+		return nil, fmt.Errorf("context and server could only be used with single cluster")
+	}
+
+	hosts := map[string]bool{}
+
+	for _, c := range configs {
+		if c.host == "" || strings.ContainsAny(c.host, "@/") {
+			return nil, fmt.Errorf("invalid agent host %q", c.host)
+		}
+		if hosts[c.host] {
+			return nil, fmt.Errorf("duplicated agent host %s", c.host)
+		}
+		hosts[c.host] = true
+	}
+
+	return configs, nil
+}
+
+// clusterConfigsFromDir loads each kubeconfig file in dir with its current context,
+// the file name without extension will be the agent host
+func clusterConfigsFromDir(dir string) ([]clusterConfig, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	configs := make([]clusterConfig, 0, len(files))
+
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+
+		file := filepath.Join(dir, f.Name())
+
+		configs = append(configs, clusterConfig{
+			host: strings.TrimSuffix(f.Name(), filepath.Ext(f.Name())),
+			load: func() (*rest.Config, error) {
+				cfg, err := clientcmd.BuildConfigFromFlags("", file)
+				if err != nil {
+					return nil, errors.Wrapf(err, "load kubeconfig %s", file)
+				}
+				return cfg, nil
+			},
+			files: []string{file},
+		})
+	}
+
+	return configs, nil
+}
+
+// bearerToken of the agent host, read from the file named by agent host in bearer token dir when exists,
+// read on each dial to pick up rotated tokens.
+func (a *Agent) bearerToken(host string) (string, error) {
+	if a.opt.BearerTokenDir != "" {
+		data, err := ioutil.ReadFile(filepath.Join(a.opt.BearerTokenDir, host))
+		if err == nil {
+			return strings.TrimSpace(string(data)), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return a.opt.BearerToken, nil
+}
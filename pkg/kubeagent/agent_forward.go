@@ -0,0 +1,84 @@
+package kubeagent
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/octohelm/kube-agent/pkg/kubeagent/auth"
+	"github.com/octohelm/kube-agent/pkg/statuserr"
+)
+
+// ForwardTargets in format of *.db.svc:5432,redis:6379
+type ForwardTargets []string
+
+func (t ForwardTargets) String() string {
+	return strings.Join(t, ",")
+}
+
+func (t *ForwardTargets) UnmarshalText(text []byte) error {
+	targets := ForwardTargets{}
+	for _, target := range strings.Split(string(text), ",") {
+		if target = strings.TrimSpace(target); target != "" {
+			targets = append(targets, target)
+		}
+	}
+	*t = targets
+	return nil
+}
+
+func (t ForwardTargets) MarshalText() (text []byte, err error) {
+	return []byte(t.String()), nil
+}
+
+func (t ForwardTargets) Allows(target string) bool {
+	return auth.ForwardTargetMatches(t, target)
+}
+
+// forwardTarget returns host:port of path /forwards/{agentHost}/{host:port}
+func forwardTarget(p string, agentHost string) (string, bool) {
+	prefix := "/forwards/" + agentHost + "/"
+	if !strings.HasPrefix(p, prefix) {
+		return "", false
+	}
+	target := strings.TrimPrefix(p, prefix)
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return "", false
+	}
+	return target, true
+}
+
+// forward dials the target, and pipes the tcp stream with messages of c, until any side closed
+func (a *Agent) forward(ctx context.Context, c *websocket.Conn, rw http.ResponseWriter, target string) {
+	conn, err := (&net.Dialer{Timeout: 10 * time.Second}).DialContext(ctx, "tcp", target)
+	if err != nil {
+		statuserr.WriteToResp(rw, statuserr.New(http.StatusBadGateway, err))
+		return
+	}
+	defer conn.Close()
+
+	rw.Header().Set("Connection", "Upgrade")
+	rw.Header().Set("Upgrade", HTTP_UPGRADE_TCP)
+	rw.WriteHeader(http.StatusSwitchingProtocols)
+
+	f := rw.(http.Flusher)
+	f.Flush()
+
+	go func() {
+		// gateway closed or canceled by shutdown
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	go func() {
+		_, _ = io.Copy(conn, &messageStreamReader{conn: c})
+		_ = conn.Close()
+	}()
+
+	// each read sends a message, for interactive protocols
+	_, _ = io.Copy(&flushWriter{w: rw, f: f}, conn)
+}
@@ -0,0 +1,147 @@
+package kubeagent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/octohelm/kube-agent/pkg/kubeagent/auth"
+	"github.com/octohelm/kube-agent/pkg/statuserr"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"sigs.k8s.io/yaml"
+)
+
+// AgentPolicy is enforced by agent on requests from gateway, as defense in depth
+type AgentPolicy struct {
+	// Scope of requests allowed, nil means all
+	Scope *auth.Scope
+	// ReadOnly only allows get, list and watch, and GET of non-resource urls,
+	// connect subresources like pods/exec and upgrade requests are denied
+	ReadOnly bool
+}
+
+func AgentPolicyFromFile(filename string) (*auth.Scope, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &auth.Scope{}
+	if err := yaml.UnmarshalStrict(data, s); err != nil {
+		return nil, errors.Wrapf(err, "invalid agent policy %s", filename)
+	}
+
+	if err := s.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid agent policy %s", filename)
+	}
+
+	// objects of response could not be filtered by agent
+	if s.LabelSelector != "" {
+		return nil, fmt.Errorf("invalid agent policy %s: labelSelector is not supported", filename)
+	}
+
+	if len(s.Roles) > 0 {
+		return nil, fmt.Errorf("invalid agent policy %s: roles is not supported", filename)
+	}
+
+	return s, nil
+}
+
+func (p *AgentPolicy) IsZero() bool {
+	return p == nil || (p.Scope == nil && !p.ReadOnly)
+}
+
+// Authorize checks the request relative to kube apiserver, dryRun=All may be added when scope requires.
+func (p *AgentPolicy) Authorize(req *http.Request) error {
+	if p.IsZero() {
+		return nil
+	}
+
+	attrs, err := auth.RequestAttributesFromRequest(req)
+	if err != nil {
+		return statuserr.New(http.StatusBadRequest, err)
+	}
+
+	if p.ReadOnly && !isReadOnly(attrs, req) {
+		return statuserr.New(http.StatusForbidden, fmt.Errorf("agent is read-only, %s %s denied", attrs.GetVerb(), attrs.GetPath()))
+	}
+
+	if p.Scope == nil {
+		return nil
+	}
+
+	restriction, err := p.Scope.Authorize(attrs)
+	if err != nil {
+		return statuserr.New(http.StatusForbidden, fmt.Errorf("denied by agent policy: %s", err))
+	}
+
+	if restriction.FiltersObjects() {
+		return statuserr.New(http.StatusForbidden, fmt.Errorf("denied by agent policy: cluster-wide %s %s, namespace required", attrs.GetVerb(), attrs.GetPath()))
+	}
+
+	if restriction.DryRun {
+		auth.EnforceDryRun(req)
+	}
+
+	return nil
+}
+
+// AuthorizeService checks the request to service target
+func (p *AgentPolicy) AuthorizeService(attrs *auth.RequestInfoAttrs, req *http.Request) error {
+	if p.IsZero() {
+		return nil
+	}
+
+	verb := attrs.GetVerb()
+
+	if p.ReadOnly && ((verb != "get" && verb != "head") || httpstream.IsUpgradeRequest(req)) {
+		return statuserr.New(http.StatusForbidden, fmt.Errorf("agent is read-only, %s %s denied", verb, attrs.GetPath()))
+	}
+
+	if p.Scope == nil {
+		return nil
+	}
+
+	if _, err := p.Scope.Authorize(attrs); err != nil {
+		return statuserr.New(http.StatusForbidden, fmt.Errorf("denied by agent policy: %s", err))
+	}
+
+	return nil
+}
+
+// AuthorizeForward checks the tcp forwarding, which is denied by read-only agent
+func (p *AgentPolicy) AuthorizeForward(attrs *auth.RequestInfoAttrs) error {
+	if p.IsZero() {
+		return nil
+	}
+
+	if p.ReadOnly {
+		return statuserr.New(http.StatusForbidden, fmt.Errorf("agent is read-only, forwarding to %s denied", attrs.GetForwardTarget()))
+	}
+
+	if p.Scope == nil {
+		return nil
+	}
+
+	if _, err := p.Scope.Authorize(attrs); err != nil {
+		return statuserr.New(http.StatusForbidden, fmt.Errorf("denied by agent policy: %s", err))
+	}
+
+	return nil
+}
+
+func isReadOnly(attrs *auth.RequestInfoAttrs, req *http.Request) bool {
+	// websocket or spdy streams, like exec through GET
+	if httpstream.IsUpgradeRequest(req) || auth.IsConnect(attrs) {
+		return false
+	}
+	if attrs.IsResourceRequest() {
+		switch attrs.GetVerb() {
+		case "get", "list", "watch":
+			return true
+		}
+		return false
+	}
+	return req.Method == http.MethodGet || req.Method == http.MethodHead
+}
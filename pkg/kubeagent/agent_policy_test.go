@@ -0,0 +1,88 @@
+package kubeagent
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/octohelm/kube-agent/pkg/statuserr"
+	. "github.com/onsi/gomega"
+)
+
+func TestAgentPolicy(t *testing.T) {
+	request := func(method string, rawURL string) *http.Request {
+		u, _ := url.Parse(rawURL)
+		return &http.Request{Method: method, URL: u}
+	}
+
+	codeOf := func(err error) int {
+		if se, ok := err.(*statuserr.StatusErr); ok {
+			return se.Code
+		}
+		return 0
+	}
+
+	t.Run("read only", func(t *testing.T) {
+		p := &AgentPolicy{ReadOnly: true}
+
+		NewWithT(t).Expect(p.Authorize(request(http.MethodGet, "/api/v1/namespaces/default/pods"))).To(Succeed())
+		NewWithT(t).Expect(p.Authorize(request(http.MethodGet, "/version"))).To(Succeed())
+		NewWithT(t).Expect(codeOf(p.Authorize(request(http.MethodDelete, "/api/v1/namespaces/default/pods/a")))).To(Equal(http.StatusForbidden))
+		NewWithT(t).Expect(codeOf(p.Authorize(request(http.MethodPost, "/api/v1/namespaces/default/pods/a/exec")))).To(Equal(http.StatusForbidden))
+		NewWithT(t).Expect(codeOf(p.Authorize(request(http.MethodGet, "/api/v1/namespaces/default/pods/a/log")))).To(Equal(0))
+
+		t.Run("websocket exec", func(t *testing.T) {
+			req := request(http.MethodGet, "/api/v1/namespaces/default/pods/a/exec?command=sh&stdin=true&tty=true")
+			req.Header = http.Header{
+				"Connection": {"Upgrade"},
+				"Upgrade":    {"websocket"},
+			}
+			NewWithT(t).Expect(codeOf(p.Authorize(req))).To(Equal(http.StatusForbidden))
+		})
+
+		for _, rawURL := range []string{
+			"/api/v1/namespaces/default/pods/a/exec?command=sh",
+			"/api/v1/namespaces/default/pods/a/attach",
+			"/api/v1/namespaces/default/pods/a/portforward",
+			"/api/v1/namespaces/default/pods/a/proxy/metrics",
+			"/api/v1/namespaces/default/services/a/proxy/",
+		} {
+			NewWithT(t).Expect(codeOf(p.Authorize(request(http.MethodGet, rawURL)))).To(Equal(http.StatusForbidden), rawURL)
+		}
+	})
+
+	t.Run("policy file", func(t *testing.T) {
+		tmp, _ := ioutil.TempDir("", "policy")
+		defer os.RemoveAll(tmp)
+
+		filename := filepath.Join(tmp, "policy.yaml")
+		_ = ioutil.WriteFile(filename, []byte(`
+namespaces: ["team-*"]
+rules:
+- apiGroups: [""]
+  resources: ["pods"]
+  verbs: ["*"]
+- nonResourceURLs: ["/version"]
+  verbs: ["get"]
+dryRun: Enforce
+`), 0600)
+
+		s, err := AgentPolicyFromFile(filename)
+		NewWithT(t).Expect(err).To(BeNil())
+
+		p := &AgentPolicy{Scope: s}
+
+		NewWithT(t).Expect(p.Authorize(request(http.MethodGet, "/api/v1/namespaces/team-a/pods"))).To(Succeed())
+		NewWithT(t).Expect(p.Authorize(request(http.MethodGet, "/version"))).To(Succeed())
+		NewWithT(t).Expect(codeOf(p.Authorize(request(http.MethodGet, "/api/v1/namespaces/kube-system/pods")))).To(Equal(http.StatusForbidden))
+		NewWithT(t).Expect(codeOf(p.Authorize(request(http.MethodGet, "/api/v1/namespaces/team-a/secrets")))).To(Equal(http.StatusForbidden))
+		NewWithT(t).Expect(codeOf(p.Authorize(request(http.MethodGet, "/api/v1/pods")))).To(Equal(http.StatusForbidden))
+
+		req := request(http.MethodDelete, "/api/v1/namespaces/team-a/pods/a")
+		NewWithT(t).Expect(p.Authorize(req)).To(Succeed())
+		NewWithT(t).Expect(req.URL.Query().Get("dryRun")).To(Equal("All"))
+	})
+}
@@ -0,0 +1,164 @@
+package kubeagent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/proxy"
+	"sigs.k8s.io/yaml"
+)
+
+// ServiceTargets named upstreams in cluster, proxied by gateway under /services/{agentHost}/{target}/
+type ServiceTargets map[string]ServiceTarget
+
+type ServiceTarget struct {
+	// URL of the upstream, like http://prometheus.monitoring.svc:9090
+	URL string `json:"url"`
+	// TLS settings when upstream is https
+	TLS *ServiceTargetTLS `json:"tls,omitempty"`
+	// AgentHosts limits the target to the clusters of agent hosts, all clusters when empty
+	AgentHosts []string `json:"agentHosts,omitempty"`
+}
+
+type ServiceTargetTLS struct {
+	CAFile             string `json:"caFile,omitempty"`
+	CertFile           string `json:"certFile,omitempty"`
+	KeyFile            string `json:"keyFile,omitempty"`
+	ServerName         string `json:"serverName,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+}
+
+func ServiceTargetsFromFile(filename string) (ServiceTargets, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := ServiceTargets{}
+	if err := yaml.UnmarshalStrict(data, &targets); err != nil {
+		return nil, errors.Wrapf(err, "invalid services %s", filename)
+	}
+
+	if err := targets.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid services %s", filename)
+	}
+
+	return targets, nil
+}
+
+func (targets ServiceTargets) Validate() error {
+	for name, t := range targets {
+		if name == "" || strings.ContainsAny(name, "/@") {
+			return fmt.Errorf("invalid target name %q", name)
+		}
+
+		u, err := url.Parse(t.URL)
+		if err != nil {
+			return errors.Wrapf(err, "invalid url of %s", name)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid url of %s: should be http or https url, but got %q", name, t.URL)
+		}
+	}
+	return nil
+}
+
+// For returns targets served in the cluster of agent host
+func (targets ServiceTargets) For(agentHost string) ServiceTargets {
+	matched := ServiceTargets{}
+	for name, t := range targets {
+		if len(t.AgentHosts) == 0 {
+			matched[name] = t
+			continue
+		}
+		for _, h := range t.AgentHosts {
+			if h == agentHost {
+				matched[name] = t
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// Handler proxies requests with path relative to the target
+func (t *ServiceTarget) Handler() (http.Handler, error) {
+	target, err := url.Parse(t.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// never goes through proxies of environment, upstreams are in cluster
+	transport.Proxy = nil
+
+	if t.TLS != nil {
+		tlsConfig, err := t.TLS.Config()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	p := proxy.NewUpgradeAwareHandler(target, transport, false, false, &responder{})
+	p.UseRequestLocation = true
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		upstreamPath := path.Join("/", target.Path, req.URL.Path)
+		// keep trailing slash, which matters for ui
+		if strings.HasSuffix(req.URL.Path, "/") && !strings.HasSuffix(upstreamPath, "/") {
+			upstreamPath += "/"
+		}
+		req.URL.Path = upstreamPath
+		req.URL.RawPath = ""
+		req.Host = target.Host
+
+		p.ServeHTTP(rw, req)
+	}), nil
+}
+
+func (c *ServiceTargetTLS) Config() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if c.CAFile != "" {
+		ca, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("invalid ca file %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// serviceTarget returns the target of path /services/{agentHost}/{target}/...
+func serviceTarget(p string, agentHost string) (string, bool) {
+	prefix := "/services/" + agentHost + "/"
+	if !strings.HasPrefix(p, prefix) {
+		return "", false
+	}
+	target := strings.SplitN(strings.TrimPrefix(p, prefix), "/", 2)[0]
+	return target, target != ""
+}
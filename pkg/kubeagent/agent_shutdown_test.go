@@ -0,0 +1,47 @@
+package kubeagent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestAgentShutdown(t *testing.T) {
+	newAgent := func() *Agent {
+		return &Agent{receiver: make(chan *agentCluster), close: make(chan struct{})}
+	}
+
+	t.Run("in-flight done", func(t *testing.T) {
+		a := newAgent()
+		a.wg.Add(1)
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			a.wg.Done()
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		NewWithT(t).Expect(a.Shutdown(ctx)).To(Succeed())
+		NewWithT(t).Expect(a.Closed()).To(BeTrue())
+	})
+
+	t.Run("in-flight cut off", func(t *testing.T) {
+		a := newAgent()
+		a.wg.Add(1)
+
+		requestCtx, cancelRequest := context.WithCancel(context.Background())
+		a.inflight.Store("1", &inflightRequest{Method: "GET", URL: "/api/v1/pods?watch=true", StartedAt: time.Now(), cancel: cancelRequest})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		err := a.Shutdown(ctx)
+		NewWithT(t).Expect(err).NotTo(BeNil())
+		NewWithT(t).Expect(err.Error()).To(ContainSubstring("1 in-flight requests"))
+		NewWithT(t).Expect(requestCtx.Err()).To(Equal(context.Canceled))
+	})
+}
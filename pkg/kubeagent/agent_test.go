@@ -1,149 +1,461 @@
-package kubeagent
+package kubeagent_test
 
 import (
+	"bufio"
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
 	"fmt"
 	"io"
-	"math/rand"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
-	"github.com/go-courier/logr"
-	"github.com/octohelm/kube-agent/pkg/httputil"
-	"github.com/octohelm/kube-agent/pkg/idgen"
-	"github.com/octohelm/kube-agent/pkg/netutil"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/octohelm/kube-agent/pkg/jwtutil"
+	"github.com/octohelm/kube-agent/pkg/kubeagent"
+	"github.com/octohelm/kube-agent/pkg/kubeagent/auth"
+	"github.com/octohelm/kube-agent/pkg/kubeagent/kubeagenttest"
+	"github.com/octohelm/kube-agent/pkg/timeutil"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 )
 
-func setupAgents() func() string {
-	log := logr.StdLogger()
+func TestAgent(t *testing.T) {
+	c := kubeagenttest.Start(t, kubeagenttest.Options{
+		Gateways:      3,
+		AgentsPerHost: 3,
+	})
+
+	c.APIServer.AddPod(corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "a", Labels: map[string]string{"app": "a"}}})
+
+	t.Run("simple http through any member", func(t *testing.T) {
+		for i := 0; i < 20; i++ {
+			resp, err := http.Get(c.RandGatewayURL() + "/proxies/local/version")
+			NewWithT(t).Expect(err).To(BeNil())
+
+			info := version.Info{}
+			_ = json.NewDecoder(resp.Body).Decode(&info)
+			_ = resp.Body.Close()
+
+			NewWithT(t).Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			NewWithT(t).Expect(info.GitVersion).To(Equal("v1.22.1"))
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		resp, err := http.Get(c.RandGatewayURL() + "/proxies/local/api/v1/namespaces/default/pods?labelSelector=app%3Da")
+		NewWithT(t).Expect(err).To(BeNil())
+
+		list := corev1.PodList{}
+		_ = json.NewDecoder(resp.Body).Decode(&list)
+		_ = resp.Body.Close()
+
+		NewWithT(t).Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		NewWithT(t).Expect(list.Items).To(HaveLen(1))
+	})
+
+	t.Run("unknown agent", func(t *testing.T) {
+		resp, err := http.Get(c.RandGatewayURL() + "/proxies/unknown/version")
+		NewWithT(t).Expect(err).To(BeNil())
+		_ = resp.Body.Close()
+
+		NewWithT(t).Expect(resp.StatusCode).To(Equal(http.StatusBadGateway))
+	})
+
+	t.Run("watch", func(t *testing.T) {
+		resp, err := http.Get(c.RandGatewayURL() + "/proxies/local/api/v1/namespaces/default/pods?watch=true&timeoutSeconds=1")
+		NewWithT(t).Expect(err).To(BeNil())
+		defer resp.Body.Close()
+
+		NewWithT(t).Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			c.APIServer.AddPod(corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "b"}})
+		}()
 
-	ip := netutil.ExposedIP()
-	idGen, _ := idgen.FromIP(ip)
+		events := make([]string, 0)
 
-	gatewayPorts := []int{8007, 8008, 8009}
-	gatewayAddrs := make([]string, len(gatewayPorts))
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			e := metav1.WatchEvent{}
+			if err := json.Unmarshal(scanner.Bytes(), &e); err == nil {
+				pod := corev1.Pod{}
+				_ = json.Unmarshal(e.Object.Raw, &pod)
+				events = append(events, fmt.Sprintf("%s %s", e.Type, pod.Name))
+			}
+		}
 
-	for i := range gatewayAddrs {
-		gatewayAddrs[i] = fmt.Sprintf("%s:%d", ip, gatewayPorts[i])
+		NewWithT(t).Expect(events).To(Equal([]string{"ADDED a", "ADDED b"}))
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		resp, err := http.Get(c.RandGatewayURL() + "/proxies/local/api/v1/namespaces/default/pods/x")
+		NewWithT(t).Expect(err).To(BeNil())
+		_, _ = io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		NewWithT(t).Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+	})
+}
+
+// signedGateway authenticates agents and users by static tokens, and signs access tokens and envelopes by a new key
+type signedGateway struct {
+	signingKeyFile string
+	tokenFile      string
+	signer         *jwtutil.Signer
+}
+
+func newSignedGateway(t *testing.T) *signedGateway {
+	dir := t.TempDir()
+
+	s := &signedGateway{
+		signingKeyFile: filepath.Join(dir, "signing-key.json"),
+		tokenFile:      filepath.Join(dir, "tokens.csv"),
 	}
 
-	randGateway := func() string {
-		return gatewayAddrs[rand.Intn(len(gatewayAddrs))]
+	privateKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	key, _ := jwk.New(privateKey)
+	data, _ := json.Marshal(key)
+	NewWithT(t).Expect(os.WriteFile(s.signingKeyFile, data, 0600)).To(Succeed())
+
+	k, _ := jwtutil.SigningKeyFromFile(s.signingKeyFile)
+	s.signer, _ = jwtutil.NewSigner(k)
+
+	NewWithT(t).Expect(os.WriteFile(s.tokenFile, []byte(
+		auth.AgentUserName("local")+"-token,"+auth.AgentUserName("local")+",1\n"+
+			"user-token,someone,2\n",
+	), 0600)).To(Succeed())
+
+	return s
+}
+
+func (s *signedGateway) GatewayOpt(i int, opt *kubeagent.GatewayOpt) {
+	opt.AllowAnonymous = false
+	opt.AuthorizationMode = "Scope"
+	opt.TokenAuthFile = s.tokenFile
+	opt.TokenSigningKeyFile = s.signingKeyFile
+	opt.TokenIssuer = "kube-agent"
+	opt.TokenAudience = "kube-agent"
+}
+
+func (s *signedGateway) AgentOpt(i int, opt *kubeagent.AgentOpt) {
+	opt.BearerToken = auth.AgentUserName("local") + "-token"
+	opt.EnvelopeIssuer = "kube-agent"
+}
+
+func TestAgentRestricted(t *testing.T) {
+	s := newSignedGateway(t)
+
+	c := kubeagenttest.Start(t, kubeagenttest.Options{
+		GatewayOpt: s.GatewayOpt,
+		AgentOpt:   s.AgentOpt,
+	})
+
+	c.APIServer.AddPod(corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "a", Labels: map[string]string{"app": "a"}}})
+	c.APIServer.AddPod(corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "b"}})
+
+	tok := jwt.New()
+	_ = tok.Set(jwt.IssuerKey, "kube-agent")
+	_ = tok.Set(jwt.AudienceKey, []string{"kube-agent"})
+	_ = tok.Set(jwt.SubjectKey, "someone")
+	_ = tok.Set(jwt.ExpirationKey, time.Now().Add(time.Hour))
+	_ = tok.Set("scopes", auth.Scopes{
+		"local": {
+			Namespaces:    []string{"default"},
+			LabelSelector: "app=a",
+			Rules:         []auth.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods", "pods/log"}, Verbs: []string{"get", "list"}}},
+		},
+	})
+	accessToken, err := s.signer.Sign(tok)
+	NewWithT(t).Expect(err).To(BeNil())
+
+	get := func(p string) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, c.RandGatewayURL()+p, nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		resp, err := http.DefaultClient.Do(req)
+		NewWithT(t).Expect(err).To(BeNil())
+		data, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return resp.StatusCode, string(data)
 	}
 
-	for _, port := range gatewayPorts {
-		go func(port int) {
-			g, _ := NewGateway(GatewayOpt{
-				ServiceName: "localhost:9007",
-				IP:          ip,
-				Port:        port,
-			})
-
-			g.InjectContext = func(ctx context.Context) context.Context {
-				ctx = idgen.WithIDGen(ctx, idGen)
-				ctx = logr.WithLogger(ctx, log.WithValues("gateway", g.Addr()))
-				return ctx
-			}
+	t.Run("list filtered", func(t *testing.T) {
+		code, body := get("/proxies/local/api/v1/namespaces/default/pods")
+		NewWithT(t).Expect(code).To(Equal(http.StatusOK), body)
+
+		list := corev1.PodList{}
+		NewWithT(t).Expect(json.Unmarshal([]byte(body), &list)).To(Succeed())
+		NewWithT(t).Expect(list.Items).To(HaveLen(1))
+		NewWithT(t).Expect(list.Items[0].Name).To(Equal("a"))
+	})
+
+	t.Run("logs pass through", func(t *testing.T) {
+		code, body := get("/proxies/local/api/v1/namespaces/default/pods/a/log")
+		NewWithT(t).Expect(code).To(Equal(http.StatusOK), body)
+		NewWithT(t).Expect(body).To(Equal("log of default/a\n"))
+	})
+
+	t.Run("object not matched", func(t *testing.T) {
+		code, body := get("/proxies/local/api/v1/namespaces/default/pods/b")
+		NewWithT(t).Expect(code).To(Equal(http.StatusForbidden), body)
+	})
+}
+
+func TestAgentMultiCluster(t *testing.T) {
+	c := kubeagenttest.Start(t, kubeagenttest.Options{})
+
+	dir := t.TempDir()
+
+	for _, name := range []string{"cluster-a", "cluster-b"} {
+		s := kubeagenttest.NewAPIServer()
+		defer s.Close()
+
+		s.AddPod(corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name}})
 
-			ctx := g.InjectContext(context.Background())
+		kubeconfig := clientcmdapi.NewConfig()
+		kubeconfig.Clusters[name] = &clientcmdapi.Cluster{Server: s.URL}
+		kubeconfig.AuthInfos[name] = &clientcmdapi.AuthInfo{}
+		kubeconfig.Contexts[name] = &clientcmdapi.Context{Cluster: name, AuthInfo: name}
+		kubeconfig.CurrentContext = name
 
-			_ = g.Serve(ctx)
-		}(port)
+		NewWithT(t).Expect(clientcmd.WriteToFile(*kubeconfig, filepath.Join(dir, name+".yaml"))).To(Succeed())
 	}
 
-	for i := 0; i < 3; i++ {
-		go func() {
-			a, _ := NewAgent(AgentOpt{
-				Host:           "local",
-				Secure:         false,
-				GatewayAddress: gatewayAddrs[0],
-			})
-
-			a.InjectContext = func(ctx context.Context) context.Context {
-				ctx = logr.WithLogger(ctx, log.WithValues("agent", "local"))
-				return ctx
-			}
+	a, err := kubeagent.NewAgent(kubeagent.AgentOpt{
+		KubeconfigDir:   dir,
+		GatewayAddress:  c.GatewayAddrs[0],
+		RetryInterval:   timeutil.Duration(100 * time.Millisecond),
+		ShutdownTimeout: timeutil.Duration(time.Second),
+	})
+	NewWithT(t).Expect(err).To(BeNil())
 
-			ctx := a.InjectContext(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
 
-			_ = a.Serve(ctx)
-		}()
+	go func() {
+		defer close(done)
+		_ = a.Serve(ctx)
+	}()
+
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	NewWithT(t).Expect(c.WaitTunnels([]string{"cluster-a", "cluster-b"}, 1)).To(Succeed())
+
+	for _, name := range []string{"cluster-a", "cluster-b"} {
+		resp, err := http.Get(c.RandGatewayURL() + "/proxies/" + name + "/api/v1/namespaces/default/pods")
+		NewWithT(t).Expect(err).To(BeNil())
+
+		list := corev1.PodList{}
+		_ = json.NewDecoder(resp.Body).Decode(&list)
+		_ = resp.Body.Close()
+
+		NewWithT(t).Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		NewWithT(t).Expect(list.Items).To(HaveLen(1))
+		NewWithT(t).Expect(list.Items[0].Name).To(Equal(name))
 	}
 
-	time.Sleep(500 * time.Millisecond)
+	t.Run("host with multiple clusters", func(t *testing.T) {
+		_, err := kubeagent.NewAgent(kubeagent.AgentOpt{Host: "local", KubeconfigDir: dir})
+		NewWithT(t).Expect(err).NotTo(BeNil())
+	})
+}
+
+func TestAgentContexts(t *testing.T) {
+	contexts := kubeagent.AgentContexts{}
+	NewWithT(t).Expect(contexts.UnmarshalText([]byte("host-a=context-a, context-b"))).To(Succeed())
+	NewWithT(t).Expect(contexts).To(Equal(kubeagent.AgentContexts{
+		{Host: "host-a", Context: "context-a"},
+		{Host: "context-b", Context: "context-b"},
+	}))
+	NewWithT(t).Expect(contexts.String()).To(Equal("host-a=context-a,context-b"))
 
-	return randGateway
+	NewWithT(t).Expect(contexts.UnmarshalText([]byte("=context-a"))).NotTo(Succeed())
 }
 
-func TestAgent(t *testing.T) {
-	t.Run("simple http", func(t *testing.T) {
-		randGateway := setupAgents()
-		defer time.Sleep(500 * time.Millisecond)
+func TestAgentServices(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte(req.Host + " " + req.URL.RequestURI()))
+	}))
+	defer upstream.Close()
 
-		for i := 0; i < 20; i++ {
-			req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/proxies/local/version", randGateway()), nil)
-			c, err := httputil.ConnClientContext(context.Background())
-			if err != nil {
-				t.Fatal(err)
-			}
-			resp, err := c.Do(req)
-			if err != nil {
-				t.Fatal(err)
-			}
-			if resp.StatusCode != http.StatusOK {
-				panic(resp.StatusCode)
-			}
-			data, _ := io.ReadAll(resp.Body)
-			resp.Body.Close()
-			fmt.Println(string(data))
+	servicesFile := filepath.Join(t.TempDir(), "services.yaml")
+	NewWithT(t).Expect(os.WriteFile(servicesFile, []byte(fmt.Sprintf(`
+echo:
+  url: %s/base
+other:
+  url: %s
+  agentHosts: [other]
+`, upstream.URL, upstream.URL)), 0600)).To(Succeed())
+
+	c := kubeagenttest.Start(t, kubeagenttest.Options{
+		AgentOpt: func(i int, opt *kubeagent.AgentOpt) {
+			opt.ServicesFile = servicesFile
+			opt.ReadOnly = true
+		},
+	})
+
+	do := func(method string, p string) (int, string) {
+		req, _ := http.NewRequest(method, c.RandGatewayURL()+p, nil)
+		resp, err := http.DefaultClient.Do(req)
+		NewWithT(t).Expect(err).To(BeNil())
+		data, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return resp.StatusCode, string(data)
+	}
+
+	t.Run("proxy to target", func(t *testing.T) {
+		code, body := do(http.MethodGet, "/services/local/echo/api/v1/query?q=up")
+		NewWithT(t).Expect(code).To(Equal(http.StatusOK))
+		NewWithT(t).Expect(body).To(Equal(strings.TrimPrefix(upstream.URL, "http://") + " /base/api/v1/query?q=up"))
+
+		code, body = do(http.MethodGet, "/services/local/echo/")
+		NewWithT(t).Expect(code).To(Equal(http.StatusOK))
+		NewWithT(t).Expect(body).To(HaveSuffix(" /base/"))
+	})
+
+	t.Run("target not found", func(t *testing.T) {
+		code, _ := do(http.MethodGet, "/services/local/other/")
+		NewWithT(t).Expect(code).To(Equal(http.StatusNotFound))
+	})
+
+	t.Run("denied by agent policy", func(t *testing.T) {
+		code, _ := do(http.MethodPost, "/services/local/echo/api/v1/query")
+		NewWithT(t).Expect(code).To(Equal(http.StatusForbidden))
+	})
+}
+
+// dryRunAuthorizer allows every request under dry-run only
+type dryRunAuthorizer struct{}
+
+func (dryRunAuthorizer) Authorize(ctx context.Context, a authorizer.Attributes) (authorizer.Decision, string, error) {
+	return authorizer.DecisionDeny, "allowed with restriction, which could not be applied", nil
+}
+
+func (dryRunAuthorizer) AuthorizeWithRestriction(ctx context.Context, a authorizer.Attributes) (authorizer.Decision, string, *auth.Restriction, error) {
+	return authorizer.DecisionAllow, "", &auth.Restriction{DryRun: true}, nil
+}
+
+func TestAgentServicesDryRun(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte(req.Method))
+	}))
+	defer upstream.Close()
+
+	servicesFile := filepath.Join(t.TempDir(), "services.yaml")
+	NewWithT(t).Expect(os.WriteFile(servicesFile, []byte(fmt.Sprintf(`
+echo:
+  url: %s
+`, upstream.URL)), 0600)).To(Succeed())
+
+	s := newSignedGateway(t)
+
+	start := func(t *testing.T, skipEnvelopeVerification bool) *kubeagenttest.Cluster {
+		return kubeagenttest.Start(t, kubeagenttest.Options{
+			GatewayOpt:     s.GatewayOpt,
+			GatewayOptions: []kubeagent.GatewayOption{kubeagent.WithAuthorizer(dryRunAuthorizer{})},
+			AgentOpt: func(i int, opt *kubeagent.AgentOpt) {
+				s.AgentOpt(i, opt)
+				opt.ServicesFile = servicesFile
+				opt.SkipEnvelopeVerification = skipEnvelopeVerification
+			},
+		})
+	}
+
+	do := func(t *testing.T, c *kubeagenttest.Cluster, method string, p string) (int, string) {
+		req, _ := http.NewRequest(method, c.RandGatewayURL()+p, nil)
+		req.Header.Set("Authorization", "Bearer user-token")
+		resp, err := http.DefaultClient.Do(req)
+		NewWithT(t).Expect(err).To(BeNil())
+		data, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return resp.StatusCode, string(data)
+	}
+
+	t.Run("enforced by agent by default", func(t *testing.T) {
+		c := start(t, false)
+
+		for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodOptions} {
+			code, _ := do(t, c, method, "/services/local/echo/")
+			NewWithT(t).Expect(code).To(Equal(http.StatusOK), method)
 		}
+
+		code, body := do(t, c, http.MethodPost, "/services/local/echo/")
+		NewWithT(t).Expect(code).To(Equal(http.StatusForbidden))
+		NewWithT(t).Expect(body).NotTo(ContainSubstring(http.MethodPost))
 	})
 
-	//t.Run("watch", func(t *testing.T) {
-	//	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/hw-dev/api/v1/namespaces/default/pods?watch=1", randGateway()), nil)
-	//	c, err := httputil.ConnClientContext(context.Background())
-	//	if err != nil {
-	//		t.Fatal(err)
-	//	}
-	//
-	//	resp, err := c.Do(req)
-	//	if err != nil {
-	//		t.Fatal(err)
-	//	}
-	//
-	//	buf := make([]byte, 256)
-	//
-	//	for {
-	//		n, err := resp.Body.Read(buf)
-	//		if err == io.EOF {
-	//			break
-	//		}
-	//		fmt.Println(string(buf[:n]))
-	//	}
-	//
-	//	resp.Body.Close()
-	//})
+	t.Run("envelope verification skipped", func(t *testing.T) {
+		c := start(t, true)
+
+		code, body := do(t, c, http.MethodPost, "/services/local/echo/")
+		NewWithT(t).Expect(code).To(Equal(http.StatusOK))
+		NewWithT(t).Expect(body).To(Equal(http.MethodPost))
+	})
 }
 
-//func TestDebug(t *testing.T) {
-//	for i := 0; i < 1; i++ {
-//		req, _ := http.NewRequest(http.MethodGet, "https://kube-agent-gateway.hw-dev.rktl.xyz/proxies/hw-dev/version", nil)
-//		c, err := httputil.ConnClientContext(context.Background())
-//		c.Timeout = 2 * time.Second
-//
-//		if err != nil {
-//			t.Fatal(err)
-//		}
-//		resp, err := c.Do(req)
-//		if err != nil {
-//			t.Fatal(err)
-//		}
-//		if resp.StatusCode != http.StatusOK {
-//			panic(resp.StatusCode)
-//		}
-//		//data, _ := io.ReadAll(resp.Body)
-//		resp.Body.Close()
-//		//fmt.Println(string(data))
-//	}
-//}
+func TestAgentDryRun(t *testing.T) {
+	s := newSignedGateway(t)
+
+	start := func(t *testing.T, skipEnvelopeVerification bool) *kubeagenttest.Cluster {
+		return kubeagenttest.Start(t, kubeagenttest.Options{
+			GatewayOpt:     s.GatewayOpt,
+			GatewayOptions: []kubeagent.GatewayOption{kubeagent.WithAuthorizer(dryRunAuthorizer{})},
+			AgentOpt: func(i int, opt *kubeagent.AgentOpt) {
+				s.AgentOpt(i, opt)
+				opt.SkipEnvelopeVerification = skipEnvelopeVerification
+			},
+		})
+	}
+
+	do := func(t *testing.T, c *kubeagenttest.Cluster, method string, p string, body string) (int, string) {
+		req, _ := http.NewRequest(method, c.RandGatewayURL()+p, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer user-token")
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		NewWithT(t).Expect(err).To(BeNil())
+		data, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return resp.StatusCode, string(data)
+	}
+
+	t.Run("enforced by agent by default", func(t *testing.T) {
+		c := start(t, false)
+
+		code, body := do(t, c, http.MethodPost, "/proxies/local/api/v1/namespaces/default/pods", `{"metadata":{"name":"a"}}`)
+		NewWithT(t).Expect(code).To(Equal(http.StatusCreated), body)
+
+		resp, err := http.Get(c.APIServer.URL + "/api/v1/namespaces/default/pods/a")
+		NewWithT(t).Expect(err).To(BeNil())
+		_ = resp.Body.Close()
+		NewWithT(t).Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+
+		// connecting could not be dry-run, denied by agent
+		code, body = do(t, c, http.MethodPost, "/proxies/local/api/v1/namespaces/default/pods/a/exec?command=sh", "")
+		NewWithT(t).Expect(code).To(Equal(http.StatusForbidden), body)
+		NewWithT(t).Expect(body).To(ContainSubstring("only dry-run allowed"))
+	})
+
+	t.Run("envelope verification skipped", func(t *testing.T) {
+		c := start(t, true)
+
+		// reaches apiserver, which requires upgrade
+		code, body := do(t, c, http.MethodPost, "/proxies/local/api/v1/namespaces/default/pods/a/exec?command=sh", "")
+		NewWithT(t).Expect(code).To(Equal(http.StatusBadRequest), body)
+	})
+}
@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/octohelm/kube-agent/pkg/jwtutil"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+const (
+	// UserExtraScopes holds the json of Scopes, which granted to the user
+	UserExtraScopes = "kube-agent.octohelm.tech/scopes"
+	// AgentUserPrefix is the prefix of user name of agent, like system:kube-agent:{agentHost}
+	AgentUserPrefix = "system:kube-agent:"
+)
+
+func AgentUserName(agentHost string) string {
+	return AgentUserPrefix + agentHost
+}
+
+// IsAnonymous reports whether the user is created by Anonymous for requests without credentials,
+// users authenticated with the same name are not anonymous.
+func IsAnonymous(u user.Info) bool {
+	_, ok := u.(*anonymousUser)
+	return ok
+}
+
+// IsReservedUserName reports whether the name is reserved for anonymous or agents,
+// which could not be claimed by subjects of tokens
+func IsReservedUserName(name string) bool {
+	return name == user.Anonymous || strings.HasPrefix(name, AgentUserPrefix)
+}
+
+// Authenticator returns false without error when the request carries no credentials it could handle
+type Authenticator interface {
+	AuthenticateRequest(req *http.Request) (*authenticator.Response, bool, error)
+}
+
+// Chain authenticates the request by authenticators one by one, until one of them succeeds
+type Chain []Authenticator
+
+func (c Chain) AuthenticateRequest(req *http.Request) (*authenticator.Response, bool, error) {
+	errs := make([]error, 0)
+
+	for i := range c {
+		resp, ok, err := c[i].AuthenticateRequest(req)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if ok {
+			return resp, true, nil
+		}
+	}
+
+	return nil, false, utilerrors.NewAggregate(errs)
+}
+
+// anonymousUser could only be created by Anonymous
+type anonymousUser struct {
+	user.DefaultInfo
+}
+
+func Anonymous() *authenticator.Response {
+	return &authenticator.Response{
+		User: &anonymousUser{
+			DefaultInfo: user.DefaultInfo{
+				Name:   user.Anonymous,
+				Groups: []string{user.AllUnauthenticated},
+			},
+		},
+	}
+}
+
+func bearerToken(req *http.Request) string {
+	return jwtutil.ParseAuthorization(req.Header.Get("Authorization")).Get("Bearer")
+}
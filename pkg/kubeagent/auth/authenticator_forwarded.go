@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+const (
+	HTTP_HEADER_FORWARDED_USER = "X-Kube-Agent-Forwarded-User"
+)
+
+const forwardedUserTTL = 30 * time.Second
+
+type forwardedUser struct {
+	Name   string              `json:"name"`
+	UID    string              `json:"uid,omitempty"`
+	Groups []string            `json:"groups,omitempty"`
+	Extra  map[string][]string `json:"extra,omitempty"`
+}
+
+// ForwardUser signs the authenticated user into request header with the secret shared by gateway members,
+// then the member which request forwarded to could trust the user, even the credentials could not be forwarded like client certificates.
+func ForwardUser(req *http.Request, u user.Info, secret string) error {
+	data, err := json.Marshal(&forwardedUser{
+		Name:   u.GetName(),
+		UID:    u.GetUID(),
+		Groups: u.GetGroups(),
+		Extra:  u.GetExtra(),
+	})
+	if err != nil {
+		return err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(data) + "." + strconv.FormatInt(time.Now().Add(forwardedUserTTL).Unix(), 10)
+
+	req.Header.Set(HTTP_HEADER_FORWARDED_USER, payload+"."+sign(payload, secret))
+
+	return nil
+}
+
+func NewForwardedUserAuthenticator(secret string) Authenticator {
+	return &forwardedUserAuthenticator{secret: secret}
+}
+
+type forwardedUserAuthenticator struct {
+	secret string
+}
+
+func (a *forwardedUserAuthenticator) AuthenticateRequest(req *http.Request) (*authenticator.Response, bool, error) {
+	v := req.Header.Get(HTTP_HEADER_FORWARDED_USER)
+	if v == "" {
+		return nil, false, nil
+	}
+
+	parts := strings.Split(v, ".")
+	if len(parts) != 3 {
+		return nil, false, errors.New("invalid forwarded user")
+	}
+
+	payload := parts[0] + "." + parts[1]
+
+	if !hmac.Equal([]byte(sign(payload, a.secret)), []byte(parts[2])) {
+		return nil, false, errors.New("invalid signature of forwarded user")
+	}
+
+	expiresAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return nil, false, errors.New("forwarded user expired")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, false, errors.Wrap(err, "invalid forwarded user")
+	}
+
+	fu := &forwardedUser{}
+	if err := json.Unmarshal(data, fu); err != nil {
+		return nil, false, errors.Wrap(err, "invalid forwarded user")
+	}
+
+	return &authenticator.Response{
+		User: &user.DefaultInfo{
+			Name:   fu.Name,
+			UID:    fu.UID,
+			Groups: fu.Groups,
+			Extra:  fu.Extra,
+		},
+	}, true, nil
+}
+
+func sign(payload string, secret string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	_, _ = h.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/octohelm/kube-agent/pkg/jwtutil"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+const (
+	// JWTSubjectAgent is the subject of agent token, which audience should be the agent host
+	JWTSubjectAgent = "KUBE_AGENT"
+	// JWTTypeEnvelope is the typ header of envelopes signed by gateway for agents, which are not access tokens
+	JWTTypeEnvelope = "kube-agent-envelope+jwt"
+)
+
+// NewJWTAuthenticator creates jwt authenticator, revocations is optional
+func NewJWTAuthenticator(issuers *jwtutil.Issuers, revocations *RevocationList) Authenticator {
+	return &jwtAuthenticator{issuers: issuers, revocations: revocations}
+}
+
+// NewAgentJWTAuthenticator creates jwt authenticator only accepts agent tokens, revocations is optional
+func NewAgentJWTAuthenticator(issuers *jwtutil.Issuers, revocations *RevocationList) Authenticator {
+	return &jwtAuthenticator{issuers: issuers, revocations: revocations, agentOnly: true}
+}
+
+type jwtAuthenticator struct {
+	issuers     *jwtutil.Issuers
+	revocations *RevocationList
+	agentOnly   bool
+}
+
+func (a *jwtAuthenticator) AuthenticateRequest(req *http.Request) (*authenticator.Response, bool, error) {
+	tokStr := bearerToken(req)
+	if tokStr == "" {
+		return nil, false, nil
+	}
+
+	if typ, _ := jwtutil.TypeOf(tokStr); typ == JWTTypeEnvelope {
+		return nil, false, fmt.Errorf("%w: envelope is not access token", jwtutil.ErrTokenMalformed)
+	}
+
+	t, issuer, err := a.issuers.Validate(req.Context(), tokStr)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if a.agentOnly && t.Subject() != JWTSubjectAgent {
+		return nil, false, fmt.Errorf("invalid subject %q: only agent tokens accepted", t.Subject())
+	}
+
+	// agent tokens use agent host as audience
+	if t.Subject() != JWTSubjectAgent && !issuer.AcceptsAudience(t.Audience()) {
+		return nil, false, fmt.Errorf("%w: %v", jwtutil.ErrAudienceNotAccepted, t.Audience())
+	}
+
+	if a.revocations != nil {
+		if err := a.revocations.IsRevoked(t.JwtID(), t.Subject()); err != nil {
+			return nil, false, err
+		}
+	}
+
+	u, err := UserFromToken(t)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &authenticator.Response{User: u, Audiences: t.Audience()}, true, nil
+}
+
+func UserFromToken(t jwt.Token) (user.Info, error) {
+	u := &user.DefaultInfo{
+		Name:  t.Subject(),
+		UID:   t.JwtID(),
+		Extra: map[string][]string{},
+	}
+
+	if aud := t.Audience(); u.Name == JWTSubjectAgent && len(aud) == 1 {
+		u.Name = AgentUserName(aud[0])
+	} else if IsReservedUserName(u.Name) {
+		return nil, fmt.Errorf("invalid subject %q: reserved", u.Name)
+	}
+
+	if groups, ok := t.Get("groups"); ok {
+		if list, ok := groups.([]interface{}); ok {
+			for i := range list {
+				if g, ok := list[i].(string); ok {
+					u.Groups = append(u.Groups, g)
+				}
+			}
+		}
+	}
+
+	if scopes, ok := t.Get("scopes"); ok {
+		data, err := json.Marshal(scopes)
+		if err != nil {
+			return nil, err
+		}
+		u.Extra[UserExtraScopes] = []string{string(data)}
+	}
+
+	return u, nil
+}
@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jws"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/octohelm/kube-agent/pkg/jwtutil"
+	. "github.com/onsi/gomega"
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+func requestWithBearer(token string) *http.Request {
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	if token != "" {
+		auths := jwtutil.Authorizations{}
+		auths.Add("Bearer", token)
+		req.Header.Set("Authorization", auths.String())
+	}
+	return req
+}
+
+func TestChain(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "auth")
+	defer os.RemoveAll(tmp)
+
+	tokenFile := filepath.Join(tmp, "tokens.csv")
+	_ = ioutil.WriteFile(tokenFile, []byte(`static-token,system:kube-agent:local,1,"agents"`+"\n"), 0600)
+
+	tokenFileAuthenticator, err := NewTokenFileAuthenticator(tokenFile)
+	NewWithT(t).Expect(err).To(BeNil())
+
+	tokenReview := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		review := &authenticationv1.TokenReview{}
+		_ = json.NewDecoder(req.Body).Decode(review)
+
+		if review.Spec.Token == "reviewed-token" {
+			review.Status.Authenticated = true
+			review.Status.User.Username = "reviewed"
+			review.Status.User.Groups = []string{"dev"}
+		}
+
+		_ = json.NewEncoder(rw).Encode(review)
+	}))
+	defer tokenReview.Close()
+
+	chain := Chain{
+		tokenFileAuthenticator,
+		NewTokenReviewAuthenticator(tokenReview.URL),
+	}
+
+	t.Run("static token", func(t *testing.T) {
+		resp, ok, err := chain.AuthenticateRequest(requestWithBearer("static-token"))
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(ok).To(BeTrue())
+		NewWithT(t).Expect(resp.User.GetName()).To(Equal(AgentUserName("local")))
+	})
+
+	t.Run("token review", func(t *testing.T) {
+		resp, ok, err := chain.AuthenticateRequest(requestWithBearer("reviewed-token"))
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(ok).To(BeTrue())
+		NewWithT(t).Expect(resp.User.GetName()).To(Equal("reviewed"))
+		NewWithT(t).Expect(resp.User.GetGroups()).To(Equal([]string{"dev"}))
+	})
+
+	t.Run("unknown token", func(t *testing.T) {
+		_, ok, _ := chain.AuthenticateRequest(requestWithBearer("unknown-token"))
+		NewWithT(t).Expect(ok).To(BeFalse())
+	})
+
+	t.Run("without credentials", func(t *testing.T) {
+		_, ok, err := chain.AuthenticateRequest(requestWithBearer(""))
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(ok).To(BeFalse())
+	})
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	privateKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	key, _ := jwk.New(privateKey)
+	_ = key.Set(jwk.KeyIDKey, "test")
+	_ = key.Set(jwk.AlgorithmKey, jwa.RS256)
+
+	publicKey, _ := jwk.PublicKeyOf(key)
+
+	s := jwk.NewSet()
+	s.Add(publicKey)
+	jwks, _ := json.Marshal(s)
+
+	issuers, err := jwtutil.NewIssuers(jwtutil.IssuersConfig{
+		Issuers: []jwtutil.IssuerConfig{{Issuer: "test", JWKS: jwks, Audiences: []string{"kube-agent"}}},
+	})
+	NewWithT(t).Expect(err).To(BeNil())
+
+	revocations := NewRevocationList()
+	a := NewJWTAuthenticator(issuers, revocations)
+
+	sign := func(claims map[string]interface{}) string {
+		tok := jwt.New()
+		_ = tok.Set(jwt.IssuerKey, "test")
+		_ = tok.Set(jwt.ExpirationKey, time.Now().Add(time.Hour))
+		for k, v := range claims {
+			_ = tok.Set(k, v)
+		}
+		data, _ := jwt.Sign(tok, jwa.RS256, key)
+		return string(data)
+	}
+
+	t.Run("agent token", func(t *testing.T) {
+		resp, ok, err := a.AuthenticateRequest(requestWithBearer(sign(map[string]interface{}{
+			jwt.SubjectKey:  JWTSubjectAgent,
+			jwt.AudienceKey: []string{"local"},
+		})))
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(ok).To(BeTrue())
+		NewWithT(t).Expect(resp.User.GetName()).To(Equal(AgentUserName("local")))
+	})
+
+	t.Run("user token with scopes", func(t *testing.T) {
+		resp, ok, err := a.AuthenticateRequest(requestWithBearer(sign(map[string]interface{}{
+			jwt.SubjectKey:  "someone",
+			jwt.AudienceKey: []string{"kube-agent"},
+			"scopes": map[string]interface{}{
+				"local": map[string]interface{}{"namespaces": []string{"default"}},
+			},
+		})))
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(ok).To(BeTrue())
+
+		scopes, ok, err := ScopesFromUser(resp.User)
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(ok).To(BeTrue())
+		NewWithT(t).Expect(scopes["local"].Namespaces).To(Equal([]string{"default"}))
+	})
+
+	t.Run("user token with reserved subject", func(t *testing.T) {
+		for _, sub := range []string{"system:anonymous", AgentUserName("local")} {
+			_, ok, err := a.AuthenticateRequest(requestWithBearer(sign(map[string]interface{}{
+				jwt.SubjectKey:  sub,
+				jwt.AudienceKey: []string{"kube-agent"},
+			})))
+			NewWithT(t).Expect(ok).To(BeFalse())
+			NewWithT(t).Expect(err).NotTo(BeNil())
+		}
+	})
+
+	t.Run("envelope is not access token", func(t *testing.T) {
+		tok := jwt.New()
+		_ = tok.Set(jwt.IssuerKey, "test")
+		_ = tok.Set(jwt.SubjectKey, "someone")
+		_ = tok.Set(jwt.AudienceKey, []string{"kube-agent"})
+		_ = tok.Set(jwt.ExpirationKey, time.Now().Add(time.Hour))
+
+		hdrs := jws.NewHeaders()
+		_ = hdrs.Set(jws.TypeKey, JWTTypeEnvelope)
+		data, _ := jwt.Sign(tok, jwa.RS256, key, jwt.WithHeaders(hdrs))
+
+		_, ok, err := a.AuthenticateRequest(requestWithBearer(string(data)))
+		NewWithT(t).Expect(ok).To(BeFalse())
+		NewWithT(t).Expect(err).NotTo(BeNil())
+	})
+
+	t.Run("user token without accepted audience", func(t *testing.T) {
+		_, _, err := a.AuthenticateRequest(requestWithBearer(sign(map[string]interface{}{
+			jwt.SubjectKey:  "someone",
+			jwt.AudienceKey: []string{"other"},
+		})))
+		NewWithT(t).Expect(errors.Is(err, jwtutil.ErrAudienceNotAccepted)).To(BeTrue())
+	})
+
+	t.Run("revoked token", func(t *testing.T) {
+		NewWithT(t).Expect(revocations.Revoke(Revocation{JTI: "leaked", ExpiresAt: time.Now().Add(time.Hour)})).To(Succeed())
+
+		_, ok, err := a.AuthenticateRequest(requestWithBearer(sign(map[string]interface{}{
+			jwt.JwtIDKey:    "leaked",
+			jwt.SubjectKey:  "someone",
+			jwt.AudienceKey: []string{"kube-agent"},
+		})))
+		NewWithT(t).Expect(ok).To(BeFalse())
+		NewWithT(t).Expect(errors.Is(err, ErrTokenRevoked)).To(BeTrue())
+	})
+}
+
+func TestForwardedUser(t *testing.T) {
+	req := requestWithBearer("")
+
+	u := Anonymous().User
+	NewWithT(t).Expect(ForwardUser(req, u, "secret")).To(Succeed())
+
+	resp, ok, err := NewForwardedUserAuthenticator("secret").AuthenticateRequest(req)
+	NewWithT(t).Expect(err).To(BeNil())
+	NewWithT(t).Expect(ok).To(BeTrue())
+	NewWithT(t).Expect(resp.User.GetName()).To(Equal(u.GetName()))
+	// only anonymous by Anonymous, never by name
+	NewWithT(t).Expect(IsAnonymous(u)).To(BeTrue())
+	NewWithT(t).Expect(IsAnonymous(resp.User)).To(BeFalse())
+
+	_, _, err = NewForwardedUserAuthenticator("other").AuthenticateRequest(req)
+	NewWithT(t).Expect(err).NotTo(BeNil())
+}
@@ -0,0 +1,33 @@
+package auth
+
+import (
+	"net/http"
+
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/token/tokenfile"
+)
+
+// NewTokenFileAuthenticator loads static tokens from csv file with lines of token,user,uid,"group1,group2"
+func NewTokenFileAuthenticator(path string) (Authenticator, error) {
+	t, err := tokenfile.NewCSV(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewTokenAuthenticator(t), nil
+}
+
+func NewTokenAuthenticator(token authenticator.Token) Authenticator {
+	return &tokenAuthenticator{token: token}
+}
+
+type tokenAuthenticator struct {
+	token authenticator.Token
+}
+
+func (a *tokenAuthenticator) AuthenticateRequest(req *http.Request) (*authenticator.Response, bool, error) {
+	tokStr := bearerToken(req)
+	if tokStr == "" {
+		return nil, false, nil
+	}
+	return a.token.AuthenticateToken(req.Context(), tokStr)
+}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/octohelm/kube-agent/pkg/httputil"
+	"github.com/pkg/errors"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+// NewTokenReviewAuthenticator posts TokenReview to the webhook endpoint to authenticate bearer token
+func NewTokenReviewAuthenticator(endpoint string) Authenticator {
+	return &tokenReviewAuthenticator{endpoint: endpoint, timeout: 10 * time.Second}
+}
+
+type tokenReviewAuthenticator struct {
+	endpoint string
+	timeout  time.Duration
+}
+
+func (a *tokenReviewAuthenticator) AuthenticateRequest(req *http.Request) (*authenticator.Response, bool, error) {
+	tokStr := bearerToken(req)
+	if tokStr == "" {
+		return nil, false, nil
+	}
+
+	review := &authenticationv1.TokenReview{}
+	review.APIVersion = authenticationv1.SchemeGroupVersion.String()
+	review.Kind = "TokenReview"
+	review.Spec.Token = tokStr
+
+	if err := postReview(req.Context(), a.endpoint, a.timeout, review); err != nil {
+		return nil, false, errors.Wrap(err, "token review failed")
+	}
+
+	if !review.Status.Authenticated {
+		if review.Status.Error != "" {
+			return nil, false, errors.New(review.Status.Error)
+		}
+		return nil, false, nil
+	}
+
+	u := &user.DefaultInfo{
+		Name:   review.Status.User.Username,
+		UID:    review.Status.User.UID,
+		Groups: review.Status.User.Groups,
+		Extra:  map[string][]string{},
+	}
+
+	for k, v := range review.Status.User.Extra {
+		u.Extra[k] = v
+	}
+
+	return &authenticator.Response{User: u, Audiences: review.Status.Audiences}, true, nil
+}
+
+// postReview posts review object to endpoint, and decodes the response back into it
+func postReview(ctx context.Context, endpoint string, timeout time.Duration, review interface{}) error {
+	data, err := json.Marshal(review)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	c, err := httputil.ConnClientContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return errors.Errorf("unexpected status %d from %s", resp.StatusCode, endpoint)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(review)
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+// NewX509Authenticator authenticates client certificates signed by the client ca,
+// common name as user name, and organizations as groups
+func NewX509Authenticator(clientCAFile string) (Authenticator, error) {
+	data, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, errors.Errorf("no certificates found in %s", clientCAFile)
+	}
+
+	return &x509Authenticator{roots: roots}, nil
+}
+
+type x509Authenticator struct {
+	roots *x509.CertPool
+}
+
+func (a *x509Authenticator) AuthenticateRequest(req *http.Request) (*authenticator.Response, bool, error) {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return nil, false, nil
+	}
+
+	certs := req.TLS.PeerCertificates
+
+	opts := x509.VerifyOptions{
+		Roots:         a.roots,
+		Intermediates: x509.NewCertPool(),
+		CurrentTime:   time.Now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	for _, intermediate := range certs[1:] {
+		opts.Intermediates.AddCert(intermediate)
+	}
+
+	if _, err := certs[0].Verify(opts); err != nil {
+		return nil, false, errors.Wrap(err, "verify client certificate failed")
+	}
+
+	if certs[0].Subject.CommonName == "" {
+		return nil, false, errors.New("common name of client certificate is empty")
+	}
+
+	return &authenticator.Response{
+		User: &user.DefaultInfo{
+			Name:   certs[0].Subject.CommonName,
+			Groups: certs[0].Subject.Organization,
+		},
+	}, true, nil
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"context"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+// AgentAttributes exposes the agent which the request is proxied to
+type AgentAttributes interface {
+	GetAgentHost() string
+	GetAgentLabels() labels.Set
+}
+
+// ServiceAttributes exposes the service target which the request is proxied to
+type ServiceAttributes interface {
+	// GetServiceTarget returns empty when the request is to kube apiserver
+	GetServiceTarget() string
+	// GetServicePath returns the path relative to the target
+	GetServicePath() string
+}
+
+// ForwardAttributes exposes the host:port which the tcp stream is forwarded to
+type ForwardAttributes interface {
+	// GetForwardTarget returns empty when the request is not tcp forwarding
+	GetForwardTarget() string
+}
+
+// RestrictingAuthorizer could allow the request with restriction,
+// like cluster-wide list which items should be filtered down to the permitted namespaces.
+type RestrictingAuthorizer interface {
+	authorizer.Authorizer
+	AuthorizeWithRestriction(ctx context.Context, a authorizer.Attributes) (authorizer.Decision, string, *Restriction, error)
+}
+
+// AuthorizerChain asks authorizers one by one, the first allow or deny wins
+type AuthorizerChain []authorizer.Authorizer
+
+func (c AuthorizerChain) Authorize(ctx context.Context, a authorizer.Attributes) (authorizer.Decision, string, error) {
+	decision, reason, restriction, err := c.AuthorizeWithRestriction(ctx, a)
+	if decision == authorizer.DecisionAllow && !restriction.IsZero() {
+		return authorizer.DecisionDeny, "allowed with restriction, which could not be applied", err
+	}
+	return decision, reason, err
+}
+
+func (c AuthorizerChain) AuthorizeWithRestriction(ctx context.Context, a authorizer.Attributes) (authorizer.Decision, string, *Restriction, error) {
+	errs := make([]error, 0)
+	reasons := make([]string, 0)
+
+	for i := range c {
+		var decision authorizer.Decision
+		var reason string
+		var restriction *Restriction
+		var err error
+
+		if ra, ok := c[i].(RestrictingAuthorizer); ok {
+			decision, reason, restriction, err = ra.AuthorizeWithRestriction(ctx, a)
+		} else {
+			decision, reason, err = c[i].Authorize(ctx, a)
+		}
+
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if reason != "" {
+			reasons = append(reasons, reason)
+		}
+
+		switch decision {
+		case authorizer.DecisionAllow, authorizer.DecisionDeny:
+			return decision, reason, restriction, err
+		}
+	}
+
+	return authorizer.DecisionNoOpinion, strings.Join(reasons, "\n"), nil, utilerrors.NewAggregate(errs)
+}
+
+func AlwaysAllow() authorizer.Authorizer {
+	return authorizer.AuthorizerFunc(func(ctx context.Context, a authorizer.Attributes) (authorizer.Decision, string, error) {
+		return authorizer.DecisionAllow, "", nil
+	})
+}
@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"context"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+// NewScopeAuthorizer authorizes requests by scopes granted to the user,
+// no opinion when user without scopes. roles is optional for scopes referencing named roles.
+func NewScopeAuthorizer(roles RoleSource) RestrictingAuthorizer {
+	return &scopeAuthorizer{roles: roles}
+}
+
+type scopeAuthorizer struct {
+	roles RoleSource
+}
+
+func (s *scopeAuthorizer) Authorize(ctx context.Context, a authorizer.Attributes) (authorizer.Decision, string, error) {
+	decision, reason, restriction, err := s.AuthorizeWithRestriction(ctx, a)
+	if decision == authorizer.DecisionAllow && !restriction.IsZero() {
+		return authorizer.DecisionDeny, "allowed with restriction, which could not be applied", err
+	}
+	return decision, reason, err
+}
+
+func (s *scopeAuthorizer) AuthorizeWithRestriction(ctx context.Context, a authorizer.Attributes) (authorizer.Decision, string, *Restriction, error) {
+	scopes, ok, err := ScopesFromUser(a.GetUser())
+	if !ok {
+		return authorizer.DecisionNoOpinion, "", nil, nil
+	}
+	if err != nil {
+		return authorizer.DecisionDeny, err.Error(), nil, nil
+	}
+
+	agentHost, agentLabels := "", labels.Set{}
+
+	if aa, ok := a.(AgentAttributes); ok {
+		agentHost, agentLabels = aa.GetAgentHost(), aa.GetAgentLabels()
+	}
+
+	roles := Roles{}
+	if s.roles != nil {
+		roles = s.roles.Roles()
+	}
+
+	// resolve matched scopes only, unknown roles of scopes for other agents should not break the request
+	scopes, err = scopes.Match(agentHost, agentLabels).Resolve(roles)
+	if err != nil {
+		return authorizer.DecisionDeny, err.Error(), nil, nil
+	}
+
+	restriction, err := scopes.Authorize(agentHost, agentLabels, a)
+	if err != nil {
+		return authorizer.DecisionDeny, err.Error(), nil, nil
+	}
+
+	return authorizer.DecisionAllow, "", restriction, nil
+}
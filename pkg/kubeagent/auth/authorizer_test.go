@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+func attrOfUser(u user.Info, method string, p string) *RequestInfoAttrs {
+	a := attr(method, p).(*RequestInfoAttrs)
+	a.User = u
+	a.AgentHost = "local"
+	return a
+}
+
+func userWithScopes(name string, scopes string) user.Info {
+	return &user.DefaultInfo{Name: name, Extra: map[string][]string{UserExtraScopes: {scopes}}}
+}
+
+func TestAuthorizerChain(t *testing.T) {
+	var reviewed int64
+
+	webhook := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&reviewed, 1)
+
+		review := &authorizationv1.SubjectAccessReview{}
+		_ = json.NewDecoder(req.Body).Decode(review)
+
+		if review.Spec.User == "admin" && review.Spec.Extra[UserExtraAgentHost][0] == "local" {
+			review.Status.Allowed = true
+		}
+		if review.Spec.User == "blocked" {
+			review.Status.Denied = true
+			review.Status.Reason = "blocked"
+		}
+
+		_ = json.NewEncoder(rw).Encode(review)
+	}))
+	defer webhook.Close()
+
+	chain := AuthorizerChain{
+		NewScopeAuthorizer(Roles{"pod-reader": {Rules: []PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get", "list"}}}}}),
+		NewWebhookAuthorizer(webhook.URL, time.Minute, time.Minute),
+	}
+
+	ctx := context.Background()
+
+	t.Run("scope allows", func(t *testing.T) {
+		u := userWithScopes("viewer", `{"local":{"namespaces":["default"],"rules":[{"apiGroups":[""],"resources":["pods"],"verbs":["list"]}]}}`)
+
+		decision, _, restriction, err := chain.AuthorizeWithRestriction(ctx, attrOfUser(u, http.MethodGet, "/api/v1/pods"))
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(decision).To(Equal(authorizer.DecisionAllow))
+		NewWithT(t).Expect(restriction.Namespaces).To(Equal([]string{"default"}))
+
+		decision, _, _ = chain.Authorize(ctx, attrOfUser(u, http.MethodGet, "/api/v1/pods"))
+		NewWithT(t).Expect(decision).To(Equal(authorizer.DecisionDeny))
+	})
+
+	t.Run("scope with roles", func(t *testing.T) {
+		u := userWithScopes("viewer", `{"local":{"namespaces":["default"],"roles":["pod-reader"]}}`)
+
+		decision, _, _ := chain.Authorize(ctx, attrOfUser(u, http.MethodGet, "/api/v1/namespaces/default/pods/a"))
+		NewWithT(t).Expect(decision).To(Equal(authorizer.DecisionAllow))
+
+		decision, _, _ = chain.Authorize(ctx, attrOfUser(u, http.MethodDelete, "/api/v1/namespaces/default/pods/a"))
+		NewWithT(t).Expect(decision).To(Equal(authorizer.DecisionDeny))
+
+		unknown := userWithScopes("viewer", `{"local":{"roles":["unknown"]}}`)
+		decision, reason, _ := chain.Authorize(ctx, attrOfUser(unknown, http.MethodGet, "/api/v1/namespaces/default/pods/a"))
+		NewWithT(t).Expect(decision).To(Equal(authorizer.DecisionDeny))
+		NewWithT(t).Expect(reason).To(ContainSubstring("unknown role unknown"))
+
+		// unknown role of scope for other agents
+		other := userWithScopes("viewer", `{"local":{"namespaces":["default"],"roles":["pod-reader"]},"prod-*":{"roles":["unknown"]}}`)
+		decision, _, _ = chain.Authorize(ctx, attrOfUser(other, http.MethodGet, "/api/v1/namespaces/default/pods/a"))
+		NewWithT(t).Expect(decision).To(Equal(authorizer.DecisionAllow))
+	})
+
+	t.Run("scope denies first", func(t *testing.T) {
+		u := userWithScopes("admin", `{"local":{"rules":[{"apiGroups":[""],"resources":["pods"],"verbs":["list"]}]}}`)
+
+		decision, _, err := chain.Authorize(ctx, attrOfUser(u, http.MethodDelete, "/api/v1/namespaces/default/pods/a"))
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(decision).To(Equal(authorizer.DecisionDeny))
+	})
+
+	t.Run("webhook with cache", func(t *testing.T) {
+		u := &user.DefaultInfo{Name: "admin"}
+
+		for i := 0; i < 3; i++ {
+			decision, _, err := chain.Authorize(ctx, attrOfUser(u, http.MethodDelete, "/api/v1/namespaces/default/pods/a"))
+			NewWithT(t).Expect(err).To(BeNil())
+			NewWithT(t).Expect(decision).To(Equal(authorizer.DecisionAllow))
+		}
+		NewWithT(t).Expect(atomic.LoadInt64(&reviewed)).To(Equal(int64(1)))
+
+		decision, reason, _ := chain.Authorize(ctx, attrOfUser(&user.DefaultInfo{Name: "blocked"}, http.MethodGet, "/version"))
+		NewWithT(t).Expect(decision).To(Equal(authorizer.DecisionDeny))
+		NewWithT(t).Expect(reason).To(Equal("blocked"))
+
+		decision, _, _ = chain.Authorize(ctx, attrOfUser(&user.DefaultInfo{Name: "nobody"}, http.MethodGet, "/version"))
+		NewWithT(t).Expect(decision).To(Equal(authorizer.DecisionNoOpinion))
+	})
+}
@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+const (
+	// UserExtraAgentHost holds the agent host which request proxied to in SubjectAccessReview
+	UserExtraAgentHost = "kube-agent.octohelm.tech/agent-host"
+)
+
+// NewWebhookAuthorizer posts SubjectAccessReview to the webhook endpoint,
+// and caches the allowed and denied decisions for ttls
+func NewWebhookAuthorizer(endpoint string, authorizedTTL time.Duration, unauthorizedTTL time.Duration) authorizer.Authorizer {
+	return &webhookAuthorizer{
+		endpoint:        endpoint,
+		timeout:         10 * time.Second,
+		authorizedTTL:   authorizedTTL,
+		unauthorizedTTL: unauthorizedTTL,
+		decisions:       map[string]*cachedDecision{},
+	}
+}
+
+type webhookAuthorizer struct {
+	endpoint        string
+	timeout         time.Duration
+	authorizedTTL   time.Duration
+	unauthorizedTTL time.Duration
+
+	mu        sync.Mutex
+	decisions map[string]*cachedDecision
+}
+
+type cachedDecision struct {
+	decision  authorizer.Decision
+	reason    string
+	expiresAt time.Time
+}
+
+func (w *webhookAuthorizer) Authorize(ctx context.Context, a authorizer.Attributes) (authorizer.Decision, string, error) {
+	review := SubjectAccessReviewFromAttributes(a)
+
+	key, err := cacheKey(review.Spec)
+	if err != nil {
+		return authorizer.DecisionNoOpinion, "", err
+	}
+
+	if d, ok := w.lookup(key); ok {
+		return d.decision, d.reason, nil
+	}
+
+	if err := postReview(ctx, w.endpoint, w.timeout, review); err != nil {
+		return authorizer.DecisionNoOpinion, "", errors.Wrap(err, "subject access review failed")
+	}
+
+	d := &cachedDecision{decision: authorizer.DecisionNoOpinion, reason: review.Status.Reason}
+
+	switch {
+	case review.Status.Allowed:
+		d.decision = authorizer.DecisionAllow
+		d.expiresAt = time.Now().Add(w.authorizedTTL)
+	case review.Status.Denied:
+		d.decision = authorizer.DecisionDeny
+		d.expiresAt = time.Now().Add(w.unauthorizedTTL)
+	default:
+		d.expiresAt = time.Now().Add(w.unauthorizedTTL)
+	}
+
+	if review.Status.EvaluationError == "" {
+		w.store(key, d)
+	}
+
+	return d.decision, d.reason, nil
+}
+
+func (w *webhookAuthorizer) lookup(key string) (*cachedDecision, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	d, ok := w.decisions[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(d.expiresAt) {
+		delete(w.decisions, key)
+		return nil, false
+	}
+	return d, true
+}
+
+func (w *webhookAuthorizer) store(key string, d *cachedDecision) {
+	if d.expiresAt.IsZero() || !d.expiresAt.After(time.Now()) {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// drop expired decisions
+	now := time.Now()
+	for k := range w.decisions {
+		if now.After(w.decisions[k].expiresAt) {
+			delete(w.decisions, k)
+		}
+	}
+
+	w.decisions[key] = d
+}
+
+func SubjectAccessReviewFromAttributes(a authorizer.Attributes) *authorizationv1.SubjectAccessReview {
+	review := &authorizationv1.SubjectAccessReview{}
+	review.APIVersion = authorizationv1.SchemeGroupVersion.String()
+	review.Kind = "SubjectAccessReview"
+
+	if u := a.GetUser(); u != nil {
+		review.Spec.User = u.GetName()
+		review.Spec.UID = u.GetUID()
+		review.Spec.Groups = u.GetGroups()
+
+		review.Spec.Extra = map[string]authorizationv1.ExtraValue{}
+		for k, v := range u.GetExtra() {
+			review.Spec.Extra[k] = v
+		}
+	}
+
+	if aa, ok := a.(AgentAttributes); ok {
+		if review.Spec.Extra == nil {
+			review.Spec.Extra = map[string]authorizationv1.ExtraValue{}
+		}
+		review.Spec.Extra[UserExtraAgentHost] = []string{aa.GetAgentHost()}
+	}
+
+	if a.IsResourceRequest() {
+		review.Spec.ResourceAttributes = &authorizationv1.ResourceAttributes{
+			Namespace:   a.GetNamespace(),
+			Verb:        a.GetVerb(),
+			Group:       a.GetAPIGroup(),
+			Version:     a.GetAPIVersion(),
+			Resource:    a.GetResource(),
+			Subresource: a.GetSubresource(),
+			Name:        a.GetName(),
+		}
+	} else {
+		review.Spec.NonResourceAttributes = &authorizationv1.NonResourceAttributes{
+			Path: a.GetPath(),
+			Verb: a.GetVerb(),
+		}
+	}
+
+	return review
+}
+
+func cacheKey(spec authorizationv1.SubjectAccessReviewSpec) (string, error) {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+const (
+	// DryRunReject rejects mutating requests without dryRun=All
+	DryRunReject = "Reject"
+	// DryRunEnforce adds dryRun=All to mutating requests
+	DryRunEnforce = "Enforce"
+)
+
+type DryRunAttributes interface {
+	IsDryRun() bool
+}
+
+func IsMutating(requestAttributes authorizer.Attributes) bool {
+	if !requestAttributes.IsResourceRequest() {
+		return false
+	}
+	switch requestAttributes.GetVerb() {
+	case "create", "update", "patch", "delete", "deletecollection":
+		return true
+	}
+	return false
+}
+
+func IsDryRunRequest(req *http.Request) bool {
+	for _, v := range req.URL.Query()["dryRun"] {
+		if v == "All" {
+			return true
+		}
+	}
+	return false
+}
+
+// EnforceDryRun makes the request dry-run
+func EnforceDryRun(req *http.Request) {
+	if IsDryRunRequest(req) {
+		return
+	}
+	query := req.URL.Query()
+	query.Set("dryRun", "All")
+	req.URL.RawQuery = query.Encode()
+}
+
+func validateDryRun(dryRun string) error {
+	switch dryRun {
+	case "", DryRunReject, DryRunEnforce:
+		return nil
+	}
+	return fmt.Errorf("dryRun should be one of %s, %s", DryRunReject, DryRunEnforce)
+}
+
+// dryRunAllows checks mutating requests by the dryRun of scope, returns true when dryRun=All should be enforced,
+// which is also true for requests already dry-run, to let agent enforce dryRun=All again.
+func dryRunAllows(dryRun string, requestAttributes authorizer.Attributes) (bool, error) {
+	if dryRun == "" {
+		return false, nil
+	}
+
+	// dryRun is ignored by connect subresources, like pods/exec, the command will run
+	if IsConnect(requestAttributes) {
+		return false, fmt.Errorf("%s %s could not be dry-run", requestAttributes.GetVerb(), requestAttributes.GetPath())
+	}
+
+	if !IsMutating(requestAttributes) {
+		return false, nil
+	}
+
+	if da, ok := requestAttributes.(DryRunAttributes); ok && da.IsDryRun() {
+		return true, nil
+	}
+
+	if dryRun == DryRunEnforce {
+		return true, nil
+	}
+
+	return false, fmt.Errorf("only dry-run allowed to %s %s", requestAttributes.GetVerb(), requestAttributes.GetPath())
+}
@@ -16,6 +16,24 @@ func RulesAllow(requestAttributes authorizer.Attributes, rules ...rbacv1.PolicyR
 	return false
 }
 
+// DenyRulesMatch matches like RulesAllow, but rules restricted by resourceNames match requests without name too,
+// like list, watch, deletecollection and create, which could reach the named objects.
+func DenyRulesMatch(requestAttributes authorizer.Attributes, rules ...rbacv1.PolicyRule) bool {
+	if !requestAttributes.IsResourceRequest() || requestAttributes.GetName() != "" {
+		return RulesAllow(requestAttributes, rules...)
+	}
+
+	for i := range rules {
+		rule := rules[i]
+		rule.ResourceNames = nil
+
+		if RuleAllows(requestAttributes, &rule) {
+			return true
+		}
+	}
+	return false
+}
+
 func RuleAllows(requestAttributes authorizer.Attributes, rule *rbacv1.PolicyRule) bool {
 	if requestAttributes.IsResourceRequest() {
 		combinedResource := requestAttributes.GetResource()
@@ -93,7 +111,7 @@ func ResourceNameMatches(rule *rbacv1.PolicyRule, requestedName string) bool {
 	}
 
 	for _, ruleName := range rule.ResourceNames {
-		if ruleName == requestedName {
+		if globMatches(ruleName, requestedName) {
 			return true
 		}
 	}
@@ -107,7 +125,7 @@ func NamespaceMatches(namespaces []string, requestedNamespace string) bool {
 	}
 
 	for _, ruleName := range namespaces {
-		if ruleName == requestedNamespace {
+		if globMatches(ruleName, requestedNamespace) {
 			return true
 		}
 	}
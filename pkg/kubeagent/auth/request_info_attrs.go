@@ -1,16 +1,51 @@
 package auth
 
 import (
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apiserver/pkg/authentication/user"
 	apirequest "k8s.io/apiserver/pkg/endpoints/request"
 )
 
 type RequestInfoAttrs struct {
 	apirequest.RequestInfo
+	User        user.Info
+	AgentHost   string
+	AgentLabels labels.Set
+	// ServiceTarget when request to service target under /services/{agentHost}/{target}/
+	ServiceTarget string
+	ServicePath   string
+	// ForwardTarget host:port when tcp forwarding under /forwards/{agentHost}/{host:port}
+	ForwardTarget string
+	// DryRun when request with dryRun=All
+	DryRun bool
+}
+
+func (r *RequestInfoAttrs) IsDryRun() bool {
+	return r.DryRun
+}
+
+func (r *RequestInfoAttrs) GetAgentHost() string {
+	return r.AgentHost
+}
+
+func (r *RequestInfoAttrs) GetAgentLabels() labels.Set {
+	return r.AgentLabels
+}
+
+func (r *RequestInfoAttrs) GetServiceTarget() string {
+	return r.ServiceTarget
+}
+
+func (r *RequestInfoAttrs) GetServicePath() string {
+	return r.ServicePath
+}
+
+func (r *RequestInfoAttrs) GetForwardTarget() string {
+	return r.ForwardTarget
 }
 
 func (r *RequestInfoAttrs) GetUser() user.Info {
-	return nil
+	return r.User
 }
 
 func (r *RequestInfoAttrs) GetVerb() string {
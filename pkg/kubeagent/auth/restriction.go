@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+// Restriction narrows down what an allowed request could see
+type Restriction struct {
+	// Namespaces which items of cluster-wide list or watch should be filtered down to
+	Namespaces []string
+	// LabelSelector which objects of get, list or watch should be matched
+	LabelSelector labels.Selector
+	// DryRun when dryRun=All should be added to the mutating request
+	DryRun bool
+}
+
+func (r *Restriction) IsZero() bool {
+	return r == nil || (!r.FiltersObjects() && !r.DryRun)
+}
+
+// FiltersObjects reports whether objects of response should be filtered
+func (r *Restriction) FiltersObjects() bool {
+	return r != nil && (len(r.Namespaces) > 0 || (r.LabelSelector != nil && !r.LabelSelector.Empty()))
+}
+
+// Union merges restrictions of scopes which both allow the request, the result restricts no more than each of them,
+// except label selectors, which could not be or-ed, the one of r is kept when both set but different.
+func (r *Restriction) Union(o *Restriction) *Restriction {
+	if r == nil || o == nil {
+		return &Restriction{}
+	}
+
+	u := &Restriction{
+		DryRun: r.DryRun && o.DryRun,
+	}
+
+	if len(r.Namespaces) > 0 && len(o.Namespaces) > 0 {
+		u.Namespaces = append(u.Namespaces, r.Namespaces...)
+		for _, ns := range o.Namespaces {
+			if !containsString(u.Namespaces, ns) {
+				u.Namespaces = append(u.Namespaces, ns)
+			}
+		}
+	}
+
+	if r.LabelSelector != nil && !r.LabelSelector.Empty() && o.LabelSelector != nil && !o.LabelSelector.Empty() {
+		u.LabelSelector = r.LabelSelector
+	}
+
+	return u
+}
+
+func containsString(list []string, s string) bool {
+	for i := range list {
+		if list[i] == s {
+			return true
+		}
+	}
+	return false
+}
+
+func IsListOrWatch(requestAttributes authorizer.Attributes) bool {
+	if !requestAttributes.IsResourceRequest() {
+		return false
+	}
+	verb := requestAttributes.GetVerb()
+	return verb == "list" || verb == "watch"
+}
+
+// IsObjectRead reports whether the response of the request is object, list of objects or watch events of objects
+func IsObjectRead(requestAttributes authorizer.Attributes) bool {
+	if !requestAttributes.IsResourceRequest() || requestAttributes.GetSubresource() != "" {
+		return false
+	}
+	return requestAttributes.GetVerb() == "get" || IsListOrWatch(requestAttributes)
+}
+
+// IsConnect reports whether the request is to connect or proxy subresources, like pods/exec, pods/portforward and services/proxy,
+// which runs commands in containers or streams to pods, services and nodes, whatever the verb is.
+func IsConnect(requestAttributes authorizer.Attributes) bool {
+	if !requestAttributes.IsResourceRequest() {
+		return false
+	}
+	switch requestAttributes.GetSubresource() {
+	case "exec", "attach", "portforward", "proxy":
+		return true
+	}
+	return false
+}
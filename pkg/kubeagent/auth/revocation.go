@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+var ErrTokenRevoked = errors.New("token is revoked")
+
+// Revocation revokes the token by jti, or all tokens of the subject.
+type Revocation struct {
+	JTI     string `json:"jti,omitempty"`
+	Subject string `json:"subject,omitempty"`
+	// ExpiresAt should be the max expiration of revoked tokens, the revocation will be dropped after that.
+	// zero means never.
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+func (r Revocation) key() string {
+	if r.JTI != "" {
+		return "jti:" + r.JTI
+	}
+	return "sub:" + r.Subject
+}
+
+func (r Revocation) Validate() error {
+	if (r.JTI == "") == (r.Subject == "") {
+		return errors.New("one of jti and subject is required")
+	}
+	return nil
+}
+
+func (r Revocation) IsExpired(now time.Time) bool {
+	return !r.ExpiresAt.IsZero() && now.After(r.ExpiresAt)
+}
+
+func (r Revocation) String() string {
+	s := r.key()
+	if r.Reason != "" {
+		s += " (" + r.Reason + ")"
+	}
+	return s
+}
+
+func NewRevocationList() *RevocationList {
+	return &RevocationList{entries: map[string]Revocation{}}
+}
+
+// RevocationList is shared across gateway members as memberlist.SharedState
+type RevocationList struct {
+	mu      sync.RWMutex
+	entries map[string]Revocation
+}
+
+func (l *RevocationList) LoadFile(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	list := make([]Revocation, 0)
+	if err := yaml.UnmarshalStrict(data, &list); err != nil {
+		return errors.Wrapf(err, "invalid revocations %s", filename)
+	}
+
+	for i := range list {
+		if err := l.Revoke(list[i]); err != nil {
+			return errors.Wrapf(err, "invalid revocations %s", filename)
+		}
+	}
+
+	return nil
+}
+
+func (l *RevocationList) Revoke(r Revocation) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	l.merge(r)
+	return nil
+}
+
+func (l *RevocationList) merge(list ...Revocation) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	for _, r := range list {
+		if r.Validate() != nil || r.IsExpired(now) {
+			continue
+		}
+
+		k := r.key()
+
+		if existed, ok := l.entries[k]; ok {
+			// the longer one wins to make merging idempotent and commutative
+			if existed.ExpiresAt.IsZero() || (!r.ExpiresAt.IsZero() && existed.ExpiresAt.After(r.ExpiresAt)) {
+				continue
+			}
+		}
+
+		l.entries[k] = r
+	}
+
+	for k, r := range l.entries {
+		if r.IsExpired(now) {
+			delete(l.entries, k)
+		}
+	}
+}
+
+// IsRevoked checks the jti and subject of token
+func (l *RevocationList) IsRevoked(jti string, subject string) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	now := time.Now()
+
+	for _, r := range []Revocation{{JTI: jti}, {Subject: subject}} {
+		if r.JTI == "" && r.Subject == "" {
+			continue
+		}
+		if revoked, ok := l.entries[r.key()]; ok && !revoked.IsExpired(now) {
+			return fmt.Errorf("%w: %s", ErrTokenRevoked, revoked)
+		}
+	}
+
+	return nil
+}
+
+func (l *RevocationList) List() []Revocation {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	now := time.Now()
+
+	list := make([]Revocation, 0, len(l.entries))
+	for _, r := range l.entries {
+		if !r.IsExpired(now) {
+			list = append(list, r)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].key() < list[j].key()
+	})
+
+	return list
+}
+
+func (l *RevocationList) LocalState() []byte {
+	data, _ := json.Marshal(l.List())
+	return data
+}
+
+func (l *RevocationList) MergeRemoteState(data []byte) {
+	list := make([]Revocation, 0)
+	if err := json.Unmarshal(data, &list); err != nil {
+		return
+	}
+	l.merge(list...)
+}
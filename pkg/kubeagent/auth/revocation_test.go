@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestRevocationList(t *testing.T) {
+	now := time.Now()
+
+	l := NewRevocationList()
+
+	NewWithT(t).Expect(l.Revoke(Revocation{})).NotTo(Succeed())
+	NewWithT(t).Expect(l.Revoke(Revocation{JTI: "1", Subject: "someone"})).NotTo(Succeed())
+
+	NewWithT(t).Expect(l.Revoke(Revocation{JTI: "1", ExpiresAt: now.Add(time.Hour)})).To(Succeed())
+	NewWithT(t).Expect(l.Revoke(Revocation{Subject: "someone"})).To(Succeed())
+
+	NewWithT(t).Expect(l.IsRevoked("1", "other")).NotTo(Succeed())
+	NewWithT(t).Expect(l.IsRevoked("2", "someone")).NotTo(Succeed())
+	NewWithT(t).Expect(l.IsRevoked("2", "other")).To(Succeed())
+
+	t.Run("merge remote state", func(t *testing.T) {
+		remote := NewRevocationList()
+		_ = remote.Revoke(Revocation{JTI: "1", ExpiresAt: now.Add(2 * time.Hour)})
+		_ = remote.Revoke(Revocation{JTI: "expired", ExpiresAt: now.Add(-time.Hour)})
+		_ = remote.Revoke(Revocation{JTI: "3"})
+
+		l.MergeRemoteState(remote.LocalState())
+		remote.MergeRemoteState(l.LocalState())
+
+		NewWithT(t).Expect(l.List()).To(Equal(remote.List()))
+		NewWithT(t).Expect(l.List()).To(HaveLen(3))
+		NewWithT(t).Expect(l.List()[0].ExpiresAt.Equal(now.Add(2 * time.Hour))).To(BeTrue())
+	})
+}
@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-courier/logr"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+// Role is named rules, which could be referenced by scopes
+type Role struct {
+	Rules []PolicyRule `json:"rules"`
+	Deny  []PolicyRule `json:"deny,omitempty"`
+}
+
+func (r *Role) Validate() error {
+	for i := range r.Rules {
+		if err := validateRule(&r.Rules[i]); err != nil {
+			return errors.Wrapf(err, "invalid rules[%d]", i)
+		}
+	}
+	for i := range r.Deny {
+		if err := validateRule(&r.Deny[i]); err != nil {
+			return errors.Wrapf(err, "invalid deny[%d]", i)
+		}
+	}
+	return nil
+}
+
+type Roles map[string]Role
+
+func (roles Roles) Validate() error {
+	for name := range roles {
+		r := roles[name]
+		if err := r.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid role %s", name)
+		}
+	}
+	return nil
+}
+
+// Roles makes Roles as static RoleSource
+func (roles Roles) Roles() Roles {
+	return roles
+}
+
+type RoleSource interface {
+	Roles() Roles
+}
+
+func RolesFromFile(filename string) (Roles, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	roles := Roles{}
+	if err := yaml.UnmarshalStrict(data, &roles); err != nil {
+		return nil, errors.Wrapf(err, "invalid roles %s", filename)
+	}
+
+	if err := roles.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid roles %s", filename)
+	}
+
+	return roles, nil
+}
+
+func NewRolesFile(filename string) (*RolesFile, error) {
+	f := &RolesFile{filename: filename}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// RolesFile reloads roles when file changed, the last valid roles will be kept when the file is invalid
+type RolesFile struct {
+	filename string
+
+	mu      sync.RWMutex
+	roles   Roles
+	modTime time.Time
+}
+
+func (f *RolesFile) Roles() Roles {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.roles
+}
+
+func (f *RolesFile) Reload() error {
+	info, err := os.Stat(f.filename)
+	if err != nil {
+		return err
+	}
+
+	f.mu.RLock()
+	unchanged := info.ModTime().Equal(f.modTime)
+	f.mu.RUnlock()
+
+	if unchanged {
+		return nil
+	}
+
+	roles, err := RolesFromFile(f.filename)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.roles = roles
+	f.modTime = info.ModTime()
+
+	return nil
+}
+
+// Serve checks changes of the file until ctx done
+func (f *RolesFile) Serve(ctx context.Context) error {
+	t := time.NewTicker(10 * time.Second)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			if err := f.Reload(); err != nil {
+				logr.FromContext(ctx).Warn(errors.Wrap(err, "reload roles failed"))
+			}
+		}
+	}
+}
+
+// Resolve merges rules of roles referenced into the scope
+func (s Scope) Resolve(roles Roles) (Scope, error) {
+	if len(s.Roles) == 0 {
+		return s, nil
+	}
+
+	resolved := s
+	resolved.Roles = nil
+	resolved.Rules = append([]PolicyRule{}, s.Rules...)
+	resolved.Deny = append([]PolicyRule{}, s.Deny...)
+
+	for _, name := range s.Roles {
+		r, ok := roles[name]
+		if !ok {
+			return Scope{}, fmt.Errorf("unknown role %s", name)
+		}
+		resolved.Rules = append(resolved.Rules, r.Rules...)
+		resolved.Deny = append(resolved.Deny, r.Deny...)
+	}
+
+	return resolved, nil
+}
+
+func (scopes Scopes) Resolve(roles Roles) (Scopes, error) {
+	resolved := make(Scopes, len(scopes))
+	for key := range scopes {
+		s, err := scopes[key].Resolve(roles)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid scope of %s", key)
+		}
+		resolved[key] = s
+	}
+	return resolved, nil
+}
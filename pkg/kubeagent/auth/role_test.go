@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestRolesFile(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "roles")
+	defer os.RemoveAll(tmp)
+
+	filename := filepath.Join(tmp, "roles.yaml")
+
+	_ = ioutil.WriteFile(filename, []byte(`
+viewer:
+  rules:
+  - apiGroups: [""]
+    resources: ["pods"]
+    verbs: ["get", "list"]
+`), 0600)
+
+	f, err := NewRolesFile(filename)
+	NewWithT(t).Expect(err).To(BeNil())
+	NewWithT(t).Expect(f.Roles()).To(HaveKey("viewer"))
+
+	t.Run("reload when changed", func(t *testing.T) {
+		_ = ioutil.WriteFile(filename, []byte(`
+editor:
+  rules:
+  - apiGroups: [""]
+    resources: ["pods"]
+    verbs: ["*"]
+`), 0600)
+		_ = os.Chtimes(filename, time.Now(), time.Now().Add(time.Second))
+
+		NewWithT(t).Expect(f.Reload()).To(Succeed())
+		NewWithT(t).Expect(f.Roles()).To(HaveKey("editor"))
+		NewWithT(t).Expect(f.Roles()).NotTo(HaveKey("viewer"))
+	})
+
+	t.Run("keep last valid roles", func(t *testing.T) {
+		_ = ioutil.WriteFile(filename, []byte(`editor: { rules: [ { verbs: [] } ] }`), 0600)
+		_ = os.Chtimes(filename, time.Now(), time.Now().Add(2*time.Second))
+
+		NewWithT(t).Expect(f.Reload()).NotTo(Succeed())
+		NewWithT(t).Expect(f.Roles()).To(HaveKey("editor"))
+	})
+}
+
+func TestScopesFromMapWithRoles(t *testing.T) {
+	scopes, err := ScopesFromMap(map[string]interface{}{
+		"prod-eu": map[string]interface{}{
+			"roles":      []string{"viewer"},
+			"namespaces": []string{"web"},
+		},
+	})
+	NewWithT(t).Expect(err).To(BeNil())
+	NewWithT(t).Expect(scopes["prod-eu"].Roles).To(Equal([]string{"viewer"}))
+
+	resolved, err := scopes.Resolve(Roles{"viewer": {Rules: []PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}}}}})
+	NewWithT(t).Expect(err).To(BeNil())
+	NewWithT(t).Expect(resolved["prod-eu"].Rules).To(HaveLen(1))
+	NewWithT(t).Expect(resolved["prod-eu"].Roles).To(BeEmpty())
+}
@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Schedule is recurring window like 22:00-02:00 on Mon,Tue in UTC,
+// window crossing midnight belongs to the day it starts.
+type Schedule struct {
+	// Days like Mon, Tue, empty means every day
+	Days []string `json:"days,omitempty"`
+	// Start and End in HH:MM
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// TimeZone like Asia/Shanghai, UTC by default
+	TimeZone string `json:"timeZone,omitempty"`
+}
+
+func (s Schedule) String() string {
+	b := strings.Builder{}
+	if len(s.Days) > 0 {
+		b.WriteString(strings.Join(s.Days, ","))
+		b.WriteString(" ")
+	}
+	b.WriteString(s.Start)
+	b.WriteString("-")
+	b.WriteString(s.End)
+	b.WriteString(" ")
+	if s.TimeZone == "" {
+		b.WriteString("UTC")
+	} else {
+		b.WriteString(s.TimeZone)
+	}
+	return b.String()
+}
+
+func (s Schedule) Validate() error {
+	for _, d := range s.Days {
+		if _, ok := weekdays[d]; !ok {
+			return errors.Errorf("invalid day %s", d)
+		}
+	}
+	if _, err := minutesOf(s.Start); err != nil {
+		return errors.Wrap(err, "invalid start")
+	}
+	if _, err := minutesOf(s.End); err != nil {
+		return errors.Wrap(err, "invalid end")
+	}
+	if _, err := s.location(); err != nil {
+		return errors.Wrap(err, "invalid timeZone")
+	}
+	return nil
+}
+
+func (s Schedule) location() (*time.Location, error) {
+	if s.TimeZone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(s.TimeZone)
+}
+
+func (s Schedule) Contains(t time.Time) bool {
+	loc, err := s.location()
+	if err != nil {
+		return false
+	}
+	start, err := minutesOf(s.Start)
+	if err != nil {
+		return false
+	}
+	end, err := minutesOf(s.End)
+	if err != nil {
+		return false
+	}
+
+	lt := t.In(loc)
+	m := lt.Hour()*60 + lt.Minute()
+
+	if start <= end {
+		return s.onDay(lt.Weekday()) && m >= start && m < end
+	}
+
+	// crossing midnight
+	return (s.onDay(lt.Weekday()) && m >= start) || (s.onDay(lt.AddDate(0, 0, -1).Weekday()) && m < end)
+}
+
+func (s Schedule) onDay(d time.Weekday) bool {
+	if len(s.Days) == 0 {
+		return true
+	}
+	for _, day := range s.Days {
+		if weekdays[day] == d {
+			return true
+		}
+	}
+	return false
+}
+
+var weekdays = map[string]time.Weekday{
+	"Sun": time.Sunday,
+	"Mon": time.Monday,
+	"Tue": time.Tuesday,
+	"Wed": time.Wednesday,
+	"Thu": time.Thursday,
+	"Fri": time.Friday,
+	"Sat": time.Saturday,
+}
+
+func minutesOf(hhmm string) (int, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(hhmm, "%d:%d", &h, &m); err != nil || len(hhmm) != 5 {
+		return 0, errors.Errorf("%q should be HH:MM", hhmm)
+	}
+	if h < 0 || h > 24 || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, errors.Errorf("%q out of range", hhmm)
+	}
+	return h*60 + m, nil
+}
+
+// ActiveAt returns error naming the window, when the scope is not valid at t
+func (s *Scope) ActiveAt(t time.Time) error {
+	if s.NotBefore != nil && t.Before(*s.NotBefore) {
+		return fmt.Errorf("scope is not valid before %s", s.NotBefore.Format(time.RFC3339))
+	}
+
+	if s.NotAfter != nil && !t.Before(*s.NotAfter) {
+		return fmt.Errorf("scope is expired at %s", s.NotAfter.Format(time.RFC3339))
+	}
+
+	if len(s.Schedules) == 0 {
+		return nil
+	}
+
+	windows := make([]string, len(s.Schedules))
+
+	for i := range s.Schedules {
+		if s.Schedules[i].Contains(t) {
+			return nil
+		}
+		windows[i] = s.Schedules[i].String()
+	}
+
+	return fmt.Errorf("scope is only valid during %s", strings.Join(windows, "; "))
+}
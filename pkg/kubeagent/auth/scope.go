@@ -0,0 +1,372 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+type PolicyRule = rbacv1.PolicyRule
+
+type Scope struct {
+	// Namespaces supports glob patterns like team-*
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Roles references named roles, which rules will be merged when resolved
+	Roles []string            `json:"roles,omitempty"`
+	Rules []rbacv1.PolicyRule `json:"rules,omitempty"`
+	// Deny rules are evaluated before Rules,
+	// rules with resourceNames deny list, watch, deletecollection and create of the resources too
+	Deny []rbacv1.PolicyRule `json:"deny,omitempty"`
+	// LabelSelector constrains get, list and watch of objects (not subresources) to objects matched
+	LabelSelector string `json:"labelSelector,omitempty"`
+	// NotBefore and NotAfter bound the validity of the scope
+	NotBefore *time.Time `json:"notBefore,omitempty"`
+	NotAfter  *time.Time `json:"notAfter,omitempty"`
+	// Schedules restricts the scope to be valid only during one of the recurring windows
+	Schedules []Schedule `json:"schedules,omitempty"`
+	// DryRun restricts mutating requests to dryRun=All, Reject or Enforce
+	DryRun string `json:"dryRun,omitempty"`
+	// Services grants access to service targets, requests to service targets are only allowed by them
+	Services []ServiceRule `json:"services,omitempty"`
+	// Forwards grants tcp forwarding to host:port through agents, supports glob patterns like *.db.svc:5432
+	Forwards []string `json:"forwards,omitempty"`
+}
+
+func (s *Scope) Validate() error {
+	for _, ns := range s.Namespaces {
+		if err := validateGlob(ns); err != nil {
+			return errors.Wrap(err, "invalid namespaces")
+		}
+	}
+
+	for i, name := range s.Roles {
+		if name == "" {
+			return errors.Errorf("invalid roles[%d]: empty name", i)
+		}
+	}
+
+	for i := range s.Rules {
+		if err := validateRule(&s.Rules[i]); err != nil {
+			return errors.Wrapf(err, "invalid rules[%d]", i)
+		}
+	}
+
+	for i := range s.Deny {
+		if err := validateRule(&s.Deny[i]); err != nil {
+			return errors.Wrapf(err, "invalid deny[%d]", i)
+		}
+	}
+
+	if s.LabelSelector != "" {
+		if _, err := labels.Parse(s.LabelSelector); err != nil {
+			return errors.Wrap(err, "invalid labelSelector")
+		}
+	}
+
+	if s.NotBefore != nil && s.NotAfter != nil && !s.NotBefore.Before(*s.NotAfter) {
+		return errors.New("notBefore should be before notAfter")
+	}
+
+	for i := range s.Schedules {
+		if err := s.Schedules[i].Validate(); err != nil {
+			return errors.Wrapf(err, "invalid schedules[%d]", i)
+		}
+	}
+
+	if err := validateDryRun(s.DryRun); err != nil {
+		return errors.Wrap(err, "invalid dryRun")
+	}
+
+	for i := range s.Services {
+		if err := s.Services[i].Validate(); err != nil {
+			return errors.Wrapf(err, "invalid services[%d]", i)
+		}
+	}
+
+	if err := validateForwards(s.Forwards); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Authorize returns the restriction when request allowed, otherwise returns the reason why denied
+func (s *Scope) Authorize(requestAttributes authorizer.Attributes) (*Restriction, error) {
+	if err := s.ActiveAt(time.Now()); err != nil {
+		return nil, err
+	}
+
+	if sa, ok := requestAttributes.(ServiceAttributes); ok && sa.GetServiceTarget() != "" {
+		return s.authorizeService(sa, requestAttributes.GetVerb())
+	}
+
+	if fa, ok := requestAttributes.(ForwardAttributes); ok && fa.GetForwardTarget() != "" {
+		return s.authorizeForward(fa.GetForwardTarget())
+	}
+
+	restriction := &Restriction{}
+
+	if currentNamespace := requestAttributes.GetNamespace(); currentNamespace != "" {
+		if !NamespaceMatches(s.Namespaces, currentNamespace) {
+			return nil, fmt.Errorf("no access to resources in namespace %s", currentNamespace)
+		}
+	} else if IsListOrWatch(requestAttributes) {
+		// cluster-wide list or watch, items will be filtered down to the permitted namespaces
+		restriction.Namespaces = s.Namespaces
+	}
+
+	if err := s.deny(requestAttributes); err != nil {
+		return nil, err
+	}
+
+	if !RulesAllow(requestAttributes, s.Rules...) {
+		return nil, fmt.Errorf("no access to %s", requestAttributes.GetPath())
+	}
+
+	dryRun, err := dryRunAllows(s.DryRun, requestAttributes)
+	if err != nil {
+		return nil, err
+	}
+	restriction.DryRun = dryRun
+
+	if s.LabelSelector != "" && IsObjectRead(requestAttributes) {
+		selector, err := labels.Parse(s.LabelSelector)
+		if err != nil {
+			return nil, err
+		}
+		restriction.LabelSelector = selector
+	}
+
+	return restriction, nil
+}
+
+// deny returns the reason when the request matched deny rules
+func (s *Scope) deny(requestAttributes authorizer.Attributes) error {
+	if DenyRulesMatch(requestAttributes, s.Deny...) {
+		return fmt.Errorf("access to %s denied", requestAttributes.GetPath())
+	}
+	return nil
+}
+
+// Scopes keyed by exact agent host, glob of agent host like staging-*, or agent selector like env=staging,region in (eu,us)
+type Scopes map[string]Scope
+
+func (scopes Scopes) Validate() error {
+	for key := range scopes {
+		if isAgentSelector(key) {
+			if _, err := labels.Parse(key); err != nil {
+				return errors.Wrapf(err, "invalid agent selector %s", key)
+			}
+		} else if err := validateGlob(key); err != nil {
+			return errors.Wrapf(err, "invalid agent host")
+		}
+
+		s := scopes[key]
+		if err := s.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid scope of %s", key)
+		}
+	}
+	return nil
+}
+
+// ScopesFor returns scopes matched the agent, sorted by key
+func (scopes Scopes) ScopesFor(agentHost string, agentLabels labels.Set) []Scope {
+	matched := scopes.Match(agentHost, agentLabels)
+
+	keys := make([]string, 0, len(matched))
+	for key := range matched {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	list := make([]Scope, 0, len(keys))
+	for _, key := range keys {
+		list = append(list, matched[key])
+	}
+	return list
+}
+
+// Match keeps scopes matched the agent, the one keyed by exact agent host takes precedence,
+// scopes keyed by glob or agent selector are ignored when it exists.
+func (scopes Scopes) Match(agentHost string, agentLabels labels.Set) Scopes {
+	if s, ok := scopes[agentHost]; ok {
+		return Scopes{agentHost: s}
+	}
+
+	matched := Scopes{}
+
+	for key := range scopes {
+		if isAgentSelector(key) {
+			selector, err := labels.Parse(key)
+			if err != nil || !selector.Matches(agentLabels) {
+				continue
+			}
+		} else if !globMatches(key, agentHost) {
+			continue
+		}
+		matched[key] = scopes[key]
+	}
+
+	return matched
+}
+
+// Narrow keeps scopes which could match the agent host, scopes keyed by agent selector are kept,
+// because agent labels are unknown until the agent registered.
+func (scopes Scopes) Narrow(agentHost string) Scopes {
+	narrowed := Scopes{}
+	for key := range scopes {
+		if isAgentSelector(key) || globMatches(key, agentHost) {
+			narrowed[key] = scopes[key]
+		}
+	}
+	return narrowed
+}
+
+// Authorize allows the request when any scope matched the agent allows, but deny rules of all matched scopes apply,
+// and restrictions of scopes which allow the request are merged by union.
+func (scopes Scopes) Authorize(agentHost string, agentLabels labels.Set, requestAttributes authorizer.Attributes) (*Restriction, error) {
+	matched := scopes.ScopesFor(agentHost, agentLabels)
+	if len(matched) == 0 {
+		return nil, fmt.Errorf("no scope for %s", agentHost)
+	}
+
+	if !isServiceOrForward(requestAttributes) {
+		for i := range matched {
+			if err := matched[i].deny(requestAttributes); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var allowed *Restriction
+	var firstErr error
+
+	for i := range matched {
+		restriction, err := matched[i].Authorize(requestAttributes)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if allowed == nil {
+			allowed = restriction
+		} else {
+			allowed = allowed.Union(restriction)
+		}
+	}
+
+	if allowed == nil {
+		return nil, firstErr
+	}
+
+	return allowed, nil
+}
+
+func isServiceOrForward(requestAttributes authorizer.Attributes) bool {
+	if sa, ok := requestAttributes.(ServiceAttributes); ok && sa.GetServiceTarget() != "" {
+		return true
+	}
+	if fa, ok := requestAttributes.(ForwardAttributes); ok && fa.GetForwardTarget() != "" {
+		return true
+	}
+	return false
+}
+
+func isAgentSelector(key string) bool {
+	return strings.ContainsAny(key, "=!(), ")
+}
+
+func ScopesFromMap(m map[string]interface{}) (Scopes, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return ScopesFromJSON(data)
+}
+
+func ScopesFromJSON(data []byte) (Scopes, error) {
+	d := json.NewDecoder(bytes.NewBuffer(data))
+	d.DisallowUnknownFields()
+
+	s := Scopes{}
+	if err := d.Decode(&s); err != nil {
+		return nil, errors.Wrap(err, "invalid scopes")
+	}
+
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// ScopesFromUser returns false when no scopes granted to the user
+func ScopesFromUser(u user.Info) (Scopes, bool, error) {
+	if u == nil {
+		return nil, false, nil
+	}
+	values := u.GetExtra()[UserExtraScopes]
+	if len(values) == 0 {
+		return nil, false, nil
+	}
+	s, err := ScopesFromJSON([]byte(values[0]))
+	if err != nil {
+		return nil, true, err
+	}
+	return s, true, nil
+}
+
+func validateRule(rule *rbacv1.PolicyRule) error {
+	if len(rule.Verbs) == 0 {
+		return errors.New("verbs must not be empty")
+	}
+
+	if len(rule.NonResourceURLs) > 0 {
+		if len(rule.Resources) > 0 || len(rule.APIGroups) > 0 || len(rule.ResourceNames) > 0 {
+			return errors.New("nonResourceURLs could not be mixed with resources")
+		}
+		return nil
+	}
+
+	if len(rule.Resources) == 0 {
+		return errors.New("resources or nonResourceURLs must not be empty")
+	}
+
+	if len(rule.APIGroups) == 0 {
+		return errors.New("apiGroups must not be empty")
+	}
+
+	for _, name := range rule.ResourceNames {
+		if err := validateGlob(name); err != nil {
+			return errors.Wrap(err, "invalid resourceNames")
+		}
+	}
+
+	return nil
+}
+
+func validateGlob(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return errors.Wrapf(err, "%q", pattern)
+	}
+	return nil
+}
+
+func globMatches(pattern string, s string) bool {
+	if pattern == s {
+		return true
+	}
+	matched, _ := path.Match(pattern, s)
+	return matched
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"sigs.k8s.io/yaml"
+)
+
+// ScopeBinding grants scopes to users or groups
+type ScopeBinding struct {
+	Users  []string `json:"users,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+	Scopes Scopes   `json:"scopes"`
+}
+
+func (b *ScopeBinding) Matches(u user.Info) bool {
+	for _, name := range b.Users {
+		if name == u.GetName() {
+			return true
+		}
+	}
+	for _, group := range b.Groups {
+		for _, g := range u.GetGroups() {
+			if g == group {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type ScopeBindings []ScopeBinding
+
+func ScopeBindingsFromFile(filename string) (ScopeBindings, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	bindings := ScopeBindings{}
+	if err := yaml.UnmarshalStrict(data, &bindings); err != nil {
+		return nil, errors.Wrapf(err, "invalid scope bindings %s", filename)
+	}
+
+	if err := bindings.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid scope bindings %s", filename)
+	}
+
+	return bindings, nil
+}
+
+func (bindings ScopeBindings) Validate() error {
+	for i := range bindings {
+		if len(bindings[i].Users) == 0 && len(bindings[i].Groups) == 0 {
+			return errors.Errorf("[%d] users or groups is required", i)
+		}
+		if err := bindings[i].Scopes.Validate(); err != nil {
+			return errors.Wrapf(err, "[%d]", i)
+		}
+	}
+	return nil
+}
+
+// ScopesFor collects scopes of all bindings matched,
+// the scope of the earlier binding wins when bindings share the same key.
+func (bindings ScopeBindings) ScopesFor(u user.Info) Scopes {
+	scopes := Scopes{}
+
+	for i := range bindings {
+		if !bindings[i].Matches(u) {
+			continue
+		}
+		for key, scope := range bindings[i].Scopes {
+			if _, ok := scopes[key]; !ok {
+				scopes[key] = scope
+			}
+		}
+	}
+
+	return scopes
+}
@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	apirequest "k8s.io/apiserver/pkg/endpoints/request"
+)
+
+// VerbConnect is the verb of tcp forwarding requests
+const VerbConnect = "connect"
+
+func validateForwards(forwards []string) error {
+	for _, target := range forwards {
+		if err := validateGlob(target); err != nil {
+			return errors.Wrap(err, "invalid forwards")
+		}
+	}
+	return nil
+}
+
+// ForwardTargetMatches checks host:port with patterns like *.db.svc:5432
+func ForwardTargetMatches(patterns []string, target string) bool {
+	for _, pattern := range patterns {
+		if globMatches(pattern, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeForward authorizes tcp forwarding, which only allowed by forwards of the scope
+func (s *Scope) authorizeForward(target string) (*Restriction, error) {
+	if !ForwardTargetMatches(s.Forwards, target) {
+		return nil, fmt.Errorf("no access to forward to %s", target)
+	}
+
+	// tcp streams could not be dry-run
+	if s.DryRun != "" {
+		return nil, fmt.Errorf("only dry-run allowed, forwarding to %s denied", target)
+	}
+
+	return &Restriction{}, nil
+}
+
+// ForwardRequestAttributes returns attributes of request under /forwards/{agentHost}/{host:port},
+// which is non-resource request with path /forwards/{host:port} and verb connect,
+// to let rbac or webhook authorizers authorize by nonResourceURLs.
+func ForwardRequestAttributes(target string) *RequestInfoAttrs {
+	return &RequestInfoAttrs{
+		RequestInfo: apirequest.RequestInfo{
+			Path: "/forwards/" + target,
+			Verb: VerbConnect,
+		},
+		ForwardTarget: target,
+	}
+}
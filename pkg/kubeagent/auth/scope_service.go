@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apirequest "k8s.io/apiserver/pkg/endpoints/request"
+)
+
+// ServiceRule grants access to service targets proxied by agents
+type ServiceRule struct {
+	// Targets supports glob patterns like grafana-*
+	Targets []string `json:"targets"`
+	// Paths relative to the target, exact or prefix ends with *, like /api/*, all paths when empty
+	Paths []string `json:"paths,omitempty"`
+	// Verbs are lower-cased http methods like get and post, or *
+	Verbs []string `json:"verbs"`
+}
+
+func (r *ServiceRule) Validate() error {
+	if len(r.Targets) == 0 {
+		return errors.New("targets must not be empty")
+	}
+
+	for _, target := range r.Targets {
+		if err := validateGlob(target); err != nil {
+			return errors.Wrap(err, "invalid targets")
+		}
+	}
+
+	for _, p := range r.Paths {
+		if !strings.HasPrefix(p, "/") && p != "*" {
+			return errors.Errorf("invalid paths: %q should start with /", p)
+		}
+	}
+
+	if len(r.Verbs) == 0 {
+		return errors.New("verbs must not be empty")
+	}
+
+	return nil
+}
+
+func (r *ServiceRule) Allows(target string, servicePath string, verb string) bool {
+	if !ServiceTargetMatches(r.Targets, target) {
+		return false
+	}
+
+	if !VerbMatches(&rbacv1.PolicyRule{Verbs: r.Verbs}, verb) {
+		return false
+	}
+
+	if len(r.Paths) == 0 {
+		return true
+	}
+
+	return NonResourceURLMatches(&rbacv1.PolicyRule{NonResourceURLs: r.Paths}, servicePath)
+}
+
+func ServiceTargetMatches(targets []string, target string) bool {
+	for _, pattern := range targets {
+		if globMatches(pattern, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func ServiceRulesAllow(target string, servicePath string, verb string, rules ...ServiceRule) bool {
+	for i := range rules {
+		if rules[i].Allows(target, servicePath, verb) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeService authorizes requests to service targets, which only allowed by services of the scope
+func (s *Scope) authorizeService(sa ServiceAttributes, verb string) (*Restriction, error) {
+	target, servicePath := sa.GetServiceTarget(), sa.GetServicePath()
+
+	if !ServiceRulesAllow(target, servicePath, verb, s.Services...) {
+		return nil, fmt.Errorf("no access to service %s at %s", target, servicePath)
+	}
+
+	if s.DryRun != "" {
+		if !IsReadOnlyServiceVerb(verb) {
+			return nil, fmt.Errorf("only dry-run allowed, %s of service %s denied", verb, target)
+		}
+		// carried to agent, which checks the verb again
+		return &Restriction{DryRun: true}, nil
+	}
+
+	return &Restriction{}, nil
+}
+
+// IsReadOnlyServiceVerb reports whether the service request is allowed under dry-run, which could not be applied to services
+func IsReadOnlyServiceVerb(verb string) bool {
+	return verb == "get" || verb == "head" || verb == "options"
+}
+
+// ServiceRequestAttributesFromRequest returns attributes of request under /services/{agentHost}/{target}/,
+// which is non-resource request with path /services/{target}/... and lower-cased http method as verb,
+// to let rbac or webhook authorizers authorize by nonResourceURLs.
+func ServiceRequestAttributesFromRequest(r *http.Request, agentHost string, target string) *RequestInfoAttrs {
+	servicePath := strings.TrimPrefix(r.URL.Path, "/services/"+agentHost+"/"+target)
+	if !strings.HasPrefix(servicePath, "/") {
+		servicePath = "/" + servicePath
+	}
+
+	return &RequestInfoAttrs{
+		RequestInfo: apirequest.RequestInfo{
+			Path: "/services/" + target + servicePath,
+			Verb: strings.ToLower(r.Method),
+		},
+		ServiceTarget: target,
+		ServicePath:   servicePath,
+	}
+}
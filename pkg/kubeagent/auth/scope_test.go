@@ -0,0 +1,400 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+func TestScope(t *testing.T) {
+	scopes, err := ScopesFromMap(map[string]interface{}{
+		"local": map[string]interface{}{
+			"namespaces": []string{"team-*"},
+			"rules": []map[string]interface{}{
+				{"apiGroups": []string{"*"}, "resources": []string{"*"}, "verbs": []string{"*"}},
+			},
+			"deny": []map[string]interface{}{
+				{"apiGroups": []string{""}, "resources": []string{"secrets"}, "verbs": []string{"*"}},
+				{"apiGroups": []string{""}, "resources": []string{"configmaps"}, "resourceNames": []string{"kube-*"}, "verbs": []string{"*"}},
+			},
+			"labelSelector": "app=web",
+		},
+	})
+	NewWithT(t).Expect(err).To(BeNil())
+
+	s := scopes["local"]
+
+	t.Run("namespace glob", func(t *testing.T) {
+		_, err := s.Authorize(attr(http.MethodGet, "/api/v1/namespaces/team-a/pods/a"))
+		NewWithT(t).Expect(err).To(BeNil())
+
+		_, err = s.Authorize(attr(http.MethodGet, "/api/v1/namespaces/default/pods/a"))
+		NewWithT(t).Expect(err).NotTo(BeNil())
+	})
+
+	t.Run("deny before allow", func(t *testing.T) {
+		_, err := s.Authorize(attr(http.MethodGet, "/api/v1/namespaces/team-a/secrets"))
+		NewWithT(t).Expect(err).NotTo(BeNil())
+
+		_, err = s.Authorize(attr(http.MethodGet, "/api/v1/namespaces/team-a/configmaps/kube-root-ca.crt"))
+		NewWithT(t).Expect(err).NotTo(BeNil())
+
+		_, err = s.Authorize(attr(http.MethodGet, "/api/v1/namespaces/team-a/configmaps/app"))
+		NewWithT(t).Expect(err).To(BeNil())
+	})
+
+	t.Run("named deny without name", func(t *testing.T) {
+		// items named kube-* will be in the list
+		_, err := s.Authorize(attr(http.MethodGet, "/api/v1/namespaces/team-a/configmaps"))
+		NewWithT(t).Expect(err).NotTo(BeNil())
+
+		_, err = s.Authorize(attr(http.MethodGet, "/api/v1/watch/namespaces/team-a/configmaps"))
+		NewWithT(t).Expect(err).NotTo(BeNil())
+
+		_, err = s.Authorize(attr(http.MethodGet, "/api/v1/configmaps"))
+		NewWithT(t).Expect(err).NotTo(BeNil())
+
+		_, err = s.Authorize(attr(http.MethodDelete, "/api/v1/namespaces/team-a/configmaps"))
+		NewWithT(t).Expect(err).NotTo(BeNil())
+
+		_, err = s.Authorize(attr(http.MethodPost, "/api/v1/namespaces/team-a/configmaps"))
+		NewWithT(t).Expect(err).NotTo(BeNil())
+
+		_, err = s.Authorize(attr(http.MethodGet, "/api/v1/namespaces/team-a/pods"))
+		NewWithT(t).Expect(err).To(BeNil())
+	})
+
+	t.Run("restriction", func(t *testing.T) {
+		r, err := s.Authorize(attr(http.MethodGet, "/api/v1/pods"))
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(r.Namespaces).To(Equal([]string{"team-*"}))
+		NewWithT(t).Expect(r.LabelSelector.String()).To(Equal("app=web"))
+
+		r, err = s.Authorize(attr(http.MethodGet, "/api/v1/namespaces/team-a/pods/a/log"))
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(r.IsZero()).To(BeTrue())
+	})
+}
+
+func TestScopesFromMapRejectsMalformed(t *testing.T) {
+	cases := map[string]map[string]interface{}{
+		"unknown field": {
+			"local": map[string]interface{}{"rule": []interface{}{}},
+		},
+		"bad glob": {
+			"local": map[string]interface{}{"namespaces": []string{"team-["}},
+		},
+		"empty verbs": {
+			"local": map[string]interface{}{
+				"rules": []map[string]interface{}{{"apiGroups": []string{""}, "resources": []string{"pods"}}},
+			},
+		},
+		"bad label selector": {
+			"local": map[string]interface{}{"labelSelector": "app in web"},
+		},
+	}
+
+	for name := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := ScopesFromMap(cases[name])
+			NewWithT(t).Expect(err).NotTo(BeNil())
+		})
+	}
+}
+
+func TestScopesFor(t *testing.T) {
+	viewer := map[string]interface{}{
+		"rules": []map[string]interface{}{
+			{"apiGroups": []string{""}, "resources": []string{"pods"}, "verbs": []string{"get"}},
+		},
+	}
+
+	scopes, err := ScopesFromMap(map[string]interface{}{
+		"env=staging,region in (eu,us)": viewer,
+		"dev-*":                         viewer,
+		"prod-eu":                       map[string]interface{}{"namespaces": []string{"web"}, "rules": viewer["rules"]},
+	})
+	NewWithT(t).Expect(err).To(BeNil())
+
+	NewWithT(t).Expect(scopes.ScopesFor("staging-1", labels.Set{"env": "staging", "region": "eu"})).To(HaveLen(1))
+	NewWithT(t).Expect(scopes.ScopesFor("staging-2", labels.Set{"env": "staging", "region": "ap"})).To(HaveLen(0))
+	NewWithT(t).Expect(scopes.ScopesFor("dev-1", nil)).To(HaveLen(1))
+	NewWithT(t).Expect(scopes.ScopesFor("prod-eu", labels.Set{"env": "prod"})).To(HaveLen(1))
+
+	_, err = scopes.Authorize("staging-1", labels.Set{"env": "staging", "region": "us"}, attr(http.MethodGet, "/api/v1/namespaces/default/pods/a"))
+	NewWithT(t).Expect(err).To(BeNil())
+
+	_, err = scopes.Authorize("prod-eu", nil, attr(http.MethodGet, "/api/v1/namespaces/default/pods/a"))
+	NewWithT(t).Expect(err).NotTo(BeNil())
+
+	_, err = ScopesFromMap(map[string]interface{}{"env in (": viewer})
+	NewWithT(t).Expect(err).NotTo(BeNil())
+}
+
+func TestScopesOverlapping(t *testing.T) {
+	all := []map[string]interface{}{
+		{"apiGroups": []string{"*"}, "resources": []string{"*"}, "verbs": []string{"*"}},
+	}
+	denySecrets := []map[string]interface{}{
+		{"apiGroups": []string{""}, "resources": []string{"secrets"}, "verbs": []string{"*"}},
+	}
+
+	scopes, err := ScopesFromMap(map[string]interface{}{
+		"*":        map[string]interface{}{"rules": all},
+		"prod-eu":  map[string]interface{}{"namespaces": []string{"web"}, "rules": all, "deny": denySecrets},
+		"prod-*":   map[string]interface{}{"namespaces": []string{"web"}, "rules": all, "deny": denySecrets},
+		"env=prod": map[string]interface{}{"namespaces": []string{"api"}, "rules": all, "labelSelector": "app=api"},
+	})
+	NewWithT(t).Expect(err).To(BeNil())
+
+	t.Run("exact agent host wins", func(t *testing.T) {
+		_, err := scopes.Authorize("prod-eu", labels.Set{"env": "prod"}, attr(http.MethodGet, "/api/v1/namespaces/web/secrets/a"))
+		NewWithT(t).Expect(err).NotTo(BeNil())
+
+		_, err = scopes.Authorize("prod-eu", labels.Set{"env": "prod"}, attr(http.MethodGet, "/api/v1/namespaces/api/pods/a"))
+		NewWithT(t).Expect(err).NotTo(BeNil())
+
+		_, err = scopes.Authorize("prod-eu", labels.Set{"env": "prod"}, attr(http.MethodGet, "/api/v1/namespaces/web/pods/a"))
+		NewWithT(t).Expect(err).To(BeNil())
+	})
+
+	t.Run("deny of any matched scope", func(t *testing.T) {
+		_, err := scopes.Authorize("prod-us", labels.Set{"env": "prod"}, attr(http.MethodGet, "/api/v1/namespaces/web/secrets/a"))
+		NewWithT(t).Expect(err).NotTo(BeNil())
+
+		_, err = scopes.Authorize("prod-us", labels.Set{"env": "prod"}, attr(http.MethodGet, "/api/v1/namespaces/kube-system/secrets"))
+		NewWithT(t).Expect(err).NotTo(BeNil())
+
+		// allowed by *
+		_, err = scopes.Authorize("prod-us", labels.Set{"env": "prod"}, attr(http.MethodGet, "/api/v1/namespaces/kube-system/pods/a"))
+		NewWithT(t).Expect(err).To(BeNil())
+	})
+
+	t.Run("union of restrictions", func(t *testing.T) {
+		overlapping := Scopes{"prod-*": scopes["prod-*"], "env=prod": scopes["env=prod"]}
+
+		r, err := overlapping.Authorize("prod-us", labels.Set{"env": "prod"}, attr(http.MethodGet, "/api/v1/pods"))
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(r.Namespaces).To(ConsistOf("web", "api"))
+		// prod-* without label selector
+		NewWithT(t).Expect(r.LabelSelector).To(BeNil())
+
+		r, err = scopes.Authorize("prod-us", labels.Set{"env": "prod"}, attr(http.MethodGet, "/api/v1/pods"))
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(r.IsZero()).To(BeTrue())
+	})
+}
+
+func TestScopeActiveAt(t *testing.T) {
+	at := func(s string) time.Time {
+		tt, _ := time.Parse(time.RFC3339, s)
+		return tt
+	}
+
+	t.Run("validity window", func(t *testing.T) {
+		notAfter := at("2021-10-01T00:00:00Z")
+		s := &Scope{NotAfter: &notAfter}
+
+		NewWithT(t).Expect(s.ActiveAt(at("2021-09-30T12:00:00Z"))).To(Succeed())
+
+		err := s.ActiveAt(at("2021-10-01T00:00:00Z"))
+		NewWithT(t).Expect(err).NotTo(BeNil())
+		NewWithT(t).Expect(err.Error()).To(ContainSubstring("2021-10-01T00:00:00Z"))
+	})
+
+	t.Run("schedule crossing midnight", func(t *testing.T) {
+		// 2021-09-27 is Monday
+		s := &Scope{Schedules: []Schedule{{Days: []string{"Mon"}, Start: "22:00", End: "02:00"}}}
+		NewWithT(t).Expect(s.Validate()).To(Succeed())
+
+		NewWithT(t).Expect(s.ActiveAt(at("2021-09-27T23:00:00Z"))).To(Succeed())
+		NewWithT(t).Expect(s.ActiveAt(at("2021-09-28T01:59:00Z"))).To(Succeed())
+		NewWithT(t).Expect(s.ActiveAt(at("2021-09-28T02:00:00Z"))).NotTo(Succeed())
+		NewWithT(t).Expect(s.ActiveAt(at("2021-09-28T23:00:00Z"))).NotTo(Succeed())
+
+		err := s.ActiveAt(at("2021-09-27T12:00:00Z"))
+		NewWithT(t).Expect(err.Error()).To(Equal("scope is only valid during Mon 22:00-02:00 UTC"))
+	})
+
+	t.Run("schedule in time zone", func(t *testing.T) {
+		s := &Scope{Schedules: []Schedule{{Start: "09:00", End: "18:00", TimeZone: "Asia/Shanghai"}}}
+		NewWithT(t).Expect(s.ActiveAt(at("2021-09-27T02:00:00Z"))).To(Succeed())
+		NewWithT(t).Expect(s.ActiveAt(at("2021-09-27T12:00:00Z"))).NotTo(Succeed())
+	})
+
+	t.Run("invalid schedule", func(t *testing.T) {
+		_, err := ScopesFromMap(map[string]interface{}{
+			"local": map[string]interface{}{"schedules": []map[string]interface{}{{"start": "25:00", "end": "02:00"}}},
+		})
+		NewWithT(t).Expect(err).NotTo(BeNil())
+	})
+}
+
+func TestScopeDryRun(t *testing.T) {
+	editor := []map[string]interface{}{
+		{"apiGroups": []string{"apps"}, "resources": []string{"deployments"}, "verbs": []string{"*"}},
+	}
+
+	scopes, err := ScopesFromMap(map[string]interface{}{
+		"reject":  map[string]interface{}{"rules": editor, "dryRun": DryRunReject},
+		"enforce": map[string]interface{}{"rules": editor, "dryRun": DryRunEnforce},
+	})
+	NewWithT(t).Expect(err).To(BeNil())
+
+	dryRunAttr := func(method string, p string) authorizer.Attributes {
+		parts := strings.SplitN(p, "?", 2)
+		a := attr(method, parts[0]).(*RequestInfoAttrs)
+		a.DryRun = len(parts) == 2 && parts[1] == "dryRun=All"
+		return a
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		s := scopes["reject"]
+
+		_, err := s.Authorize(dryRunAttr(http.MethodDelete, "/apis/apps/v1/namespaces/default/deployments/a"))
+		NewWithT(t).Expect(err).NotTo(BeNil())
+
+		r, err := s.Authorize(dryRunAttr(http.MethodDelete, "/apis/apps/v1/namespaces/default/deployments/a?dryRun=All"))
+		NewWithT(t).Expect(err).To(BeNil())
+		// enforced by agent again
+		NewWithT(t).Expect(r.DryRun).To(BeTrue())
+
+		r, err = s.Authorize(dryRunAttr(http.MethodGet, "/apis/apps/v1/namespaces/default/deployments/a"))
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(r.IsZero()).To(BeTrue())
+	})
+
+	t.Run("enforce", func(t *testing.T) {
+		s := scopes["enforce"]
+
+		r, err := s.Authorize(dryRunAttr(http.MethodPost, "/apis/apps/v1/namespaces/default/deployments"))
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(r.DryRun).To(BeTrue())
+	})
+
+	t.Run("connect subresources", func(t *testing.T) {
+		for _, s := range scopes {
+			for _, p := range []string{
+				"/api/v1/namespaces/default/pods/a/exec?dryRun=All",
+				"/api/v1/namespaces/default/pods/a/attach",
+				"/api/v1/namespaces/default/pods/a/portforward",
+				"/api/v1/namespaces/default/pods/a/proxy/metrics",
+				"/api/v1/namespaces/default/services/a/proxy/",
+			} {
+				s.Rules = []PolicyRule{{APIGroups: []string{"*"}, Resources: []string{"*"}, Verbs: []string{"*"}}}
+
+				_, err := s.Authorize(dryRunAttr(http.MethodPost, p))
+				NewWithT(t).Expect(err).NotTo(BeNil(), p)
+
+				_, err = s.Authorize(dryRunAttr(http.MethodGet, p))
+				NewWithT(t).Expect(err).NotTo(BeNil(), p)
+			}
+		}
+	})
+
+	_, err = ScopesFromMap(map[string]interface{}{"local": map[string]interface{}{"rules": editor, "dryRun": "All"}})
+	NewWithT(t).Expect(err).NotTo(BeNil())
+}
+
+func TestScopeServices(t *testing.T) {
+	scopes, err := ScopesFromMap(map[string]interface{}{
+		"local": map[string]interface{}{
+			"rules": []map[string]interface{}{
+				{"nonResourceURLs": []string{"*"}, "verbs": []string{"*"}},
+			},
+			"services": []map[string]interface{}{
+				{"targets": []string{"grafana-*"}, "verbs": []string{"*"}},
+				{"targets": []string{"prometheus"}, "paths": []string{"/api/v1/*"}, "verbs": []string{"get"}},
+			},
+		},
+	})
+	NewWithT(t).Expect(err).To(BeNil())
+
+	s := scopes["local"]
+
+	serviceAttr := func(method string, p string) authorizer.Attributes {
+		req, _ := http.NewRequest(method, p, nil)
+		target := strings.SplitN(strings.TrimPrefix(p, "/services/local/"), "/", 2)[0]
+		return ServiceRequestAttributesFromRequest(req, "local", target)
+	}
+
+	a := serviceAttr(http.MethodGet, "/services/local/prometheus/api/v1/query").(*RequestInfoAttrs)
+	NewWithT(t).Expect(a.GetPath()).To(Equal("/services/prometheus/api/v1/query"))
+	NewWithT(t).Expect(a.GetServicePath()).To(Equal("/api/v1/query"))
+	NewWithT(t).Expect(a.GetVerb()).To(Equal("get"))
+
+	_, err = s.Authorize(serviceAttr(http.MethodGet, "/services/local/prometheus/api/v1/query"))
+	NewWithT(t).Expect(err).To(BeNil())
+
+	_, err = s.Authorize(serviceAttr(http.MethodPost, "/services/local/prometheus/api/v1/query"))
+	NewWithT(t).Expect(err).NotTo(BeNil())
+
+	_, err = s.Authorize(serviceAttr(http.MethodGet, "/services/local/prometheus/-/reload"))
+	NewWithT(t).Expect(err).NotTo(BeNil())
+
+	_, err = s.Authorize(serviceAttr(http.MethodPost, "/services/local/grafana-ops/api/dashboards"))
+	NewWithT(t).Expect(err).To(BeNil())
+
+	// nonResourceURLs of rules never grant services
+	_, err = s.Authorize(serviceAttr(http.MethodGet, "/services/local/alertmanager/"))
+	NewWithT(t).Expect(err).NotTo(BeNil())
+
+	t.Run("dry run", func(t *testing.T) {
+		dryRun := s
+		dryRun.DryRun = DryRunEnforce
+
+		r, err := dryRun.Authorize(serviceAttr(http.MethodGet, "/services/local/grafana-ops/"))
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(r.DryRun).To(BeTrue())
+
+		_, err = dryRun.Authorize(serviceAttr(http.MethodPost, "/services/local/grafana-ops/api/dashboards"))
+		NewWithT(t).Expect(err).NotTo(BeNil())
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := ScopesFromMap(map[string]interface{}{
+			"local": map[string]interface{}{
+				"services": []map[string]interface{}{{"targets": []string{"grafana"}, "paths": []string{"api"}, "verbs": []string{"get"}}},
+			},
+		})
+		NewWithT(t).Expect(err).NotTo(BeNil())
+	})
+}
+
+func TestScopeForwards(t *testing.T) {
+	scopes, err := ScopesFromMap(map[string]interface{}{
+		"local": map[string]interface{}{
+			"rules": []map[string]interface{}{
+				{"nonResourceURLs": []string{"*"}, "verbs": []string{"*"}},
+			},
+			"forwards": []string{"*.db.svc:5432", "redis:6379"},
+		},
+	})
+	NewWithT(t).Expect(err).To(BeNil())
+
+	s := scopes["local"]
+
+	a := ForwardRequestAttributes("postgres.db.svc:5432")
+	NewWithT(t).Expect(a.GetPath()).To(Equal("/forwards/postgres.db.svc:5432"))
+	NewWithT(t).Expect(a.GetVerb()).To(Equal(VerbConnect))
+
+	_, err = s.Authorize(a)
+	NewWithT(t).Expect(err).To(BeNil())
+
+	_, err = s.Authorize(ForwardRequestAttributes("redis:6379"))
+	NewWithT(t).Expect(err).To(BeNil())
+
+	// nonResourceURLs of rules never grant forwards
+	_, err = s.Authorize(ForwardRequestAttributes("postgres.db.svc:22"))
+	NewWithT(t).Expect(err).NotTo(BeNil())
+
+	dryRun := s
+	dryRun.DryRun = DryRunReject
+	_, err = dryRun.Authorize(ForwardRequestAttributes("redis:6379"))
+	NewWithT(t).Expect(err).NotTo(BeNil())
+}
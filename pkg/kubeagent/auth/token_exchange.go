@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/octohelm/kube-agent/pkg/jwtutil"
+)
+
+// https://datatracker.ietf.org/doc/html/rfc8693
+const (
+	GrantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	TokenTypeIDToken       = "urn:ietf:params:oauth:token-type:id_token"
+	TokenTypeJWT           = "urn:ietf:params:oauth:token-type:jwt"
+	TokenTypeAccessToken   = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// TokenExchanger trades the id token of upstream issuers for the access token carrying scopes bound to the user
+type TokenExchanger struct {
+	// Issuer of access tokens
+	Issuer string
+	// Audience of access tokens
+	Audience string
+	TTL      time.Duration
+	Signer   *jwtutil.Signer
+	// Upstream issuers to validate subject tokens
+	Upstream *jwtutil.Issuers
+	Bindings ScopeBindings
+}
+
+type TokenExchangeResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int64  `json:"expires_in"`
+}
+
+type TokenExchangeError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *TokenExchangeError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+func (e *TokenExchanger) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	resp, err := e.exchange(req)
+
+	rw.Header().Set("Content-Type", "application/json;charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(rw).Encode(err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(resp)
+}
+
+func (e *TokenExchanger) exchange(req *http.Request) (*TokenExchangeResponse, *TokenExchangeError) {
+	if req.Method != http.MethodPost {
+		return nil, &TokenExchangeError{Code: "invalid_request", Description: "only POST supported"}
+	}
+
+	if err := req.ParseForm(); err != nil {
+		return nil, &TokenExchangeError{Code: "invalid_request", Description: err.Error()}
+	}
+
+	if grantType := req.PostForm.Get("grant_type"); grantType != GrantTypeTokenExchange {
+		return nil, &TokenExchangeError{Code: "unsupported_grant_type", Description: grantType}
+	}
+
+	switch subjectTokenType := req.PostForm.Get("subject_token_type"); subjectTokenType {
+	case TokenTypeIDToken, TokenTypeJWT:
+	default:
+		return nil, &TokenExchangeError{Code: "invalid_request", Description: fmt.Sprintf("unsupported subject_token_type %q", subjectTokenType)}
+	}
+
+	switch requestedTokenType := req.PostForm.Get("requested_token_type"); requestedTokenType {
+	case "", TokenTypeAccessToken, TokenTypeJWT:
+	default:
+		return nil, &TokenExchangeError{Code: "invalid_request", Description: fmt.Sprintf("unsupported requested_token_type %q", requestedTokenType)}
+	}
+
+	// resource is the agent host, to narrow scopes of the access token
+	accessToken, expiresIn, err := e.Exchange(req, req.PostForm.Get("subject_token"), req.PostForm.Get("resource"))
+	if err != nil {
+		return nil, &TokenExchangeError{Code: "invalid_grant", Description: err.Error()}
+	}
+
+	return &TokenExchangeResponse{
+		AccessToken:     accessToken,
+		IssuedTokenType: TokenTypeAccessToken,
+		TokenType:       "Bearer",
+		ExpiresIn:       int64(expiresIn / time.Second),
+	}, nil
+}
+
+// Exchange issues access token for the subject token, scopes will be narrowed when agentHost provided
+func (e *TokenExchanger) Exchange(req *http.Request, subjectToken string, agentHost string) (string, time.Duration, error) {
+	if subjectToken == "" {
+		return "", 0, fmt.Errorf("missing subject_token")
+	}
+
+	subject, issuer, err := e.Upstream.Validate(req.Context(), subjectToken)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// never exchange access tokens, which will extend the lifetime
+	if issuer.Issuer == e.Issuer {
+		return "", 0, fmt.Errorf("%w: %q", jwtutil.ErrIssuerNotAccepted, subject.Issuer())
+	}
+
+	if !issuer.AcceptsAudience(subject.Audience()) {
+		return "", 0, fmt.Errorf("%w: %v", jwtutil.ErrAudienceNotAccepted, subject.Audience())
+	}
+
+	if subject.Subject() == "" || subject.Subject() == JWTSubjectAgent || strings.HasPrefix(subject.Subject(), "system:") {
+		return "", 0, fmt.Errorf("invalid subject %q", subject.Subject())
+	}
+
+	u, err := UserFromToken(subject)
+	if err != nil {
+		return "", 0, err
+	}
+
+	scopes := e.Bindings.ScopesFor(u)
+	if agentHost != "" {
+		scopes = scopes.Narrow(agentHost)
+	}
+	if len(scopes) == 0 {
+		return "", 0, fmt.Errorf("no scopes bound to %s", u.GetName())
+	}
+
+	now := time.Now()
+
+	// never outlive the subject token
+	ttl := e.TTL
+	if untilExpired := subject.Expiration().Sub(now); untilExpired < ttl {
+		ttl = untilExpired
+	}
+
+	tok := jwt.New()
+	_ = tok.Set(jwt.IssuerKey, e.Issuer)
+	// prefixed by upstream issuer, to avoid colliding with users of other authenticators
+	_ = tok.Set(jwt.SubjectKey, UpstreamUserName(subject.Issuer(), u.GetName()))
+	_ = tok.Set(jwt.AudienceKey, []string{e.Audience})
+	_ = tok.Set(jwt.JwtIDKey, randomID())
+	_ = tok.Set(jwt.IssuedAtKey, now)
+	_ = tok.Set(jwt.NotBeforeKey, now)
+	_ = tok.Set(jwt.ExpirationKey, now.Add(ttl))
+	if groups := u.GetGroups(); len(groups) > 0 {
+		_ = tok.Set("groups", groups)
+	}
+	_ = tok.Set("scopes", scopes)
+
+	accessToken, err := e.Signer.Sign(tok)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return accessToken, ttl, nil
+}
+
+// UpstreamUserName is the subject of access tokens issued for users of upstream issuers
+func UpstreamUserName(issuer string, name string) string {
+	return "oidc:" + issuer + "#" + name
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/octohelm/kube-agent/pkg/jwtutil"
+	. "github.com/onsi/gomega"
+)
+
+func newSigner(kid string) *jwtutil.Signer {
+	privateKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	key, _ := jwk.New(privateKey)
+	_ = key.Set(jwk.KeyIDKey, kid)
+	_ = key.Set(jwk.AlgorithmKey, jwa.RS256)
+	s, _ := jwtutil.NewSigner(key)
+	return s
+}
+
+func TestTokenExchanger(t *testing.T) {
+	upstream := newSigner("oidc")
+	gateway := newSigner("gateway")
+
+	upstreamJWKS, _ := upstream.MarshalJWKS()
+	gatewayJWKS, _ := gateway.MarshalJWKS()
+
+	issuers, err := jwtutil.NewIssuers(jwtutil.IssuersConfig{
+		Issuers: []jwtutil.IssuerConfig{
+			{Issuer: "https://oidc.example.com", JWKS: upstreamJWKS, Audiences: []string{"client"}},
+			{Issuer: "gateway", JWKS: gatewayJWKS, Audiences: []string{"kube-agent"}},
+		},
+	})
+	NewWithT(t).Expect(err).To(BeNil())
+
+	e := &TokenExchanger{
+		Issuer:   "gateway",
+		Audience: "kube-agent",
+		TTL:      15 * time.Minute,
+		Signer:   gateway,
+		Upstream: issuers,
+		Bindings: ScopeBindings{
+			{
+				Groups: []string{"dev"},
+				Scopes: Scopes{"local": {Namespaces: []string{"default"}, Rules: []PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"list"}}}}},
+			},
+		},
+	}
+
+	idToken := func(claims map[string]interface{}) string {
+		tok := jwt.New()
+		_ = tok.Set(jwt.IssuerKey, "https://oidc.example.com")
+		_ = tok.Set(jwt.AudienceKey, []string{"client"})
+		_ = tok.Set(jwt.ExpirationKey, time.Now().Add(time.Hour))
+		for k, v := range claims {
+			_ = tok.Set(k, v)
+		}
+		s, _ := upstream.Sign(tok)
+		return s
+	}
+
+	exchange := func(subjectToken string) (int, map[string]interface{}) {
+		form := url.Values{}
+		form.Set("grant_type", GrantTypeTokenExchange)
+		form.Set("subject_token_type", TokenTypeIDToken)
+		form.Set("subject_token", subjectToken)
+
+		req := httptest.NewRequest(http.MethodPost, "/.sys/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rw := httptest.NewRecorder()
+		e.ServeHTTP(rw, req)
+
+		ret := map[string]interface{}{}
+		_ = json.NewDecoder(rw.Body).Decode(&ret)
+		return rw.Code, ret
+	}
+
+	t.Run("exchange id token for access token with scopes", func(t *testing.T) {
+		code, ret := exchange(idToken(map[string]interface{}{
+			jwt.SubjectKey: "someone",
+			"groups":       []string{"dev"},
+		}))
+		NewWithT(t).Expect(code).To(Equal(http.StatusOK))
+		NewWithT(t).Expect(ret["issued_token_type"]).To(Equal(TokenTypeAccessToken))
+
+		accessToken := ret["access_token"].(string)
+
+		resp, ok, err := NewJWTAuthenticator(issuers, nil).AuthenticateRequest(requestWithBearer(accessToken))
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(ok).To(BeTrue())
+		NewWithT(t).Expect(resp.User.GetName()).To(Equal("oidc:https://oidc.example.com#someone"))
+
+		scopes, ok, err := ScopesFromUser(resp.User)
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(ok).To(BeTrue())
+		NewWithT(t).Expect(scopes["local"].Namespaces).To(Equal([]string{"default"}))
+
+		t.Run("access token could not be exchanged again", func(t *testing.T) {
+			code, ret := exchange(accessToken)
+			NewWithT(t).Expect(code).To(Equal(http.StatusBadRequest))
+			NewWithT(t).Expect(ret["error"]).To(Equal("invalid_grant"))
+		})
+	})
+
+	t.Run("no scopes bound", func(t *testing.T) {
+		code, ret := exchange(idToken(map[string]interface{}{
+			jwt.SubjectKey: "someone",
+			"groups":       []string{"ops"},
+		}))
+		NewWithT(t).Expect(code).To(Equal(http.StatusBadRequest))
+		NewWithT(t).Expect(ret["error"]).To(Equal("invalid_grant"))
+	})
+
+	t.Run("reserved subject", func(t *testing.T) {
+		code, ret := exchange(idToken(map[string]interface{}{
+			jwt.SubjectKey: "system:admin",
+			"groups":       []string{"dev"},
+		}))
+		NewWithT(t).Expect(code).To(Equal(http.StatusBadRequest))
+		NewWithT(t).Expect(ret["error"]).To(Equal("invalid_grant"))
+	})
+}
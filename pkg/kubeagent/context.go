@@ -0,0 +1,24 @@
+package kubeagent
+
+import (
+	"context"
+	"time"
+)
+
+// withoutCancel keeps values of the parent, but never canceled,
+// for the work should be done gracefully after the parent canceled.
+type withoutCancel struct {
+	context.Context
+}
+
+func (withoutCancel) Deadline() (deadline time.Time, ok bool) {
+	return
+}
+
+func (withoutCancel) Done() <-chan struct{} {
+	return nil
+}
+
+func (withoutCancel) Err() error {
+	return nil
+}
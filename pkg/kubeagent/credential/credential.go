@@ -0,0 +1,180 @@
+package credential
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/octohelm/kube-agent/pkg/kubeagent/auth"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientauthenticationv1 "k8s.io/client-go/pkg/apis/clientauthentication/v1"
+)
+
+// refresh before expired, to avoid token expired during the request
+const expirySkew = time.Minute
+
+type Opt struct {
+	Gateway             string `flag:"gateway,env" desc:"address of gateway, like https://kube-agent-gateway.example.com"`
+	AgentHost           string `flag:"agent-host,env" desc:"agent host to access"`
+	SubjectTokenFile    string `flag:"subject-token-file,env" desc:"file of id token, to exchange for access token"`
+	SubjectTokenCommand string `flag:"subject-token-command,env" desc:"command to print id token, to exchange for access token"`
+	CacheDir            string `flag:"cache-dir,env" desc:"dir to cache access tokens, default ~/.kube/cache/kube-agent"`
+}
+
+// ExecCredential returns the cached access token until expired, otherwise exchanges new one from gateway
+func ExecCredential(ctx context.Context, opt Opt) (*clientauthenticationv1.ExecCredential, error) {
+	if opt.Gateway == "" || opt.AgentHost == "" {
+		return nil, errors.New("gateway and agent host are required")
+	}
+
+	cacheFile, err := cacheFileOf(opt)
+	if err != nil {
+		return nil, err
+	}
+
+	if cred, ok := loadCached(cacheFile); ok {
+		return cred, nil
+	}
+
+	subjectToken, err := subjectTokenOf(ctx, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := exchange(ctx, opt, subjectToken)
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt := metav1.NewTime(time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second))
+
+	cred := &clientauthenticationv1.ExecCredential{
+		Status: &clientauthenticationv1.ExecCredentialStatus{
+			Token:               resp.AccessToken,
+			ExpirationTimestamp: &expiresAt,
+		},
+	}
+	cred.APIVersion = clientauthenticationv1.SchemeGroupVersion.String()
+	cred.Kind = "ExecCredential"
+
+	if err := saveCache(cacheFile, cred); err != nil {
+		return nil, err
+	}
+
+	return cred, nil
+}
+
+func cacheFileOf(opt Opt) (string, error) {
+	dir := opt.CacheDir
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".kube", "cache", "kube-agent")
+	}
+
+	// subject token source is a part of the key, to avoid sharing access tokens between identities
+	h := sha256.Sum256([]byte(strings.Join([]string{opt.Gateway, opt.AgentHost, opt.SubjectTokenCommand, opt.SubjectTokenFile}, "\n")))
+
+	return filepath.Join(dir, hex.EncodeToString(h[:])+".json"), nil
+}
+
+func loadCached(filename string) (*clientauthenticationv1.ExecCredential, bool) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, false
+	}
+
+	cred := &clientauthenticationv1.ExecCredential{}
+	if err := json.Unmarshal(data, cred); err != nil {
+		return nil, false
+	}
+
+	if cred.Status == nil || cred.Status.ExpirationTimestamp == nil || time.Until(cred.Status.ExpirationTimestamp.Time) < expirySkew {
+		return nil, false
+	}
+
+	return cred, true
+}
+
+func saveCache(filename string, cred *clientauthenticationv1.ExecCredential) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(cred)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filename, data, 0600)
+}
+
+func subjectTokenOf(ctx context.Context, opt Opt) (string, error) {
+	switch {
+	case opt.SubjectTokenCommand != "":
+		cmd := exec.CommandContext(ctx, "sh", "-c", opt.SubjectTokenCommand)
+		cmd.Stderr = os.Stderr
+		data, err := cmd.Output()
+		if err != nil {
+			return "", errors.Wrap(err, "get subject token failed")
+		}
+		return strings.TrimSpace(string(data)), nil
+	case opt.SubjectTokenFile != "":
+		data, err := ioutil.ReadFile(opt.SubjectTokenFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return "", errors.New("subject token file or command is required")
+}
+
+func exchange(ctx context.Context, opt Opt, subjectToken string) (*auth.TokenExchangeResponse, error) {
+	form := url.Values{}
+	form.Set("grant_type", auth.GrantTypeTokenExchange)
+	form.Set("subject_token_type", auth.TokenTypeIDToken)
+	form.Set("subject_token", subjectToken)
+	form.Set("requested_token_type", auth.TokenTypeAccessToken)
+	form.Set("resource", opt.AgentHost)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(opt.Gateway, "/")+"/.sys/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		e := &auth.TokenExchangeError{}
+		if err := json.NewDecoder(resp.Body).Decode(e); err != nil || e.Code == "" {
+			return nil, fmt.Errorf("token exchange failed: status %d", resp.StatusCode)
+		}
+		return nil, errors.Wrap(e, "token exchange failed")
+	}
+
+	ret := &auth.TokenExchangeResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
@@ -0,0 +1,91 @@
+package credential
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/octohelm/kube-agent/pkg/kubeagent/auth"
+	. "github.com/onsi/gomega"
+)
+
+func TestExecCredential(t *testing.T) {
+	var exchanged int64
+
+	gateway := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_ = req.ParseForm()
+
+		if req.PostForm.Get("subject_token") != "id-token" || req.PostForm.Get("resource") != "local" {
+			rw.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(rw).Encode(&auth.TokenExchangeError{Code: "invalid_grant"})
+			return
+		}
+
+		atomic.AddInt64(&exchanged, 1)
+
+		_ = json.NewEncoder(rw).Encode(&auth.TokenExchangeResponse{
+			AccessToken:     "access-token",
+			IssuedTokenType: auth.TokenTypeAccessToken,
+			TokenType:       "Bearer",
+			ExpiresIn:       900,
+		})
+	}))
+	defer gateway.Close()
+
+	tmp, _ := ioutil.TempDir("", "credential")
+	defer os.RemoveAll(tmp)
+
+	tokenFile := filepath.Join(tmp, "id-token")
+	_ = ioutil.WriteFile(tokenFile, []byte("id-token\n"), 0600)
+
+	opt := Opt{
+		Gateway:          gateway.URL,
+		AgentHost:        "local",
+		SubjectTokenFile: tokenFile,
+		CacheDir:         filepath.Join(tmp, "cache"),
+	}
+
+	for i := 0; i < 3; i++ {
+		cred, err := ExecCredential(context.Background(), opt)
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(cred.Kind).To(Equal("ExecCredential"))
+		NewWithT(t).Expect(cred.Status.Token).To(Equal("access-token"))
+	}
+
+	NewWithT(t).Expect(atomic.LoadInt64(&exchanged)).To(Equal(int64(1)))
+
+	t.Run("exchange failed", func(t *testing.T) {
+		_ = ioutil.WriteFile(tokenFile, []byte("other"), 0600)
+
+		_, err := ExecCredential(context.Background(), Opt{
+			Gateway:          gateway.URL,
+			AgentHost:        "other",
+			SubjectTokenFile: tokenFile,
+			CacheDir:         filepath.Join(tmp, "cache"),
+		})
+		NewWithT(t).Expect(err).NotTo(BeNil())
+	})
+}
+
+func TestCacheFileOf(t *testing.T) {
+	opt := Opt{
+		Gateway:          "https://gateway.example.com",
+		AgentHost:        "local",
+		SubjectTokenFile: "/tmp/a",
+		CacheDir:         "/tmp/cache",
+	}
+
+	f, _ := cacheFileOf(opt)
+
+	other := opt
+	other.SubjectTokenFile = "/tmp/b"
+	otherF, _ := cacheFileOf(other)
+
+	NewWithT(t).Expect(otherF).NotTo(Equal(f))
+}
@@ -0,0 +1,187 @@
+package kubeagent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/octohelm/kube-agent/pkg/jwtutil"
+	"github.com/octohelm/kube-agent/pkg/kubeagent/auth"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+const (
+	// HTTP_HEADER_KUBE_AGENT_ENVELOPE is jwt signed by gateway, to let agent verify the request authorized by gateway
+	HTTP_HEADER_KUBE_AGENT_ENVELOPE = "X-Kube-Agent-Envelope"
+)
+
+// Envelope carries what gateway decided for the request
+type Envelope struct {
+	User        string               `json:"user"`
+	Groups      []string             `json:"groups,omitempty"`
+	Scopes      json.RawMessage      `json:"scopes,omitempty"`
+	Restriction *EnvelopeRestriction `json:"restriction,omitempty"`
+}
+
+type EnvelopeRestriction struct {
+	Namespaces    []string `json:"namespaces,omitempty"`
+	LabelSelector string   `json:"labelSelector,omitempty"`
+	DryRun        bool     `json:"dryRun,omitempty"`
+}
+
+// Restriction returns the restriction decided by gateway, which should be enforced by agent again
+func (r *EnvelopeRestriction) Restriction() (*auth.Restriction, error) {
+	if r == nil {
+		return nil, nil
+	}
+
+	restriction := &auth.Restriction{
+		Namespaces: r.Namespaces,
+		DryRun:     r.DryRun,
+	}
+
+	if r.LabelSelector != "" {
+		selector, err := labels.Parse(r.LabelSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid envelope: %w", err)
+		}
+		restriction.LabelSelector = selector
+	}
+
+	return restriction, nil
+}
+
+func NewEnvelope(u user.Info, restriction *auth.Restriction) *Envelope {
+	e := &Envelope{}
+
+	if u != nil {
+		e.User = u.GetName()
+		e.Groups = u.GetGroups()
+		if scopes := u.GetExtra()[auth.UserExtraScopes]; len(scopes) > 0 {
+			e.Scopes = json.RawMessage(scopes[0])
+		}
+	}
+
+	if !restriction.IsZero() {
+		e.Restriction = &EnvelopeRestriction{
+			Namespaces: restriction.Namespaces,
+			DryRun:     restriction.DryRun,
+		}
+		if restriction.LabelSelector != nil {
+			e.Restriction.LabelSelector = restriction.LabelSelector.String()
+		}
+	}
+
+	return e
+}
+
+type contextKeyEnvelope struct{}
+
+func WithEnvelope(ctx context.Context, e *Envelope) context.Context {
+	return context.WithValue(ctx, contextKeyEnvelope{}, e)
+}
+
+func EnvelopeFromContext(ctx context.Context) (*Envelope, bool) {
+	e, ok := ctx.Value(contextKeyEnvelope{}).(*Envelope)
+	return e, ok
+}
+
+const envelopeTTL = 30 * time.Second
+
+// EnvelopeSealer signs the envelope in context of the request, bound to request id, method and uri
+type EnvelopeSealer struct {
+	Issuer string
+	Signer *jwtutil.Signer
+}
+
+func (s *EnvelopeSealer) Seal(req *http.Request, agentHost string, requestID string) error {
+	e, ok := EnvelopeFromContext(req.Context())
+	if !ok {
+		return fmt.Errorf("missing envelope of request %s", requestID)
+	}
+
+	now := time.Now()
+
+	tok := jwt.New()
+	_ = tok.Set(jwt.IssuerKey, s.Issuer)
+	_ = tok.Set(jwt.SubjectKey, e.User)
+	_ = tok.Set(jwt.AudienceKey, []string{agentHost})
+	_ = tok.Set(jwt.JwtIDKey, requestID)
+	_ = tok.Set(jwt.IssuedAtKey, now)
+	_ = tok.Set(jwt.ExpirationKey, now.Add(envelopeTTL))
+	_ = tok.Set("method", req.Method)
+	_ = tok.Set("uri", req.URL.RequestURI())
+	_ = tok.Set("envelope", e)
+
+	// typed, never be accepted as access token
+	signed, err := s.Signer.SignWithType(tok, auth.JWTTypeEnvelope)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set(HTTP_HEADER_KUBE_AGENT_ENVELOPE, signed)
+	return nil
+}
+
+// EnvelopeVerifier verifies envelope of requests pulled by agent
+type EnvelopeVerifier struct {
+	// Issuer of envelopes, which is the token issuer of gateway
+	Issuer    string
+	AgentHost string
+	KeySet    *jwtutil.KeySet
+}
+
+func (v *EnvelopeVerifier) Open(ctx context.Context, req *http.Request, requestID string) (*Envelope, error) {
+	signed := req.Header.Get(HTTP_HEADER_KUBE_AGENT_ENVELOPE)
+	if signed == "" {
+		return nil, fmt.Errorf("missing envelope")
+	}
+	req.Header.Del(HTTP_HEADER_KUBE_AGENT_ENVELOPE)
+
+	// access tokens signed by the same key are not envelopes
+	if typ, err := jwtutil.TypeOf(signed); err != nil || typ != auth.JWTTypeEnvelope {
+		return nil, fmt.Errorf("invalid envelope: not typed %s", auth.JWTTypeEnvelope)
+	}
+
+	tok, err := v.KeySet.Validate(ctx, signed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid envelope: %w", err)
+	}
+
+	if tok.Issuer() != v.Issuer {
+		return nil, fmt.Errorf("invalid envelope: issuer %q not accepted", tok.Issuer())
+	}
+
+	if aud := tok.Audience(); len(aud) != 1 || aud[0] != v.AgentHost {
+		return nil, fmt.Errorf("invalid envelope: not for agent %s", v.AgentHost)
+	}
+
+	if tok.JwtID() != requestID {
+		return nil, fmt.Errorf("invalid envelope: not for request %s", requestID)
+	}
+
+	if method, _ := tok.Get("method"); method != req.Method {
+		return nil, fmt.Errorf("invalid envelope: method mismatched")
+	}
+
+	if uri, _ := tok.Get("uri"); uri != req.URL.RequestURI() {
+		return nil, fmt.Errorf("invalid envelope: uri mismatched")
+	}
+
+	raw, _ := tok.Get("envelope")
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Envelope{}
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, fmt.Errorf("invalid envelope: %w", err)
+	}
+
+	return e, nil
+}
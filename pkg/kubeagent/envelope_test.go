@@ -0,0 +1,123 @@
+package kubeagent
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/octohelm/kube-agent/pkg/jwtutil"
+	"github.com/octohelm/kube-agent/pkg/kubeagent/auth"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+func TestEnvelope(t *testing.T) {
+	privateKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	key, _ := jwk.New(privateKey)
+	_ = key.Set(jwk.KeyIDKey, "gateway")
+	_ = key.Set(jwk.AlgorithmKey, jwa.RS256)
+	signer, _ := jwtutil.NewSigner(key)
+
+	sealer := &EnvelopeSealer{Issuer: "kube-agent", Signer: signer}
+	verifier := &EnvelopeVerifier{
+		Issuer:    "kube-agent",
+		AgentHost: "local",
+		KeySet: jwtutil.NewKeySet(func(ctx context.Context) (jwk.Set, error) {
+			return signer.PublicKeys(), nil
+		}),
+	}
+
+	sealed := func(rawURL string) *http.Request {
+		u, _ := url.Parse(rawURL)
+		req := (&http.Request{Method: http.MethodGet, URL: u, Header: http.Header{}}).WithContext(
+			WithEnvelope(context.Background(), NewEnvelope(&user.DefaultInfo{Name: "someone"}, &auth.Restriction{DryRun: true})),
+		)
+		NewWithT(t).Expect(sealer.Seal(req, "local", "1@local@gateway")).To(Succeed())
+		return req
+	}
+
+	t.Run("open", func(t *testing.T) {
+		e, err := verifier.Open(context.Background(), sealed("/proxies/local/api/v1/pods"), "1@local@gateway")
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(e.User).To(Equal("someone"))
+		NewWithT(t).Expect(e.Restriction.DryRun).To(BeTrue())
+	})
+
+	t.Run("request id mismatched", func(t *testing.T) {
+		_, err := verifier.Open(context.Background(), sealed("/proxies/local/api/v1/pods"), "2@local@gateway")
+		NewWithT(t).Expect(err).NotTo(BeNil())
+	})
+
+	t.Run("uri tampered", func(t *testing.T) {
+		req := sealed("/proxies/local/api/v1/pods")
+		req.URL.Path = "/proxies/local/api/v1/secrets"
+		_, err := verifier.Open(context.Background(), req, "1@local@gateway")
+		NewWithT(t).Expect(err).NotTo(BeNil())
+	})
+
+	t.Run("restriction", func(t *testing.T) {
+		u, _ := url.Parse("/proxies/local/api/v1/pods")
+		req := (&http.Request{Method: http.MethodGet, URL: u, Header: http.Header{}}).WithContext(
+			WithEnvelope(context.Background(), NewEnvelope(&user.DefaultInfo{Name: "someone"}, &auth.Restriction{
+				Namespaces:    []string{"team-*"},
+				LabelSelector: labels.SelectorFromSet(labels.Set{"app": "web"}),
+			})),
+		)
+		NewWithT(t).Expect(sealer.Seal(req, "local", "1@local@gateway")).To(Succeed())
+
+		e, err := verifier.Open(context.Background(), req, "1@local@gateway")
+		NewWithT(t).Expect(err).To(BeNil())
+
+		r, err := e.Restriction.Restriction()
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(r.Namespaces).To(Equal([]string{"team-*"}))
+		NewWithT(t).Expect(r.LabelSelector.String()).To(Equal("app=web"))
+	})
+
+	t.Run("access token of the same key", func(t *testing.T) {
+		u, _ := url.Parse("/proxies/local/api/v1/pods")
+		req := &http.Request{Method: http.MethodGet, URL: u, Header: http.Header{}}
+
+		tok := jwt.New()
+		_ = tok.Set(jwt.IssuerKey, "kube-agent")
+		_ = tok.Set(jwt.SubjectKey, "someone")
+		_ = tok.Set(jwt.AudienceKey, []string{"local"})
+		_ = tok.Set(jwt.JwtIDKey, "1@local@gateway")
+		_ = tok.Set(jwt.ExpirationKey, time.Now().Add(time.Minute))
+		_ = tok.Set("method", http.MethodGet)
+		_ = tok.Set("uri", u.RequestURI())
+
+		signed, _ := signer.Sign(tok)
+		req.Header.Set(HTTP_HEADER_KUBE_AGENT_ENVELOPE, signed)
+
+		_, err := verifier.Open(context.Background(), req, "1@local@gateway")
+		NewWithT(t).Expect(err).NotTo(BeNil())
+	})
+
+	t.Run("issuer not accepted", func(t *testing.T) {
+		other := &EnvelopeSealer{Issuer: "other", Signer: signer}
+
+		u, _ := url.Parse("/proxies/local/api/v1/pods")
+		req := (&http.Request{Method: http.MethodGet, URL: u, Header: http.Header{}}).WithContext(
+			WithEnvelope(context.Background(), NewEnvelope(&user.DefaultInfo{Name: "someone"}, nil)),
+		)
+		NewWithT(t).Expect(other.Seal(req, "local", "1@local@gateway")).To(Succeed())
+
+		_, err := verifier.Open(context.Background(), req, "1@local@gateway")
+		NewWithT(t).Expect(err).NotTo(BeNil())
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		u, _ := url.Parse("/proxies/local/api/v1/pods")
+		_, err := verifier.Open(context.Background(), &http.Request{Method: http.MethodGet, URL: u, Header: http.Header{}}, "1@local@gateway")
+		NewWithT(t).Expect(err).NotTo(BeNil())
+	})
+}
@@ -0,0 +1,160 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/go-courier/logr"
+	"github.com/octohelm/kube-agent/pkg/kubeagent"
+	"github.com/octohelm/kube-agent/pkg/kubeagent/credential"
+	"github.com/pkg/errors"
+)
+
+type Opt struct {
+	Gateway             string `flag:"gateway,env" desc:"address of gateway, like https://kube-agent-gateway.example.com"`
+	AgentHost           string `flag:"agent-host,env" desc:"agent host to forward through"`
+	Target              string `flag:"target,env" desc:"host:port to connect from agent, like postgres.db.svc:5432"`
+	Listen              string `flag:"listen,env" default:"127.0.0.1:0" desc:"local address to listen, random port when port is 0"`
+	Token               string `flag:"token,env" desc:"bearer token of gateway, exchanged by subject token when empty"`
+	SubjectTokenFile    string `flag:"subject-token-file,env" desc:"file of id token, to exchange for access token"`
+	SubjectTokenCommand string `flag:"subject-token-command,env" desc:"command to print id token, to exchange for access token"`
+	CacheDir            string `flag:"cache-dir,env" desc:"dir to cache access tokens, default ~/.kube/cache/kube-agent"`
+}
+
+// Listen listens locally, each accepted connection will be forwarded to the target through the agent
+func Listen(opt Opt) (*Forwarder, error) {
+	if opt.Gateway == "" || opt.AgentHost == "" || opt.Target == "" {
+		return nil, errors.New("gateway, agent host and target are required")
+	}
+
+	if _, _, err := net.SplitHostPort(opt.Target); err != nil {
+		return nil, errors.Wrap(err, "invalid target")
+	}
+
+	lis, err := net.Listen("tcp", opt.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Forwarder{opt: opt, lis: lis}, nil
+}
+
+type Forwarder struct {
+	opt Opt
+	lis net.Listener
+}
+
+func (f *Forwarder) Addr() net.Addr {
+	return f.lis.Addr()
+}
+
+// Serve accepts connections until ctx done
+func (f *Forwarder) Serve(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		_ = f.lis.Close()
+	}()
+
+	for {
+		conn, err := f.lis.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		go f.handle(ctx, conn)
+	}
+}
+
+func (f *Forwarder) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	stream, err := Dial(ctx, f.opt)
+	if err != nil {
+		logr.FromContext(ctx).Warn(err)
+		return
+	}
+	defer stream.Close()
+
+	done := make(chan struct{}, 2)
+
+	go func() {
+		_, _ = io.Copy(stream, conn)
+		done <- struct{}{}
+	}()
+
+	go func() {
+		_, _ = io.Copy(conn, stream)
+		done <- struct{}{}
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// Dial opens a tcp stream to the target through the agent
+func Dial(ctx context.Context, opt Opt) (io.ReadWriteCloser, error) {
+	u := fmt.Sprintf("%s/forwards/%s/%s", strings.TrimSuffix(opt.Gateway, "/"), opt.AgentHost, opt.Target)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", kubeagent.HTTP_UPGRADE_TCP)
+
+	token, err := tokenOf(ctx, opt)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("forward to %s through %s failed: %s %s", opt.Target, opt.AgentHost, resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	stream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		_ = resp.Body.Close()
+		return nil, errors.New("upgraded stream is not writable")
+	}
+
+	return stream, nil
+}
+
+func tokenOf(ctx context.Context, opt Opt) (string, error) {
+	if opt.Token != "" || (opt.SubjectTokenFile == "" && opt.SubjectTokenCommand == "") {
+		return opt.Token, nil
+	}
+
+	cred, err := credential.ExecCredential(ctx, credential.Opt{
+		Gateway:             opt.Gateway,
+		AgentHost:           opt.AgentHost,
+		SubjectTokenFile:    opt.SubjectTokenFile,
+		SubjectTokenCommand: opt.SubjectTokenCommand,
+		CacheDir:            opt.CacheDir,
+	})
+	if err != nil {
+		return "", err
+	}
+	return cred.Status.Token, nil
+}
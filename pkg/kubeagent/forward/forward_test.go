@@ -0,0 +1,83 @@
+package forward
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/octohelm/kube-agent/pkg/kubeagent"
+	"github.com/octohelm/kube-agent/pkg/kubeagent/kubeagenttest"
+	. "github.com/onsi/gomega"
+)
+
+func TestForward(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	NewWithT(t).Expect(err).To(BeNil())
+	defer echo.Close()
+
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	c := kubeagenttest.Start(t, kubeagenttest.Options{
+		Gateways: 2,
+		AgentOpt: func(i int, opt *kubeagent.AgentOpt) {
+			opt.ForwardTargets = kubeagent.ForwardTargets{"127.0.0.1:*"}
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for i := range c.GatewayAddrs {
+		f, err := Listen(Opt{
+			Gateway:   c.GatewayURL(i),
+			AgentHost: "local",
+			Target:    echo.Addr().String(),
+			Listen:    "127.0.0.1:0",
+		})
+		NewWithT(t).Expect(err).To(BeNil())
+
+		go func() {
+			_ = f.Serve(ctx)
+		}()
+
+		conn, err := net.Dial("tcp", f.Addr().String())
+		NewWithT(t).Expect(err).To(BeNil())
+
+		// interactive, each write should be echoed before next one
+		for _, msg := range []string{"ping", "pong", "done"} {
+			_, err := conn.Write([]byte(msg))
+			NewWithT(t).Expect(err).To(BeNil())
+
+			buf := make([]byte, len(msg))
+			_, err = io.ReadFull(conn, buf)
+			NewWithT(t).Expect(err).To(BeNil())
+			NewWithT(t).Expect(string(buf)).To(Equal(msg))
+		}
+
+		_ = conn.Close()
+	}
+
+	t.Run("target not allowed by agent", func(t *testing.T) {
+		_, err := Dial(ctx, Opt{Gateway: c.GatewayURL(0), AgentHost: "local", Target: "localhost:22"})
+		NewWithT(t).Expect(err).NotTo(BeNil())
+		NewWithT(t).Expect(err.Error()).To(ContainSubstring("403"))
+	})
+
+	t.Run("unknown agent", func(t *testing.T) {
+		_, err := Dial(ctx, Opt{Gateway: c.GatewayURL(0), AgentHost: "unknown", Target: echo.Addr().String()})
+		NewWithT(t).Expect(err).NotTo(BeNil())
+		NewWithT(t).Expect(err.Error()).To(ContainSubstring("502"))
+	})
+}
@@ -2,6 +2,7 @@ package kubeagent
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -9,27 +10,29 @@ import (
 	"net"
 	"net/http"
 	nethttputil "net/http/httputil"
-	"os"
-	"os/signal"
 	"runtime"
 	"strings"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-courier/logr"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
-	"github.com/lestrrat-go/jwx/jwt"
 	"github.com/octohelm/kube-agent/pkg/httputil"
 	"github.com/octohelm/kube-agent/pkg/idgen"
 	"github.com/octohelm/kube-agent/pkg/jwtutil"
 	"github.com/octohelm/kube-agent/pkg/kubeagent/auth"
 	"github.com/octohelm/kube-agent/pkg/memberlist"
 	"github.com/octohelm/kube-agent/pkg/statuserr"
+	"github.com/octohelm/kube-agent/pkg/timeutil"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apiserver/pkg/authentication/user"
 	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 )
 
 const (
@@ -37,15 +40,61 @@ const (
 )
 
 type GatewayOpt struct {
-	IP           net.IP
-	ServiceName  string `flag:"service-name"`
-	JWKSEndpoint string `flag:"jwks-endpoint"`
-	Port         int    `flag:"port"`
+	IP          net.IP
+	ServiceName string `flag:"service-name"`
+	Port        int    `flag:"port"`
+	MemberPort  int    `flag:"member-port" desc:"port for gossip of gateway members, port+1000 when not set"`
+
+	TLSCertFile       string `flag:"tls-cert-file" desc:"serve https with the cert file"`
+	TLSPrivateKeyFile string `flag:"tls-private-key-file" desc:"serve https with the private key file"`
+
+	JWKSEndpoint               string            `flag:"jwks-endpoint" desc:"authenticate bearer jwt with the jwks, any issuer accepted"`
+	JWTIssuersFile             string            `flag:"jwt-issuers-file" desc:"authenticate bearer jwt from accepted issuers, each with own jwks and audiences"`
+	JWTLeeway                  timeutil.Duration `flag:"jwt-leeway" desc:"leeway for clock skew when checking exp, nbf and iat, overrides leeway of issuers file"`
+	JWKSRefreshInterval        timeutil.Duration `flag:"jwks-refresh-interval" default:"15m" desc:"interval to refresh jwks in background, max-age of Cache-Control preferred"`
+	JWKSMinRefetchInterval     timeutil.Duration `flag:"jwks-min-refetch-interval" default:"30s" desc:"min interval between jwks fetches triggered by unknown key id"`
+	TokenAuthFile              string            `flag:"token-auth-file" desc:"authenticate bearer token with static tokens in csv file"`
+	ClientCAFile               string            `flag:"client-ca-file" desc:"authenticate client certificates signed by the ca, requires https"`
+	AuthenticationTokenWebhook string            `flag:"authentication-token-webhook" desc:"authenticate bearer token by posting TokenReview to the endpoint"`
+	AllowAnonymous             bool              `flag:"allow-anonymous" desc:"allow requests without credentials to access everything, only for development"`
+	RevocationsFile            string            `flag:"revocations-file" desc:"revoked tokens by jti or subject, more could be added by POST /.sys/revocations"`
+	AdminGroup                 string            `flag:"admin-group" desc:"group of users allowed to list and add revocations at /.sys/revocations, nobody allowed when empty"`
+	TokenSigningKeyFile        string            `flag:"token-signing-key-file" desc:"pem or jwk private key to sign access tokens issued by token exchange, public keys served at /.well-known/jwks.json"`
+	TokenIssuer                string            `flag:"token-issuer" default:"kube-agent" desc:"issuer of access tokens issued by token exchange"`
+	TokenAudience              string            `flag:"token-audience" default:"kube-agent" desc:"audience of access tokens issued by token exchange"`
+	TokenTTL                   timeutil.Duration `flag:"token-ttl" default:"15m" desc:"lifetime of access tokens issued by token exchange"`
+	ScopeBindingsFile          string            `flag:"scope-bindings-file" desc:"bind scopes to users or groups of id tokens, enables token exchange at POST /.sys/token, tokens of jwks endpoint and jwt issuers file are accepted only for exchange or as agent tokens then"`
+	RolesFile                  string            `flag:"roles-file" desc:"named roles referenced by scopes, reloaded when changed"`
+	MemberSecret               string            `flag:"member-secret,env" desc:"secret shared by gateway members to trust the users of forwarded requests"`
+	DrainTimeout               timeutil.Duration `flag:"drain-timeout" default:"30s" desc:"max duration to wait in-flight requests done when shutdown, agents will be asked to reconnect to other members"`
+
+	AuthorizationMode                        string            `flag:"authorization-mode" default:"Scope" desc:"ordered authorizers, the first allow or deny wins, supports Scope,Webhook,AlwaysAllow"`
+	AuthorizationWebhook                     string            `flag:"authorization-webhook" desc:"authorize requests by posting SubjectAccessReview to the endpoint"`
+	AuthorizationWebhookCacheAuthorizedTTL   timeutil.Duration `flag:"authorization-webhook-cache-authorized-ttl" default:"5m" desc:"duration to cache allowed decisions of webhook"`
+	AuthorizationWebhookCacheUnauthorizedTTL timeutil.Duration `flag:"authorization-webhook-cache-unauthorized-ttl" default:"30s" desc:"duration to cache denied decisions of webhook"`
 }
 
-func NewGateway(opt GatewayOpt) (*Gateway, error) {
+func NewGateway(opt GatewayOpt, opts ...GatewayOption) (*Gateway, error) {
 	g := &Gateway{
-		opt: opt,
+		opt:         opt,
+		revocations: auth.NewRevocationList(),
+	}
+
+	for i := range opts {
+		opts[i](g)
+	}
+
+	// used when no id generator injected
+	idGen, err := idgen.FromIP(opt.IP)
+	if err != nil {
+		return nil, err
+	}
+	g.idGen = idGen
+
+	if opt.RevocationsFile != "" {
+		if err := g.revocations.LoadFile(opt.RevocationsFile); err != nil {
+			return nil, err
+		}
 	}
 
 	seeds := make([]string, 0)
@@ -53,7 +102,11 @@ func NewGateway(opt GatewayOpt) (*Gateway, error) {
 	m := memberlist.Member{
 		Name:     g.Addr(),
 		BindIP:   opt.IP,
-		BindPort: opt.Port + 1000,
+		BindPort: opt.MemberPort,
+	}
+
+	if m.BindPort == 0 {
+		m.BindPort = opt.Port + 1000
 	}
 
 	if opt.ServiceName != "" {
@@ -66,27 +119,217 @@ func NewGateway(opt GatewayOpt) (*Gateway, error) {
 		seeds = append(seeds, seed)
 	}
 
-	if opt.JWKSEndpoint != "" {
-		g.jwks = jwtutil.NewKeySet(jwtutil.SyncRemote(opt.JWKSEndpoint))
+	if opt.MemberSecret != "" {
+		g.authenticator = append(g.authenticator, auth.NewForwardedUserAuthenticator(opt.MemberSecret))
+	}
+
+	if opt.ClientCAFile != "" {
+		a, err := auth.NewX509Authenticator(opt.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		g.authenticator = append(g.authenticator, a)
+	}
+
+	if opt.TokenAuthFile != "" {
+		a, err := auth.NewTokenFileAuthenticator(opt.TokenAuthFile)
+		if err != nil {
+			return nil, err
+		}
+		g.authenticator = append(g.authenticator, a)
+	}
+
+	var signer *jwtutil.Signer
+
+	if opt.TokenSigningKeyFile != "" {
+		key, err := jwtutil.SigningKeyFromFile(opt.TokenSigningKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err = jwtutil.NewSigner(key)
+		if err != nil {
+			return nil, err
+		}
+		g.signer = signer
+	}
+
+	if opt.ScopeBindingsFile != "" {
+		if signer == nil {
+			return nil, errors.New("token signing key is required for token exchange")
+		}
+		if opt.JWTIssuersFile == "" && opt.JWKSEndpoint == "" {
+			return nil, errors.New("jwt issuers file or jwks endpoint is required for token exchange")
+		}
+
+		bindings, err := auth.ScopeBindingsFromFile(opt.ScopeBindingsFile)
+		if err != nil {
+			return nil, err
+		}
+
+		// id tokens of upstream issuers are only for exchange, never accepted as access tokens,
+		// except agent tokens to register tunnels and pull requests
+		upstream, err := NewJWTIssuers(opt, nil)
+		if err != nil {
+			return nil, err
+		}
+		g.upstreamIssuers = upstream
+		g.authenticator = append(g.authenticator, auth.NewAgentJWTAuthenticator(upstream, g.revocations))
+
+		issuers, err := NewJWTIssuers(GatewayOpt{
+			TokenIssuer:            opt.TokenIssuer,
+			TokenAudience:          opt.TokenAudience,
+			JWTLeeway:              opt.JWTLeeway,
+			JWKSRefreshInterval:    opt.JWKSRefreshInterval,
+			JWKSMinRefetchInterval: opt.JWKSMinRefetchInterval,
+		}, signer)
+		if err != nil {
+			return nil, err
+		}
+		g.issuers = issuers
+		g.authenticator = append(g.authenticator, auth.NewJWTAuthenticator(issuers, g.revocations))
+
+		g.tokenExchanger = &auth.TokenExchanger{
+			Issuer:   opt.TokenIssuer,
+			Audience: opt.TokenAudience,
+			TTL:      opt.TokenTTL.AsDuration(),
+			Signer:   signer,
+			Upstream: upstream,
+			Bindings: bindings,
+		}
+	} else if opt.JWTIssuersFile != "" || opt.JWKSEndpoint != "" || signer != nil {
+		issuers, err := NewJWTIssuers(opt, signer)
+		if err != nil {
+			return nil, err
+		}
+		g.issuers = issuers
+		g.authenticator = append(g.authenticator, auth.NewJWTAuthenticator(issuers, g.revocations))
+	}
+
+	if opt.AuthenticationTokenWebhook != "" {
+		g.authenticator = append(g.authenticator, auth.NewTokenReviewAuthenticator(opt.AuthenticationTokenWebhook))
+	}
+
+	var roles auth.RoleSource
+
+	if opt.RolesFile != "" {
+		rolesFile, err := auth.NewRolesFile(opt.RolesFile)
+		if err != nil {
+			return nil, err
+		}
+		g.roles = rolesFile
+		roles = rolesFile
+	}
+
+	if g.Authorizer == nil {
+		a, err := NewAuthorizer(opt, roles)
+		if err != nil {
+			return nil, err
+		}
+		g.Authorizer = a
 	}
 
 	g.memberList = memberlist.NewMemberList(m, seeds)
+	g.memberList.State = g.revocations
 
 	return g, nil
 }
 
+// NewJWTIssuers creates issuers from opt, and trusts tokens issued by self when signer provided
+func NewJWTIssuers(opt GatewayOpt, signer *jwtutil.Signer) (*jwtutil.Issuers, error) {
+	c := &jwtutil.IssuersConfig{}
+
+	if opt.JWTIssuersFile != "" {
+		loaded, err := jwtutil.IssuersConfigFromFile(opt.JWTIssuersFile)
+		if err != nil {
+			return nil, err
+		}
+		c = loaded
+	}
+
+	if opt.JWKSEndpoint != "" {
+		// any issuer for compatibility
+		c.Issuers = append(c.Issuers, jwtutil.IssuerConfig{JWKSURL: opt.JWKSEndpoint})
+	}
+
+	if signer != nil {
+		jwks, err := signer.MarshalJWKS()
+		if err != nil {
+			return nil, err
+		}
+		c.Issuers = append(c.Issuers, jwtutil.IssuerConfig{
+			Issuer:    opt.TokenIssuer,
+			JWKS:      jwks,
+			Audiences: []string{opt.TokenAudience},
+		})
+	}
+
+	if opt.JWTLeeway != 0 {
+		c.Leeway = opt.JWTLeeway
+	}
+
+	return jwtutil.NewIssuers(
+		*c,
+		jwtutil.WithRefreshInterval(opt.JWKSRefreshInterval.AsDuration()),
+		jwtutil.WithMinRefetchInterval(opt.JWKSMinRefetchInterval.AsDuration()),
+	)
+}
+
+// NewAuthorizer creates authorizer by opt.AuthorizationMode, roles is optional for scopes referencing named roles
+func NewAuthorizer(opt GatewayOpt, roles auth.RoleSource) (authorizer.Authorizer, error) {
+	chain := auth.AuthorizerChain{}
+
+	for _, mode := range strings.Split(opt.AuthorizationMode, ",") {
+		switch mode = strings.TrimSpace(mode); mode {
+		case "":
+		case "Scope":
+			chain = append(chain, auth.NewScopeAuthorizer(roles))
+		case "Webhook":
+			if opt.AuthorizationWebhook == "" {
+				return nil, errors.New("authorization webhook is required for Webhook mode")
+			}
+			chain = append(chain, auth.NewWebhookAuthorizer(
+				opt.AuthorizationWebhook,
+				opt.AuthorizationWebhookCacheAuthorizedTTL.AsDuration(),
+				opt.AuthorizationWebhookCacheUnauthorizedTTL.AsDuration(),
+			))
+		case "AlwaysAllow":
+			chain = append(chain, auth.AlwaysAllow())
+		default:
+			return nil, fmt.Errorf("unsupported authorization mode %s", mode)
+		}
+	}
+
+	return chain, nil
+}
+
 type Gateway struct {
-	InjectContext func(ctx context.Context) context.Context
+	// Authorizer authorizes requests of authenticated users
+	Authorizer    authorizer.Authorizer
 	opt           GatewayOpt
+	prefix        string
+	middlewares   []func(http.Handler) http.Handler
+	hooks         GatewayHooks
+	injectContext func(ctx context.Context) context.Context
+	idGen         idgen.IDGen
 	tunnels       sync.Map
-	jwks          *jwtutil.KeySet
-	memberList    *memberlist.MemberList
+	authenticator auth.Chain
+	issuers       *jwtutil.Issuers
+	// upstreamIssuers validates id tokens for token exchange
+	upstreamIssuers *jwtutil.Issuers
+	revocations     *auth.RevocationList
+	roles           *auth.RolesFile
+	signer          *jwtutil.Signer
+	tokenExchanger  *auth.TokenExchanger
+	memberList      *memberlist.MemberList
+	draining        int32
+	inflight        int64
+	forwards        sync.Map
 }
 
 func (g *Gateway) Rand(agentHost string) (c *Tunnel, err error) {
 	g.tunnels.Range(func(key, value interface{}) bool {
 		channel := value.(*Tunnel)
-		if channel.Meta.AgentHost == agentHost {
+		if channel.Meta.AgentHost == agentHost && channel.Available() {
 			c = channel
 			return false
 		}
@@ -98,42 +341,66 @@ func (g *Gateway) Rand(agentHost string) (c *Tunnel, err error) {
 	return
 }
 
-func (g *Gateway) ResolveRequestTransit(id *KubeAgentRequestID) (req *RequestTransit, err error) {
+// ClaimRequestTransit claims the request from the tunnel which notified, only once
+func (g *Gateway) ClaimRequestTransit(id *KubeAgentRequestID, proof string) (req *RequestTransit, err error) {
+	rid := id.String()
+	err = ErrRequestNotFound
+
 	g.tunnels.Range(func(key, value interface{}) bool {
 		channel := value.(*Tunnel)
 		if channel.Meta.AgentHost == id.AgentHost {
-			rid := id.String()
-
-			v, ok := channel.requests.Load(rid)
-			if ok {
-				req = v.(*RequestTransit)
+			req, err = channel.Claim(rid, proof)
+			if err != ErrRequestNotFound {
 				return false
 			}
 		}
 		return true
 	})
-	if req == nil {
-		return nil, ErrRequestNotFound
+
+	switch err {
+	case ErrRequestClaimed:
+		requestClaimsRejected.WithLabelValues(id.AgentHost, "claimed").Inc()
+	case ErrInvalidProof:
+		requestClaimsRejected.WithLabelValues(id.AgentHost, "invalid_proof").Inc()
 	}
 	return
 }
 
-func (g *Gateway) Register(ctx context.Context, conn *websocket.Conn, agentHost string) (*Tunnel, error) {
-	c, err := NewTunnel(conn, idgen.FromContext(ctx), TunnelMeta{
+func (g *Gateway) Register(ctx context.Context, conn *websocket.Conn, agentHost string, agentLabels labels.Set, secret string) (*Tunnel, error) {
+	gen := idgen.FromContext(ctx)
+	if gen == nil {
+		gen = g.idGen
+	}
+
+	c, err := NewTunnel(conn, gen, TunnelMeta{
 		GatewayAddress: g.Addr(),
 		AgentHost:      agentHost,
-	})
+		AgentLabels:    agentLabels,
+	}, secret)
 	if err != nil {
 		return nil, err
 	}
 
+	if g.signer != nil {
+		sealer := &EnvelopeSealer{Issuer: g.opt.TokenIssuer, Signer: g.signer}
+		c.Seal = sealer.Seal
+	}
+
 	c.WillClose = func() {
 		logr.FromContext(ctx).Warn(fmt.Errorf("agent channel for %s disconnected.", agentHost))
 		g.tunnels.Delete(c.ID)
+
+		if g.hooks.OnAgentDisconnected != nil {
+			g.hooks.OnAgentDisconnected(ctx, c.Meta)
+		}
 	}
 
 	g.tunnels.Store(c.ID, c)
 
+	if g.hooks.OnAgentRegistered != nil {
+		g.hooks.OnAgentRegistered(ctx, c.Meta)
+	}
+
 	return c, nil
 }
 
@@ -141,12 +408,96 @@ func (g *Gateway) Addr() string {
 	return fmt.Sprintf("%s:%d", g.opt.IP, g.opt.Port)
 }
 
-func (g *Gateway) Serve(ctx context.Context) (err error) {
+func (g *Gateway) secure() bool {
+	return g.opt.TLSCertFile != ""
+}
+
+func (g *Gateway) memberScheme() string {
+	if g.secure() {
+		return "https"
+	}
+	return "http"
+}
+
+func (g *Gateway) memberClient(ctx context.Context) (*http.Client, error) {
+	return httputil.ConnClientContext(ctx, g.memberTransport)
+}
+
+func (g *Gateway) memberTransport(rt http.RoundTripper) http.RoundTripper {
+	if t, ok := rt.(*http.Transport); ok && g.secure() {
+		// members are addressed by ip, which is usually not in the serving certificate.
+		// and only http/1.1 to make sure upgrade requests could be forwarded.
+		t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return rt
+}
+
+// Serve serves until ctx canceled, then drains and shutdowns
+func (g *Gateway) Serve(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var err error
+	var errOnce sync.Once
+
+	fail := func(e error) {
+		errOnce.Do(func() {
+			err = e
+		})
+		cancel()
+	}
+
+	wg := &sync.WaitGroup{}
+
+	// others stopped after the http server drained, to keep the member visible while draining
+	runCtx, cancelRun := context.WithCancel(withoutCancel{Context: ctx})
+	defer cancelRun()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		if e := g.Run(runCtx); e != nil {
+			fail(e)
+		}
+	}()
+
+	if e := g.serve(ctx); e != nil {
+		fail(e)
+	}
+
+	cancelRun()
+	wg.Wait()
+
+	return err
+}
+
+// Run runs background services, like member list and jwks refreshing, until ctx canceled.
+// When the gateway embedded by Handler, Run should be called instead of Serve, and Drain before ctx canceled.
+func (g *Gateway) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var err error
+	var errOnce sync.Once
+
 	wg := &sync.WaitGroup{}
 
 	servers := []func(ctx context.Context) error{
 		g.memberList.Serve,
-		g.serve,
+	}
+
+	if g.issuers != nil {
+		servers = append(servers, g.issuers.Serve)
+	}
+
+	if g.upstreamIssuers != nil {
+		servers = append(servers, g.upstreamIssuers.Serve)
+	}
+
+	if g.roles != nil {
+		servers = append(servers, g.roles.Serve)
 	}
 
 	for i := range servers {
@@ -156,14 +507,17 @@ func (g *Gateway) Serve(ctx context.Context) (err error) {
 			defer wg.Done()
 
 			if e := s(ctx); e != nil {
-				err = e
+				errOnce.Do(func() {
+					err = e
+				})
+				cancel()
 			}
 		}(servers[i])
 	}
 
 	wg.Wait()
 
-	return
+	return err
 }
 
 func (g *Gateway) serve(ctx context.Context) error {
@@ -171,50 +525,161 @@ func (g *Gateway) serve(ctx context.Context) error {
 
 	srv.Addr = fmt.Sprintf(":%d", g.opt.Port)
 	srv.Handler = httputil.PipeHandler(
-		httputil.HealthCheckHandler(),
+		httputil.HealthCheckHandler(g.healthy),
 		httputil.PProfHandler(true),
-	)(g.NewRouter())
+	)(g.Handler())
 
 	log := logr.FromContext(ctx)
 
+	lis, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+
+	serve := func() error {
+		return srv.Serve(lis)
+	}
+
+	if g.secure() {
+		srv.TLSConfig = &tls.Config{
+			// client certificates will be verified by authenticator
+			ClientAuth: tls.RequestClientCert,
+		}
+
+		serve = func() error {
+			return srv.ServeTLS(lis, g.opt.TLSCertFile, g.opt.TLSPrivateKeyFile)
+		}
+	}
+
+	serveErr := make(chan error, 1)
+
 	go func() {
 		log.Info("listen on %s, (%s, %s)", g.Addr(), runtime.GOOS, runtime.GOARCH)
 
-		if err := srv.ListenAndServe(); err != nil {
-			if err == http.ErrServerClosed {
-				log.Info("server closed")
-			} else {
-				log.Fatal(err)
-			}
+		if err := serve(); err != nil && err != http.ErrServerClosed {
+			serveErr <- err
+			return
 		}
+		log.Info("server closed")
 	}()
 
-	stopCh := make(chan os.Signal, 1)
-	signal.Notify(stopCh, os.Interrupt, syscall.SIGTERM)
-	<-stopCh
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	drainTimeout := g.opt.DrainTimeout.AsDuration()
+	log.Info("draining in %s", drainTimeout)
+
+	drainCtx, cancelDrain := context.WithTimeout(withoutCancel{Context: ctx}, drainTimeout)
+	defer cancelDrain()
+
+	if err := g.Drain(drainCtx); err != nil {
+		log.Warn(errors.Wrapf(err, "drain timeout, %d requests in-flight", atomic.LoadInt64(&g.inflight)))
+	}
+
+	g.tunnels.Range(func(key, value interface{}) bool {
+		value.(*Tunnel).Shutdown()
+		return true
+	})
+
+	g.closeForwards()
 
 	timeout := 5 * time.Second
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	shutdownCtx, cancel := context.WithTimeout(withoutCancel{Context: ctx}, timeout)
 	defer cancel()
 
-	return srv.Shutdown(ctx)
+	return srv.Shutdown(shutdownCtx)
+}
+
+func (g *Gateway) isDraining() bool {
+	return atomic.LoadInt32(&g.draining) > 0
+}
+
+func (g *Gateway) healthy() error {
+	if g.isDraining() {
+		return errors.New("draining")
+	}
+	return nil
+}
+
+// Drain stops accepting new agents, asks registered agents to reconnect to other members,
+// and waits in-flight requests done until ctx done.
+func (g *Gateway) Drain(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&g.draining, 0, 1) {
+		return nil
+	}
+
+	if err := g.memberList.Drain(); err != nil {
+		logr.FromContext(ctx).Warn(errors.Wrap(err, "mark member draining failed"))
+	}
+
+	g.tunnels.Range(func(key, value interface{}) bool {
+		go value.(*Tunnel).Reconnect()
+		return true
+	})
+
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(&g.inflight) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
 }
 
 type GatewayStatus struct {
 	Members []string
 }
 
+// Handler serves all routes of the gateway under the prefix
+func (g *Gateway) Handler() http.Handler {
+	if g.prefix == "" {
+		return g.NewRouter()
+	}
+	return http.StripPrefix(g.prefix, g.NewRouter())
+}
+
 func (g *Gateway) NewRouter() *mux.Router {
 	r := mux.NewRouter()
 
 	r.HandleFunc("/.sys/status", g.statusHandler).Methods(http.MethodGet)
 	r.HandleFunc("/.sys/agents", g.agentsHandler).Methods(http.MethodGet)
 	r.Handle("/.sys/metrics", promhttp.Handler()).Methods(http.MethodGet)
+	r.HandleFunc("/.sys/revocations", g.listRevocationsHandler).Methods(http.MethodGet)
+	r.HandleFunc("/.sys/revocations", g.revokeHandler).Methods(http.MethodPost)
+
+	if g.signer != nil {
+		r.HandleFunc("/.well-known/jwks.json", g.jwksHandler).Methods(http.MethodGet)
+	}
+	if g.tokenExchanger != nil {
+		r.Handle("/.sys/token", g.tokenExchanger).Methods(http.MethodPost)
+		r.HandleFunc("/.sys/kubeconfig", g.kubeconfigHandler).Methods(http.MethodGet)
+	}
 
 	r.HandleFunc("/agents/{agentHost}/register", g.registerHandler)
 	r.HandleFunc("/agents/{agentHost}/requests", g.requestsHandler)
 
-	r.PathPrefix("/proxies/{agentHost}/").HandlerFunc(g.proxyHandler)
+	withMiddlewares := func(h http.Handler) http.Handler {
+		for i := len(g.middlewares) - 1; i >= 0; i-- {
+			h = g.middlewares[i](h)
+		}
+		return h
+	}
+
+	proxy := withMiddlewares(http.HandlerFunc(g.proxyHandler))
+
+	r.PathPrefix("/proxies/{agentHost}/").Handler(proxy)
+	// service targets in cluster, like prometheus and grafana, configured by agent
+	r.PathPrefix("/services/{agentHost}/{target}/").Handler(proxy)
+	// tcp streams to host:port allowed by agent
+	r.Handle("/forwards/{agentHost}/{target}", withMiddlewares(http.HandlerFunc(g.forwardHandler)))
 
 	return r
 }
@@ -250,10 +715,10 @@ func (g *Gateway) agentsHandler(rw http.ResponseWriter, req *http.Request) {
 				continue
 			}
 
-			c, _ := httputil.ConnClientContext(req.Context())
+			c, _ := g.memberClient(req.Context())
 
 			if c != nil {
-				req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/.sys/agents?single=true", host), nil)
+				req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("%s://%s%s/.sys/agents?single=true", g.memberScheme(), host, g.prefix), nil)
 
 				resp, _ := c.Do(req)
 				if resp != nil {
@@ -276,8 +741,144 @@ func (g *Gateway) agentsHandler(rw http.ResponseWriter, req *http.Request) {
 	_ = json.NewEncoder(rw).Encode(agentTunnels)
 }
 
+func (g *Gateway) jwksHandler(rw http.ResponseWriter, req *http.Request) {
+	data, err := g.signer.MarshalJWKS()
+	if err != nil {
+		statuserr.WriteToResp(rw, statuserr.New(http.StatusInternalServerError, err))
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json;charset=utf-8")
+	rw.Header().Set("Cache-Control", "public, max-age=300")
+
+	rw.WriteHeader(http.StatusOK)
+	_, _ = rw.Write(data)
+}
+
+// kubeconfigHandler generates kubeconfig for agent hosts of query, which uses kube-agent-credential to fetch tokens.
+// the id token to exchange is passed by query subjectTokenCommand or subjectTokenFile.
+func (g *Gateway) kubeconfigHandler(rw http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	agentHosts := query["agentHost"]
+	if len(agentHosts) == 0 {
+		statuserr.WriteToResp(rw, statuserr.New(http.StatusBadRequest, fmt.Errorf("missing agentHost")))
+		return
+	}
+
+	var subjectTokenArg string
+
+	switch {
+	case query.Get("subjectTokenCommand") != "":
+		subjectTokenArg = "--subject-token-command=" + query.Get("subjectTokenCommand")
+	case query.Get("subjectTokenFile") != "":
+		subjectTokenArg = "--subject-token-file=" + query.Get("subjectTokenFile")
+	default:
+		statuserr.WriteToResp(rw, statuserr.New(http.StatusBadRequest, fmt.Errorf("missing subjectTokenCommand or subjectTokenFile")))
+		return
+	}
+
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	gateway := fmt.Sprintf("%s://%s%s", scheme, req.Host, g.prefix)
+
+	c := clientcmdapi.NewConfig()
+
+	for _, agentHost := range agentHosts {
+		c.Clusters[agentHost] = &clientcmdapi.Cluster{
+			Server: fmt.Sprintf("%s/proxies/%s", gateway, agentHost),
+		}
+		c.AuthInfos[agentHost] = &clientcmdapi.AuthInfo{
+			Exec: &clientcmdapi.ExecConfig{
+				APIVersion:      "client.authentication.k8s.io/v1",
+				Command:         "kube-agent-credential",
+				Args:            []string{"--gateway=" + gateway, "--agent-host=" + agentHost, subjectTokenArg},
+				InstallHint:     "go install github.com/octohelm/kube-agent/cmd/kube-agent-credential@latest",
+				InteractiveMode: clientcmdapi.NeverExecInteractiveMode,
+			},
+		}
+		c.Contexts[agentHost] = &clientcmdapi.Context{
+			Cluster:  agentHost,
+			AuthInfo: agentHost,
+		}
+	}
+
+	c.CurrentContext = agentHosts[0]
+
+	data, err := clientcmd.Write(*c)
+	if err != nil {
+		statuserr.WriteToResp(rw, statuserr.New(http.StatusInternalServerError, err))
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/yaml")
+
+	rw.WriteHeader(http.StatusOK)
+	_, _ = rw.Write(data)
+}
+
+func (g *Gateway) listRevocationsHandler(rw http.ResponseWriter, req *http.Request) {
+	if err := g.authorizeSys(req); err != nil {
+		statuserr.WriteToResp(rw, err)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json;charset=utf-8")
+
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(g.revocations.List())
+}
+
+func (g *Gateway) revokeHandler(rw http.ResponseWriter, req *http.Request) {
+	if err := g.authorizeSys(req); err != nil {
+		statuserr.WriteToResp(rw, err)
+		return
+	}
+
+	r := auth.Revocation{}
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		statuserr.WriteToResp(rw, statuserr.New(http.StatusBadRequest, err))
+		return
+	}
+
+	if err := g.revocations.Revoke(r); err != nil {
+		statuserr.WriteToResp(rw, statuserr.New(http.StatusBadRequest, err))
+		return
+	}
+
+	data, _ := json.Marshal([]auth.Revocation{r})
+	g.memberList.Broadcast(data)
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// authorizeSys authorizes requests to manage the gateway, like revocations, only users in admin group allowed,
+// scopes are not used, which are granted to access agents.
+func (g *Gateway) authorizeSys(req *http.Request) *statuserr.StatusErr {
+	u, err := g.Authenticate(req)
+	if err != nil {
+		return statuserr.New(http.StatusUnauthorized, err)
+	}
+
+	if g.isAnonymous(u) {
+		return nil
+	}
+
+	if g.opt.AdminGroup != "" {
+		for _, group := range u.GetGroups() {
+			if group == g.opt.AdminGroup {
+				return nil
+			}
+		}
+	}
+
+	return statuserr.New(http.StatusForbidden, fmt.Errorf("%s is not allowed to manage the gateway", u.GetName()))
+}
+
 func (g *Gateway) requestsHandler(rw http.ResponseWriter, req *http.Request) {
-	t, err := g.ValidateTokenIfNeed(req)
+	u, err := g.Authenticate(req)
 	if err != nil {
 		statuserr.WriteToResp(rw, statuserr.New(http.StatusUnauthorized, err))
 		return
@@ -289,8 +890,8 @@ func (g *Gateway) requestsHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if t != nil {
-		if t.Subject() != "KUBE_AGENT" || strings.Join(t.Audience(), "") != requestID.AgentHost {
+	if !g.isAnonymous(u) {
+		if u.GetName() != auth.AgentUserName(requestID.AgentHost) {
 			statuserr.WriteToResp(rw, statuserr.New(http.StatusForbidden, fmt.Errorf("no access to pull requests of %s", requestID.AgentHost)))
 			return
 		}
@@ -299,17 +900,31 @@ func (g *Gateway) requestsHandler(rw http.ResponseWriter, req *http.Request) {
 	if requestID.GatewayAddress != g.Addr() {
 		rr := &nethttputil.ReverseProxy{
 			Director: func(r *http.Request) {
-				r.URL.Scheme = "http"
+				r.URL.Scheme = g.memberScheme()
 				r.URL.Host = requestID.GatewayAddress
+				r.URL.Path = g.prefix + r.URL.Path
+				if r.URL.RawPath != "" {
+					r.URL.RawPath = g.prefix + r.URL.RawPath
+				}
 			},
 		}
+		if g.secure() {
+			rr.Transport = g.memberTransport(http.DefaultTransport.(*http.Transport).Clone())
+		}
 		rr.ServeHTTP(rw, req)
 		return
 	}
 
-	rs, err := g.ResolveRequestTransit(requestID)
+	rs, err := g.ClaimRequestTransit(requestID, req.Header.Get(HTTP_KUBE_AGENT_REQUEST_PROOF))
 	if err != nil {
-		statuserr.WriteToResp(rw, statuserr.New(http.StatusBadRequest, err))
+		switch err {
+		case ErrRequestClaimed:
+			statuserr.WriteToResp(rw, statuserr.New(http.StatusConflict, err))
+		case ErrInvalidProof:
+			statuserr.WriteToResp(rw, statuserr.New(http.StatusForbidden, err))
+		default:
+			statuserr.WriteToResp(rw, statuserr.New(http.StatusBadRequest, err))
+		}
 		return
 	}
 
@@ -335,7 +950,7 @@ func (g *Gateway) requestsHandler(rw http.ResponseWriter, req *http.Request) {
 }
 
 func (g *Gateway) registerHandler(rw http.ResponseWriter, req *http.Request) {
-	t, err := g.ValidateTokenIfNeed(req)
+	u, err := g.Authenticate(req)
 	if err != nil {
 		statuserr.WriteToResp(rw, statuserr.New(http.StatusUnauthorized, err))
 		return
@@ -343,13 +958,30 @@ func (g *Gateway) registerHandler(rw http.ResponseWriter, req *http.Request) {
 
 	agentHost := mux.Vars(req)["agentHost"]
 
-	if t != nil {
-		if t.Subject() != "KUBE_AGENT" || strings.Join(t.Audience(), "") != agentHost {
+	if !g.isAnonymous(u) {
+		if u.GetName() != auth.AgentUserName(agentHost) {
 			statuserr.WriteToResp(rw, statuserr.New(http.StatusUnauthorized, fmt.Errorf("invalid token for %s", agentHost)))
 			return
 		}
 	}
 
+	if g.isDraining() {
+		statuserr.WriteToResp(rw, statuserr.New(http.StatusServiceUnavailable, fmt.Errorf("gateway %s is draining", g.Addr())))
+		return
+	}
+
+	agentLabels := AgentLabels{}
+	if err := agentLabels.UnmarshalText([]byte(req.Header.Get(HTTP_HEADER_KUBE_AGENT_LABELS))); err != nil {
+		statuserr.WriteToResp(rw, statuserr.New(http.StatusBadRequest, err))
+		return
+	}
+
+	secret, err := NewTunnelSecret()
+	if err != nil {
+		statuserr.WriteToResp(rw, statuserr.New(http.StatusInternalServerError, err))
+		return
+	}
+
 	ctx := g.InjectContext(req.Context())
 
 	log := logr.FromContext(ctx)
@@ -357,14 +989,16 @@ func (g *Gateway) registerHandler(rw http.ResponseWriter, req *http.Request) {
 	c, err := (&websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
-	}).Upgrade(rw, req, nil)
+	}).Upgrade(rw, req, http.Header{
+		HTTP_KUBE_AGENT_TUNNEL_SECRET: {secret},
+	})
 
 	if err != nil {
 		log.Error(err)
 		return
 	}
 
-	channel, err := g.Register(ctx, c, agentHost)
+	channel, err := g.Register(ctx, c, agentHost, labels.Set(agentLabels), secret)
 	if err != nil {
 		_ = c.Close()
 		log.Error(errors.Wrapf(err, "register channel %s failed:", agentHost))
@@ -374,18 +1008,69 @@ func (g *Gateway) registerHandler(rw http.ResponseWriter, req *http.Request) {
 	channel.Wait(ctx)
 }
 
-func (g *Gateway) DoRequest(agentHost string, req *http.Request) (*http.Response, error) {
+func (g *Gateway) DoRequest(agentHost string, attrs *auth.RequestInfoAttrs, req *http.Request) (*http.Response, error) {
 	// clear RequestURI for forward
 	req.RequestURI = ""
 
-	resp, err := g.doRequestThroughStoredTunnel(agentHost, req)
+	channel, err := g.Rand(agentHost)
 	if err != nil {
 		if err == ErrTunnelNotFound {
-			// retry next tunnel
+			if u := attrs.GetUser(); g.opt.MemberSecret != "" && !g.isAnonymous(u) {
+				if err := auth.ForwardUser(req, u, g.opt.MemberSecret); err != nil {
+					return nil, err
+				}
+			}
+			// retry next member, which holds the tunnel will authorize the request
 			return g.doRequestThroughOtherMember(agentHost, req)
 		}
 		return nil, err
 	}
+
+	req.Header.Del(auth.HTTP_HEADER_FORWARDED_USER)
+
+	var filter *RestrictedFilter
+	var restriction *auth.Restriction
+
+	attrs.AgentHost = channel.Meta.AgentHost
+	attrs.AgentLabels = channel.Meta.AgentLabels
+
+	if !g.isAnonymous(attrs.GetUser()) {
+		restriction, err = g.Authorize(req.Context(), attrs)
+		if err != nil {
+			return nil, err
+		}
+		// restrictions of services and forwards are only carried by envelope
+		if !restriction.IsZero() && attrs.ServiceTarget == "" && attrs.ForwardTarget == "" {
+			filter = NewRestrictedFilter(restriction, attrs)
+			filter.WrapRequest(req)
+		}
+	}
+
+	if g.hooks.BeforeProxy != nil {
+		if err := g.hooks.BeforeProxy(req.Context(), channel.Meta, attrs); err != nil {
+			return nil, err
+		}
+	}
+
+	// sealed by tunnel when dispatched
+	req = req.WithContext(WithEnvelope(req.Context(), NewEnvelope(attrs.GetUser(), restriction)))
+
+	resp, err := g.doRequestThroughTunnel(channel, req)
+
+	if g.hooks.AfterProxy != nil {
+		g.hooks.AfterProxy(req.Context(), channel.Meta, attrs, resp, err)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if filter != nil {
+		if err := filter.WrapResponse(resp); err != nil {
+			return nil, err
+		}
+	}
+
 	return resp, nil
 }
 
@@ -409,34 +1094,51 @@ func (g *Gateway) doRequestThroughOtherMember(agentHost string, req *http.Reques
 	}
 
 	unvisitedMemberList := make([]string, 0)
+	drainingMemberList := make([]string, 0)
+
 	for _, member := range registeredMemberList {
 		if !visitedMembers[member] {
+			// draining members may still hold tunnels, but try them last
+			if g.memberList.IsDraining(member) {
+				drainingMemberList = append(drainingMemberList, member)
+				continue
+			}
 			unvisitedMemberList = append(unvisitedMemberList, member)
 		}
 	}
 
+	if len(unvisitedMemberList) == 0 {
+		unvisitedMemberList = drainingMemberList
+	}
+
 	if len(unvisitedMemberList) == 0 {
 		return nil, statuserr.New(http.StatusBadGateway, fmt.Errorf("tunnel for %s is closed or not registered", agentHost))
 	}
 
 	nextMember := unvisitedMemberList[rand.Intn(len(unvisitedMemberList))]
 
-	c, err := httputil.ConnClientContext(req.Context())
+	c, err := g.memberClient(req.Context())
 	if err != nil {
 		return nil, err
 	}
 
-	req.URL.Scheme = "http"
-
+	req.URL.Scheme = g.memberScheme()
 	req.URL.Host = nextMember
 
+	if g.prefix != "" && !strings.HasPrefix(req.URL.Path, g.prefix+"/") {
+		req.URL.Path = g.prefix + req.URL.Path
+		if req.URL.RawPath != "" {
+			req.URL.RawPath = g.prefix + req.URL.RawPath
+		}
+	}
+
 	resp, err := c.Do(req)
 	if err != nil {
 		if netErr, ok := errors.Unwrap(err).(*net.OpError); ok {
 			if strings.Contains(netErr.Error(), "connection refused") {
 				// next member may dead
-				// retry next tunnel
-				return g.DoRequest(agentHost, req)
+				// retry next member
+				return g.doRequestThroughOtherMember(agentHost, req)
 			}
 		}
 		return nil, err
@@ -444,12 +1146,7 @@ func (g *Gateway) doRequestThroughOtherMember(agentHost string, req *http.Reques
 	return resp, err
 }
 
-func (g *Gateway) doRequestThroughStoredTunnel(agentHost string, req *http.Request) (resp *http.Response, err error) {
-	channel, err := g.Rand(agentHost)
-	if err != nil {
-		return nil, err
-	}
-
+func (g *Gateway) doRequestThroughTunnel(channel *Tunnel, req *http.Request) (resp *http.Response, err error) {
 	c, err := httputil.ConnClientContext(req.Context(), func(rt http.RoundTripper) http.RoundTripper {
 		return channel
 	})
@@ -462,6 +1159,9 @@ func (g *Gateway) doRequestThroughStoredTunnel(agentHost string, req *http.Reque
 }
 
 func (g *Gateway) proxyHandler(rw http.ResponseWriter, req *http.Request) {
+	atomic.AddInt64(&g.inflight, 1)
+	defer atomic.AddInt64(&g.inflight, -1)
+
 	ctx := g.InjectContext(req.Context())
 	req = req.WithContext(ctx)
 
@@ -492,28 +1192,30 @@ func (g *Gateway) proxyHandler(rw http.ResponseWriter, req *http.Request) {
 		}
 	}()
 
-	agentHost := mux.Vars(req)["agentHost"]
+	vars := mux.Vars(req)
+	agentHost := vars["agentHost"]
 
-	attrs, err := auth.RequestAttributesFromRequest(req, "proxies/"+agentHost)
-	if err != nil {
-		writeErr(statuserr.New(http.StatusBadRequest, err))
-		return
+	var attrs *auth.RequestInfoAttrs
+
+	if target := vars["target"]; target != "" {
+		attrs = auth.ServiceRequestAttributesFromRequest(req, agentHost, target)
+	} else {
+		a, err := auth.RequestAttributesFromRequest(req, "proxies/"+agentHost)
+		if err != nil {
+			writeErr(statuserr.New(http.StatusBadRequest, err))
+			return
+		}
+		attrs = a
 	}
 
-	t, err := g.ValidateTokenIfNeed(req)
+	u, err := g.Authenticate(req)
 	if err != nil {
 		writeErr(statuserr.New(http.StatusUnauthorized, err))
 		return
 	}
+	attrs.User = u
 
-	if t != nil {
-		if err := g.ValidateKubeAccessToken(req, t, agentHost, attrs); err != nil {
-			writeErr(err.(*statuserr.StatusErr))
-			return
-		}
-	}
-
-	resp, err := g.DoRequest(agentHost, req)
+	resp, err := g.DoRequest(agentHost, attrs, req)
 	if err != nil {
 		writeErr(statuserr.New(http.StatusBadGateway, err))
 		return
@@ -530,55 +1232,81 @@ func (g *Gateway) proxyHandler(rw http.ResponseWriter, req *http.Request) {
 	statusCode = resp.StatusCode
 	rw.WriteHeader(resp.StatusCode)
 
-	if _, err := io.Copy(rw, resp.Body); err != nil {
+	var w io.Writer = rw
+
+	// streaming, like watch, flush each write
+	if f, ok := rw.(http.Flusher); ok && resp.ContentLength == -1 {
+		w = &flushWriter{w: rw, f: f}
+	}
+
+	if _, err := io.Copy(w, resp.Body); err != nil {
 		writeErr(statuserr.New(http.StatusInternalServerError, err))
 	}
 }
 
-func (g *Gateway) ValidateTokenIfNeed(req *http.Request) (jwt.Token, error) {
-	if g.jwks != nil {
-		a := jwtutil.ParseAuthorization(req.Header.Get("Authorization"))
-		tokStr := a.Get("Bearer")
-		if tokStr == "" {
-			return nil, errors.New("missing token")
-		}
-		t, err := g.jwks.Validate(req.Context(), tokStr)
-		if err != nil {
-			return nil, err
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.f.Flush()
+	return n, err
+}
+
+func (g *Gateway) Authenticate(req *http.Request) (user.Info, error) {
+	resp, ok, err := g.authenticator.AuthenticateRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if g.opt.AllowAnonymous {
+			return auth.Anonymous().User, nil
 		}
+		return nil, fmt.Errorf("missing credentials")
+	}
 
-		return t, nil
+	// users of all authenticators could be revoked by subject, jwt users by jti too, which is the uid
+	if err := g.revocations.IsRevoked(resp.User.GetUID(), resp.User.GetName()); err != nil {
+		return nil, err
 	}
-	return nil, nil
+
+	return resp.User, nil
 }
 
-func (g *Gateway) ValidateKubeAccessToken(req *http.Request, t jwt.Token, agentHost string, attrs authorizer.Attributes) error {
-	scopes, exists := t.Get("scopes")
-	if !exists {
-		return statuserr.New(http.StatusUnauthorized, fmt.Errorf("invalid kube access token"))
-	}
+// isAnonymous reports whether the request without credentials allowed as anonymous, which skips authorization
+func (g *Gateway) isAnonymous(u user.Info) bool {
+	return g.opt.AllowAnonymous && auth.IsAnonymous(u)
+}
 
-	agentHostScopes, ok := scopes.(map[string]interface{})
-	if !ok {
-		return statuserr.New(http.StatusForbidden, fmt.Errorf("invalid scope"))
+func (g *Gateway) Authorize(ctx context.Context, attrs authorizer.Attributes) (*auth.Restriction, error) {
+	if g.Authorizer == nil {
+		return nil, statuserr.New(http.StatusForbidden, fmt.Errorf("no authorizer"))
 	}
 
-	authScopes := auth.ScopesFromMap(agentHostScopes)
+	var decision authorizer.Decision
+	var reason string
+	var restriction *auth.Restriction
+	var err error
 
-	s, ok := authScopes[agentHost]
-	if !ok {
-		return statuserr.New(http.StatusForbidden, fmt.Errorf("invalid token for %s", agentHost))
+	if ra, ok := g.Authorizer.(auth.RestrictingAuthorizer); ok {
+		decision, reason, restriction, err = ra.AuthorizeWithRestriction(ctx, attrs)
+	} else {
+		decision, reason, err = g.Authorizer.Authorize(ctx, attrs)
 	}
 
-	if currentNamespace := attrs.GetNamespace(); currentNamespace != "" {
-		if !auth.NamespaceMatches(s.Namespaces, attrs.GetNamespace()) {
-			return statuserr.New(http.StatusForbidden, fmt.Errorf("no access to resources in namespace %s", currentNamespace))
-		}
+	if decision == authorizer.DecisionAllow {
+		return restriction, nil
 	}
 
-	if !auth.RulesAllow(attrs, s.Rules...) {
-		return statuserr.New(http.StatusForbidden, fmt.Errorf("no access to %s", req.URL.String()))
+	if reason == "" {
+		reason = fmt.Sprintf("no access to %s", attrs.GetPath())
 	}
 
-	return nil
+	if err != nil {
+		logr.FromContext(ctx).Warn(errors.Wrapf(err, "authorize %s", attrs.GetPath()))
+	}
+
+	return nil, statuserr.New(http.StatusForbidden, fmt.Errorf("%s", reason))
 }
@@ -0,0 +1,139 @@
+package kubeagent
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-courier/logr"
+	"github.com/gorilla/mux"
+	"github.com/octohelm/kube-agent/pkg/kubeagent/auth"
+	"github.com/octohelm/kube-agent/pkg/statuserr"
+)
+
+// HTTP_UPGRADE_TCP upgrades requests under /forwards/{agentHost}/{host:port} to raw tcp streams
+const HTTP_UPGRADE_TCP = "tcp"
+
+// forwardHandler forwards the tcp stream to host:port through the agent,
+// the request should be upgraded to tcp, and the stream is piped after 101 responded.
+func (g *Gateway) forwardHandler(rw http.ResponseWriter, req *http.Request) {
+	atomic.AddInt64(&g.inflight, 1)
+	defer atomic.AddInt64(&g.inflight, -1)
+
+	ctx := g.InjectContext(req.Context())
+	req = req.WithContext(ctx)
+
+	log := logr.FromContext(ctx)
+
+	vars := mux.Vars(req)
+	agentHost, target := vars["agentHost"], vars["target"]
+
+	if !strings.EqualFold(req.Header.Get("Upgrade"), HTTP_UPGRADE_TCP) {
+		statuserr.WriteToResp(rw, statuserr.New(http.StatusBadRequest, fmt.Errorf("upgrade to %s required", HTTP_UPGRADE_TCP)))
+		return
+	}
+
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		statuserr.WriteToResp(rw, statuserr.New(http.StatusBadRequest, err))
+		return
+	}
+
+	attrs := auth.ForwardRequestAttributes(target)
+
+	u, err := g.Authenticate(req)
+	if err != nil {
+		statuserr.WriteToResp(rw, statuserr.New(http.StatusUnauthorized, err))
+		return
+	}
+	attrs.User = u
+
+	resp, err := g.DoRequest(agentHost, attrs, req)
+	if err != nil {
+		log.Error(err)
+		statuserr.WriteToResp(rw, statuserr.New(http.StatusBadGateway, err))
+		return
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	// denied or failed by agent
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		for k, vv := range resp.Header {
+			rw.Header()[k] = vv
+		}
+		rw.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(rw, resp.Body)
+		return
+	}
+
+	stream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		statuserr.WriteToResp(rw, statuserr.New(http.StatusBadGateway, fmt.Errorf("upgraded stream is not writable")))
+		return
+	}
+
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		statuserr.WriteToResp(rw, statuserr.New(http.StatusInternalServerError, fmt.Errorf("connection could not be hijacked")))
+		return
+	}
+
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	// closed when gateway shutdown, hijacked connections are not tracked by http server
+	g.forwards.Store(conn, true)
+	defer g.forwards.Delete(conn)
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if _, err := io.WriteString(brw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: "+HTTP_UPGRADE_TCP+"\r\n\r\n"); err != nil {
+		log.Error(err)
+		return
+	}
+	if err := brw.Flush(); err != nil {
+		log.Error(err)
+		return
+	}
+
+	startedAt := time.Now()
+
+	done := make(chan struct{}, 2)
+
+	go func() {
+		// buffered of the hijacked first
+		_, _ = io.Copy(stream, brw.Reader)
+		done <- struct{}{}
+	}()
+
+	go func() {
+		_, _ = io.Copy(conn, stream)
+		done <- struct{}{}
+	}()
+
+	// no half-close, any side closed ends the stream
+	<-done
+
+	log.WithValues(
+		"cost", time.Since(startedAt),
+		"user", u.GetName(),
+	).Info("forward to %s through %s closed", target, agentHost)
+}
+
+func (g *Gateway) closeForwards() {
+	g.forwards.Range(func(key, value interface{}) bool {
+		_ = key.(net.Conn).Close()
+		return true
+	})
+}
@@ -0,0 +1,69 @@
+package kubeagent
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/octohelm/kube-agent/pkg/kubeagent/auth"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+type GatewayOption = func(g *Gateway)
+
+// WithPrefix mounts all routes of the gateway under the prefix, like /kube-agent,
+// agents should connect with the prefix in gateway address, like gateway.example.com/kube-agent
+func WithPrefix(prefix string) GatewayOption {
+	return func(g *Gateway) {
+		g.prefix = "/" + strings.Trim(prefix, "/")
+		if g.prefix == "/" {
+			g.prefix = ""
+		}
+	}
+}
+
+// WithMiddleware wraps the proxy handler, the first one is the outermost
+func WithMiddleware(middlewares ...func(http.Handler) http.Handler) GatewayOption {
+	return func(g *Gateway) {
+		g.middlewares = append(g.middlewares, middlewares...)
+	}
+}
+
+// WithInjectContext injects values like logger and id generator into the context of each request
+func WithInjectContext(injectContext func(ctx context.Context) context.Context) GatewayOption {
+	return func(g *Gateway) {
+		g.injectContext = injectContext
+	}
+}
+
+// WithAuthorizer replaces the authorizer created by opt.AuthorizationMode
+func WithAuthorizer(a authorizer.Authorizer) GatewayOption {
+	return func(g *Gateway) {
+		g.Authorizer = a
+	}
+}
+
+// WithHooks sets the hooks, nil ones will be skipped
+func WithHooks(hooks GatewayHooks) GatewayOption {
+	return func(g *Gateway) {
+		g.hooks = hooks
+	}
+}
+
+// GatewayHooks called by the member which holds the tunnel of the agent
+type GatewayHooks struct {
+	OnAgentRegistered   func(ctx context.Context, meta TunnelMeta)
+	OnAgentDisconnected func(ctx context.Context, meta TunnelMeta)
+	// BeforeProxy called after the request authorized, the request will be rejected when error returned,
+	// *statuserr.StatusErr could be returned to respond with the status code.
+	BeforeProxy func(ctx context.Context, meta TunnelMeta, attrs *auth.RequestInfoAttrs) error
+	// AfterProxy called when the response of agent received or failed
+	AfterProxy func(ctx context.Context, meta TunnelMeta, attrs *auth.RequestInfoAttrs, resp *http.Response, err error)
+}
+
+func (g *Gateway) InjectContext(ctx context.Context) context.Context {
+	if g.injectContext == nil {
+		return ctx
+	}
+	return g.injectContext(ctx)
+}
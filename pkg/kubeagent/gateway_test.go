@@ -0,0 +1,334 @@
+package kubeagent
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/octohelm/kube-agent/pkg/jwtutil"
+	"github.com/octohelm/kube-agent/pkg/kubeagent/auth"
+	"github.com/octohelm/kube-agent/pkg/statuserr"
+	"github.com/octohelm/kube-agent/pkg/timeutil"
+	. "github.com/onsi/gomega"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+func freePort() int {
+	lis, _ := net.Listen("tcp", ":0")
+	defer lis.Close()
+	return lis.Addr().(*net.TCPAddr).Port
+}
+
+func TestGatewayServe(t *testing.T) {
+	port := freePort()
+
+	newGateway := func() *Gateway {
+		g, err := NewGateway(GatewayOpt{
+			IP:             net.ParseIP("127.0.0.1"),
+			Port:           port,
+			AllowAnonymous: true,
+			DrainTimeout:   timeutil.Duration(time.Second),
+		})
+		NewWithT(t).Expect(err).To(BeNil())
+		return g
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	served := make(chan error, 1)
+	go func() {
+		served <- newGateway().Serve(ctx)
+	}()
+
+	NewWithT(t).Eventually(func() int {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/_health", port))
+		if err != nil {
+			return 0
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}).Should(Equal(http.StatusNoContent))
+
+	t.Run("failed to listen on the same port", func(t *testing.T) {
+		err := newGateway().Serve(context.Background())
+		NewWithT(t).Expect(err).NotTo(BeNil())
+	})
+
+	cancel()
+
+	select {
+	case err := <-served:
+		NewWithT(t).Expect(err).To(BeNil())
+	case <-time.After(10 * time.Second):
+		t.Fatal("gateway not stopped")
+	}
+}
+
+func TestGatewayHandler(t *testing.T) {
+	registered := make(chan TunnelMeta, 1)
+	proxied := make(chan int, 10)
+
+	g, err := NewGateway(GatewayOpt{
+		IP:             net.ParseIP("127.0.0.1"),
+		AllowAnonymous: true,
+	},
+		WithPrefix("/kube-agent/"),
+		WithMiddleware(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("X-Middleware", "1")
+				next.ServeHTTP(rw, req)
+			})
+		}),
+		WithHooks(GatewayHooks{
+			OnAgentRegistered: func(ctx context.Context, meta TunnelMeta) {
+				registered <- meta
+			},
+			BeforeProxy: func(ctx context.Context, meta TunnelMeta, attrs *auth.RequestInfoAttrs) error {
+				if attrs.GetPath() == "/denied" {
+					return statuserr.New(http.StatusForbidden, fmt.Errorf("denied by hook"))
+				}
+				return nil
+			},
+			AfterProxy: func(ctx context.Context, meta TunnelMeta, attrs *auth.RequestInfoAttrs, resp *http.Response, err error) {
+				if resp != nil {
+					proxied <- resp.StatusCode
+				}
+			},
+		}),
+	)
+	NewWithT(t).Expect(err).To(BeNil())
+
+	mux := http.NewServeMux()
+	mux.Handle("/kube-agent/", g.Handler())
+
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := &Agent{
+		opt: AgentOpt{
+			Host:            "local",
+			GatewayAddress:  strings.TrimPrefix(s.URL, "http://") + "/kube-agent",
+			RetryInterval:   timeutil.Duration(100 * time.Millisecond),
+			ShutdownTimeout: timeutil.Duration(time.Second),
+		},
+		policy: &AgentPolicy{},
+		clusters: []*agentCluster{{
+			host: "local",
+			handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				_, _ = rw.Write([]byte(req.URL.Path))
+			}),
+		}},
+		receiver: make(chan *agentCluster),
+		close:    make(chan struct{}),
+	}
+	go func() {
+		_ = a.Serve(ctx)
+	}()
+
+	select {
+	case meta := <-registered:
+		NewWithT(t).Expect(meta.AgentHost).To(Equal("local"))
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent not registered")
+	}
+
+	resp, err := http.Get(s.URL + "/kube-agent/proxies/local/version")
+	NewWithT(t).Expect(err).To(BeNil())
+	data, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	NewWithT(t).Expect(resp.StatusCode).To(Equal(http.StatusOK), string(data))
+	NewWithT(t).Expect(resp.Header.Get("X-Middleware")).To(Equal("1"))
+	NewWithT(t).Expect(string(data)).To(Equal("/version"))
+	NewWithT(t).Expect(<-proxied).To(Equal(http.StatusOK))
+
+	resp, err = http.Get(s.URL + "/kube-agent/proxies/local/denied")
+	NewWithT(t).Expect(err).To(BeNil())
+	_ = resp.Body.Close()
+	NewWithT(t).Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+}
+
+func TestGatewayRevocations(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "gateway")
+	defer os.RemoveAll(tmp)
+
+	tokenFile := filepath.Join(tmp, "tokens.csv")
+	_ = ioutil.WriteFile(tokenFile, []byte(`admin-token,admin,1,"kube-agent-admins"`+"\n"+`user-token,someone,2,"dev"`+"\n"), 0600)
+
+	g, err := NewGateway(GatewayOpt{
+		IP:            net.ParseIP("127.0.0.1"),
+		TokenAuthFile: tokenFile,
+		AdminGroup:    "kube-agent-admins",
+	})
+	NewWithT(t).Expect(err).To(BeNil())
+
+	s := httptest.NewServer(g.Handler())
+	defer s.Close()
+
+	do := func(method string, token string, body string) int {
+		req, _ := http.NewRequest(method, s.URL+"/.sys/revocations", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		NewWithT(t).Expect(err).To(BeNil())
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	NewWithT(t).Expect(do(http.MethodGet, "user-token", "")).To(Equal(http.StatusForbidden))
+	NewWithT(t).Expect(do(http.MethodPost, "user-token", `{"subject":"admin"}`)).To(Equal(http.StatusForbidden))
+
+	NewWithT(t).Expect(do(http.MethodGet, "admin-token", "")).To(Equal(http.StatusOK))
+	NewWithT(t).Expect(do(http.MethodPost, "admin-token", `{"subject":"someone"}`)).To(Equal(http.StatusNoContent))
+
+	// revoked user of token file
+	NewWithT(t).Expect(do(http.MethodGet, "user-token", "")).To(Equal(http.StatusUnauthorized))
+}
+
+func TestGatewayKubeconfig(t *testing.T) {
+	g, err := NewGateway(GatewayOpt{
+		IP: net.ParseIP("127.0.0.1"),
+	})
+	NewWithT(t).Expect(err).To(BeNil())
+
+	// kubeconfig served only when token exchange enabled
+	g.tokenExchanger = &auth.TokenExchanger{}
+
+	s := httptest.NewServer(g.Handler())
+	defer s.Close()
+
+	t.Run("with subject token command", func(t *testing.T) {
+		resp, err := http.Get(s.URL + "/.sys/kubeconfig?agentHost=local&subjectTokenCommand=" + url.QueryEscape("gcloud auth print-identity-token"))
+		NewWithT(t).Expect(err).To(BeNil())
+		data, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		NewWithT(t).Expect(resp.StatusCode).To(Equal(http.StatusOK), string(data))
+
+		c, err := clientcmd.Load(data)
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(c.AuthInfos["local"].Exec.Args).To(ContainElement("--subject-token-command=gcloud auth print-identity-token"))
+	})
+
+	t.Run("without subject token", func(t *testing.T) {
+		resp, err := http.Get(s.URL + "/.sys/kubeconfig?agentHost=local")
+		NewWithT(t).Expect(err).To(BeNil())
+		_ = resp.Body.Close()
+		NewWithT(t).Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+	})
+}
+
+func TestGatewayTokenExchange(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "gateway")
+	defer os.RemoveAll(tmp)
+
+	writeKey := func(name string) *jwtutil.Signer {
+		privateKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+		key, _ := jwk.New(privateKey)
+		data, _ := json.Marshal(key)
+		_ = ioutil.WriteFile(filepath.Join(tmp, name), data, 0600)
+		k, _ := jwtutil.SigningKeyFromFile(filepath.Join(tmp, name))
+		s, _ := jwtutil.NewSigner(k)
+		return s
+	}
+
+	upstream := writeKey("upstream.json")
+	_ = writeKey("signing-key.json")
+
+	upstreamJWKS, _ := upstream.MarshalJWKS()
+	issuersConfig, _ := json.Marshal(jwtutil.IssuersConfig{
+		Issuers: []jwtutil.IssuerConfig{{Issuer: "https://oidc.example.com", JWKS: upstreamJWKS}},
+	})
+	_ = ioutil.WriteFile(filepath.Join(tmp, "issuers.json"), issuersConfig, 0600)
+	_ = ioutil.WriteFile(filepath.Join(tmp, "bindings.yaml"), []byte(`
+- users: ["someone"]
+  scopes:
+    local:
+      rules:
+      - apiGroups: [""]
+        resources: ["pods"]
+        verbs: ["list"]
+`), 0600)
+
+	g, err := NewGateway(GatewayOpt{
+		IP:                  net.ParseIP("127.0.0.1"),
+		JWTIssuersFile:      filepath.Join(tmp, "issuers.json"),
+		TokenSigningKeyFile: filepath.Join(tmp, "signing-key.json"),
+		TokenIssuer:         "kube-agent",
+		TokenAudience:       "kube-agent",
+		TokenTTL:            timeutil.Duration(time.Minute),
+		ScopeBindingsFile:   filepath.Join(tmp, "bindings.yaml"),
+	})
+	NewWithT(t).Expect(err).To(BeNil())
+
+	s := httptest.NewServer(g.Handler())
+	defer s.Close()
+
+	tok := jwt.New()
+	_ = tok.Set(jwt.IssuerKey, "https://oidc.example.com")
+	_ = tok.Set(jwt.SubjectKey, "someone")
+	_ = tok.Set(jwt.ExpirationKey, time.Now().Add(time.Hour))
+	idToken, _ := upstream.Sign(tok)
+
+	authenticate := func(token string) (user.Info, error) {
+		req, _ := http.NewRequest(http.MethodGet, s.URL, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return g.Authenticate(req)
+	}
+
+	t.Run("id token of upstream is not access token", func(t *testing.T) {
+		_, err := authenticate(idToken)
+		NewWithT(t).Expect(err).NotTo(BeNil())
+	})
+
+	t.Run("agent token of upstream", func(t *testing.T) {
+		agentTok := jwt.New()
+		_ = agentTok.Set(jwt.IssuerKey, "https://oidc.example.com")
+		_ = agentTok.Set(jwt.SubjectKey, auth.JWTSubjectAgent)
+		_ = agentTok.Set(jwt.AudienceKey, []string{"local"})
+		_ = agentTok.Set(jwt.ExpirationKey, time.Now().Add(time.Hour))
+		agentToken, _ := upstream.Sign(agentTok)
+
+		c, resp, err := websocket.DefaultDialer.Dial(strings.Replace(s.URL, "http", "ws", 1)+"/agents/local/register", http.Header{
+			"Authorization": {"Bearer " + agentToken},
+		})
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(resp.StatusCode).To(Equal(http.StatusSwitchingProtocols))
+		_ = c.Close()
+	})
+
+	t.Run("exchange", func(t *testing.T) {
+		resp, err := http.PostForm(s.URL+"/.sys/token", url.Values{
+			"grant_type":         {auth.GrantTypeTokenExchange},
+			"subject_token_type": {auth.TokenTypeIDToken},
+			"subject_token":      {idToken},
+		})
+		NewWithT(t).Expect(err).To(BeNil())
+		ret := &auth.TokenExchangeResponse{}
+		_ = json.NewDecoder(resp.Body).Decode(ret)
+		_ = resp.Body.Close()
+		NewWithT(t).Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		u, err := authenticate(ret.AccessToken)
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(u.GetName()).To(Equal("oidc:https://oidc.example.com#someone"))
+	})
+}
@@ -7,6 +7,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/octohelm/kube-agent/pkg/statuserr"
 	utilnet "k8s.io/apimachinery/pkg/util/net"
 	"k8s.io/apimachinery/pkg/util/proxy"
 	"k8s.io/client-go/rest"
@@ -35,7 +36,7 @@ func ProxyHandler(cfg *rest.Config) (http.Handler, error) {
 		return nil, err
 	}
 
-	p := proxy.NewUpgradeAwareHandler(target, t, true, false, &responder{})
+	p := proxy.NewUpgradeAwareHandler(target, &restrictedRoundTripper{rt: t}, true, false, &responder{})
 	p.UpgradeTransport = upgradeTransport
 	p.UseRequestLocation = true
 
@@ -45,6 +46,11 @@ func ProxyHandler(cfg *rest.Config) (http.Handler, error) {
 type responder struct{}
 
 func (r *responder) Error(w http.ResponseWriter, req *http.Request, err error) {
+	// keeps status of errors, like the object dropped by restricted filter
+	if se, ok := err.(*statuserr.StatusErr); ok {
+		statuserr.WriteToResp(w, se)
+		return
+	}
 	http.Error(w, err.Error(), http.StatusInternalServerError)
 }
 
@@ -74,21 +80,31 @@ func makeUpgradeTransport(config *rest.Config, keepalive time.Duration) (proxy.U
 }
 
 func ResolveKubeConfig() (*rest.Config, error) {
-	clientConfig, err := rest.InClusterConfig()
-	if err != nil {
-		clientConfig, err = localConfig()
-		if err != nil {
-			return nil, err
-		}
-	}
-	return clientConfig, nil
+	load, _ := kubeConfigLoader("", "", "")
+	return load()
 }
 
-func localConfig() (*rest.Config, error) {
+// kubeConfigLoader loads config of the context from kubeconfig, with apiserver url overridden when server provided,
+// in-cluster config is preferred when both kubeconfig and context empty.
+// kubeconfig files are returned for watching.
+func kubeConfigLoader(kubeconfig string, context string, server string) (func() (*rest.Config, error), []string) {
 	rules := clientcmd.NewDefaultClientConfigLoadingRules()
-	apiConfig, err := rules.Load()
-	if err != nil {
-		return nil, err
+	rules.ExplicitPath = kubeconfig
+
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: context}
+	overrides.ClusterInfo.Server = server
+
+	load := func() (*rest.Config, error) {
+		if kubeconfig == "" && context == "" {
+			if cfg, err := rest.InClusterConfig(); err == nil {
+				if server != "" {
+					cfg.Host = server
+				}
+				return cfg, nil
+			}
+		}
+		return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
 	}
-	return clientcmd.NewDefaultClientConfig(*apiConfig, &clientcmd.ConfigOverrides{}).ClientConfig()
+
+	return load, rules.GetLoadingPrecedence()
 }
@@ -0,0 +1,136 @@
+package kubeagent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-courier/logr"
+	"k8s.io/client-go/rest"
+)
+
+func newReloadingProxy(load func() (*rest.Config, error), files []string) (*reloadingProxy, error) {
+	p := &reloadingProxy{load: load, files: files}
+	if _, err := p.reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// reloadingProxy rebuilds the proxy handler when the kubeconfig files or the files referred by the config changed,
+// like rotated certificates and tokens mounted from secrets.
+type reloadingProxy struct {
+	load  func() (*rest.Config, error)
+	files []string
+
+	mu      sync.RWMutex
+	handler http.Handler
+	watched []string
+	digest  string
+}
+
+func (p *reloadingProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	p.mu.RLock()
+	h := p.handler
+	p.mu.RUnlock()
+
+	h.ServeHTTP(rw, req)
+}
+
+// reload rebuilds the handler when watched files changed, the current one will be kept when failed
+func (p *reloadingProxy) reload() (bool, error) {
+	p.mu.RLock()
+	watched, digest := p.watched, p.digest
+	p.mu.RUnlock()
+
+	// digest before load, changes during loading will be picked up by next reload
+	current := digestFiles(watched)
+	if p.handler != nil && current == digest {
+		return false, nil
+	}
+
+	cfg, err := p.load()
+	if err != nil {
+		return false, err
+	}
+
+	h, err := ProxyHandler(cfg)
+	if err != nil {
+		return false, err
+	}
+
+	nextWatched := append(append([]string{}, p.files...), configFiles(cfg)...)
+	if !equalStrings(watched, nextWatched) {
+		current = digestFiles(nextWatched)
+	}
+
+	p.mu.Lock()
+	p.handler = h
+	p.watched = nextWatched
+	p.digest = current
+	p.mu.Unlock()
+
+	return true, nil
+}
+
+// Watch checks changes of watched files in every interval until ctx done
+func (p *reloadingProxy) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := p.reload()
+			if err != nil {
+				logr.FromContext(ctx).Warn(err)
+				continue
+			}
+			if reloaded {
+				logr.FromContext(ctx).Info("proxy handler rebuilt, kubeconfig or certificates changed")
+			}
+		}
+	}
+}
+
+func configFiles(cfg *rest.Config) []string {
+	files := make([]string, 0, 4)
+	for _, f := range []string{cfg.TLSClientConfig.CAFile, cfg.TLSClientConfig.CertFile, cfg.TLSClientConfig.KeyFile, cfg.BearerTokenFile} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// digestFiles hashes contents of files, missing files are hashed as empty
+func digestFiles(files []string) string {
+	h := sha256.New()
+	for _, f := range files {
+		h.Write([]byte(f))
+		h.Write([]byte{0})
+		if data, err := ioutil.ReadFile(f); err == nil {
+			h.Write(data)
+		}
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,76 @@
+package kubeagent
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+func TestReloadingProxy(t *testing.T) {
+	newServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			_, _ = rw.Write([]byte(name))
+		}))
+	}
+
+	a, b := newServer("a"), newServer("b")
+	defer a.Close()
+	defer b.Close()
+
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+
+	writeKubeConfig := func(server string) {
+		c := clientcmdapi.NewConfig()
+		c.Clusters["local"] = &clientcmdapi.Cluster{Server: server}
+		c.AuthInfos["local"] = &clientcmdapi.AuthInfo{}
+		c.Contexts["local"] = &clientcmdapi.Context{Cluster: "local", AuthInfo: "local"}
+		c.Contexts["other"] = &clientcmdapi.Context{Cluster: "local", AuthInfo: "local"}
+		c.CurrentContext = "local"
+		NewWithT(t).Expect(clientcmd.WriteToFile(*c, kubeconfig)).To(Succeed())
+	}
+
+	serve := func(h http.Handler) string {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/version", nil))
+		data, _ := io.ReadAll(rw.Body)
+		return string(data)
+	}
+
+	writeKubeConfig(a.URL)
+
+	p, err := newReloadingProxy(kubeConfigLoader(kubeconfig, "", ""))
+	NewWithT(t).Expect(err).To(BeNil())
+	NewWithT(t).Expect(serve(p)).To(Equal("a"))
+
+	t.Run("not changed", func(t *testing.T) {
+		reloaded, err := p.reload()
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(reloaded).To(BeFalse())
+	})
+
+	t.Run("kubeconfig changed", func(t *testing.T) {
+		writeKubeConfig(b.URL)
+
+		reloaded, err := p.reload()
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(reloaded).To(BeTrue())
+		NewWithT(t).Expect(serve(p)).To(Equal("b"))
+	})
+
+	t.Run("server overridden with context", func(t *testing.T) {
+		p, err := newReloadingProxy(kubeConfigLoader(kubeconfig, "other", a.URL))
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(serve(p)).To(Equal("a"))
+	})
+
+	t.Run("unknown context", func(t *testing.T) {
+		_, err := newReloadingProxy(kubeConfigLoader(kubeconfig, "unknown", ""))
+		NewWithT(t).Expect(err).NotTo(BeNil())
+	})
+}
@@ -1,31 +1,57 @@
-package kubeagent
+package kubeagent_test
 
 import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
-	"os"
+	"net/http/httptest"
+	"strings"
 	"testing"
-	"time"
+
+	"github.com/octohelm/kube-agent/pkg/kubeagent"
+	"github.com/octohelm/kube-agent/pkg/kubeagent/kubeagenttest"
+	. "github.com/onsi/gomega"
 )
 
-func Test(t *testing.T) {
-	cfg, err := ResolveKubeConfig()
-	if err != nil {
-		panic(err)
-	}
+func TestProxyHandler(t *testing.T) {
+	apiServer := kubeagenttest.NewAPIServer()
+	defer apiServer.Close()
+
+	h, err := kubeagent.ProxyHandler(apiServer.RestConfig())
+	NewWithT(t).Expect(err).To(BeNil())
 
-	h, err := ProxyHandler(cfg)
-	if err != nil {
-		panic(err)
-	}
+	s := httptest.NewServer(h)
+	defer s.Close()
 
 	t.Run("simple http", func(t *testing.T) {
-		startedAt := time.Now()
-		req, _ := http.NewRequest(http.MethodGet, "http://localhost/api", nil)
-		h.ServeHTTP(newStdOutResponseWriter(), req)
-		t.Log("cost", time.Since(startedAt))
+		resp, err := http.Get(s.URL + "/api")
+		NewWithT(t).Expect(err).To(BeNil())
+		data, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		NewWithT(t).Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		NewWithT(t).Expect(string(data)).To(ContainSubstring(`"v1"`))
 	})
-}
 
-func newStdOutResponseWriter() http.ResponseWriter {
-	return NewResponseWriter(os.Stdout)
+	t.Run("upgrade", func(t *testing.T) {
+		conn, err := net.Dial("tcp", strings.TrimPrefix(s.URL, "http://"))
+		NewWithT(t).Expect(err).To(BeNil())
+		defer conn.Close()
+
+		_, _ = fmt.Fprintf(conn, "POST /api/v1/namespaces/default/pods/a/exec HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: SPDY/3.1\r\n\r\n", s.Listener.Addr())
+
+		r := bufio.NewReader(conn)
+
+		resp, err := http.ReadResponse(r, nil)
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(resp.StatusCode).To(Equal(http.StatusSwitchingProtocols))
+
+		_, _ = io.WriteString(conn, "ping\n")
+
+		line, err := r.ReadString('\n')
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(line).To(Equal("ping\n"))
+	})
 }
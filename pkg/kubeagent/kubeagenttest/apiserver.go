@@ -0,0 +1,362 @@
+package kubeagenttest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+)
+
+// APIServer is a fake kube apiserver, which serves discovery, and create, get, list, watch and logs of pods,
+// and echoes the upgraded connections of exec, attach and portforward.
+type APIServer struct {
+	*httptest.Server
+
+	mu              sync.RWMutex
+	resourceVersion int64
+	pods            map[string]corev1.Pod
+	watchers        map[chan watch.Event]bool
+}
+
+func NewAPIServer() *APIServer {
+	s := &APIServer{
+		pods:     map[string]corev1.Pod{},
+		watchers: map[chan watch.Event]bool{},
+	}
+	s.Server = httptest.NewServer(s.router())
+	return s
+}
+
+func (s *APIServer) RestConfig() *rest.Config {
+	return &rest.Config{Host: s.URL}
+}
+
+func (s *APIServer) Close() {
+	s.Server.CloseClientConnections()
+	s.Server.Close()
+}
+
+// AddPod adds or updates the pod, and notifies the watchers
+func (s *APIServer) AddPod(pod corev1.Pod) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.addPod(pod)
+}
+
+func (s *APIServer) addPod(pod corev1.Pod) corev1.Pod {
+	if pod.Namespace == "" {
+		pod.Namespace = metav1.NamespaceDefault
+	}
+
+	s.resourceVersion++
+	pod.ResourceVersion = strconv.FormatInt(s.resourceVersion, 10)
+	pod.TypeMeta = metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}
+
+	eventType := watch.Added
+	if _, ok := s.pods[key(pod.Namespace, pod.Name)]; ok {
+		eventType = watch.Modified
+	}
+
+	s.pods[key(pod.Namespace, pod.Name)] = pod
+	s.notify(watch.Event{Type: eventType, Object: &pod})
+
+	return pod
+}
+
+// DeletePod deletes the pod, and notifies the watchers
+func (s *APIServer) DeletePod(namespace string, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pod, ok := s.pods[key(namespace, name)]
+	if !ok {
+		return
+	}
+
+	delete(s.pods, key(namespace, name))
+	s.notify(watch.Event{Type: watch.Deleted, Object: &pod})
+}
+
+func (s *APIServer) notify(e watch.Event) {
+	for w := range s.watchers {
+		select {
+		case w <- e:
+		default:
+			// slow watcher, drop like apiserver closes it
+		}
+	}
+}
+
+func key(namespace string, name string) string {
+	return namespace + "/" + name
+}
+
+func (s *APIServer) router() http.Handler {
+	r := mux.NewRouter()
+
+	r.HandleFunc("/version", func(rw http.ResponseWriter, req *http.Request) {
+		writeJSON(rw, http.StatusOK, &version.Info{Major: "1", Minor: "22", GitVersion: "v1.22.1"})
+	})
+
+	r.HandleFunc("/api", func(rw http.ResponseWriter, req *http.Request) {
+		writeJSON(rw, http.StatusOK, &metav1.APIVersions{
+			TypeMeta: metav1.TypeMeta{Kind: "APIVersions"},
+			Versions: []string{"v1"},
+		})
+	})
+
+	r.HandleFunc("/apis", func(rw http.ResponseWriter, req *http.Request) {
+		writeJSON(rw, http.StatusOK, &metav1.APIGroupList{
+			TypeMeta: metav1.TypeMeta{Kind: "APIGroupList", APIVersion: "v1"},
+			Groups:   []metav1.APIGroup{},
+		})
+	})
+
+	r.HandleFunc("/api/v1", func(rw http.ResponseWriter, req *http.Request) {
+		writeJSON(rw, http.StatusOK, &metav1.APIResourceList{
+			TypeMeta:     metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"},
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{
+				{Name: "pods", Namespaced: true, Kind: "Pod", Verbs: metav1.Verbs{"get", "list", "watch"}},
+				{Name: "pods/attach", Namespaced: true, Kind: "PodAttachOptions", Verbs: metav1.Verbs{"create", "get"}},
+				{Name: "pods/exec", Namespaced: true, Kind: "PodExecOptions", Verbs: metav1.Verbs{"create", "get"}},
+				{Name: "pods/log", Namespaced: true, Kind: "Pod", Verbs: metav1.Verbs{"get"}},
+				{Name: "pods/portforward", Namespaced: true, Kind: "PodPortForwardOptions", Verbs: metav1.Verbs{"create", "get"}},
+			},
+		})
+	})
+
+	r.HandleFunc("/api/v1/pods", s.listOrWatchPods).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/namespaces/{namespace}/pods", s.listOrWatchPods).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/namespaces/{namespace}/pods", s.createPod).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/namespaces/{namespace}/pods/{name}", s.getPod).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/namespaces/{namespace}/pods/{name}/log", s.podLogs).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/namespaces/{namespace}/pods/{name}/{subresource:exec|attach|portforward}", s.upgrade)
+
+	r.NotFoundHandler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		writeStatus(rw, http.StatusNotFound, fmt.Sprintf("the server could not find the requested resource %s", req.URL.Path))
+	})
+
+	return r
+}
+
+func (s *APIServer) listOrWatchPods(rw http.ResponseWriter, req *http.Request) {
+	namespace := mux.Vars(req)["namespace"]
+
+	selector, err := labels.Parse(req.URL.Query().Get("labelSelector"))
+	if err != nil {
+		writeStatus(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	matches := func(pod *corev1.Pod) bool {
+		return (namespace == "" || pod.Namespace == namespace) && selector.Matches(labels.Set(pod.Labels))
+	}
+
+	if w, _ := strconv.ParseBool(req.URL.Query().Get("watch")); w {
+		s.watchPods(rw, req, matches)
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := &corev1.PodList{
+		TypeMeta: metav1.TypeMeta{Kind: "PodList", APIVersion: "v1"},
+		ListMeta: metav1.ListMeta{ResourceVersion: strconv.FormatInt(s.resourceVersion, 10)},
+		Items:    []corev1.Pod{},
+	}
+
+	for _, pod := range s.pods {
+		if matches(&pod) {
+			list.Items = append(list.Items, pod)
+		}
+	}
+
+	sort.Slice(list.Items, func(i, j int) bool {
+		return key(list.Items[i].Namespace, list.Items[i].Name) < key(list.Items[j].Namespace, list.Items[j].Name)
+	})
+
+	writeJSON(rw, http.StatusOK, list)
+}
+
+func (s *APIServer) watchPods(rw http.ResponseWriter, req *http.Request, matches func(pod *corev1.Pod) bool) {
+	s.mu.Lock()
+	events := make(chan watch.Event, len(s.pods)+100)
+	resourceVersion, _ := strconv.ParseInt(req.URL.Query().Get("resourceVersion"), 10, 64)
+	for _, pod := range s.pods {
+		pod := pod
+		if rv, _ := strconv.ParseInt(pod.ResourceVersion, 10, 64); rv > resourceVersion {
+			events <- watch.Event{Type: watch.Added, Object: &pod}
+		}
+	}
+	s.watchers[events] = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.watchers, events)
+		s.mu.Unlock()
+	}()
+
+	timeout := time.Duration(0)
+	if seconds, _ := strconv.ParseInt(req.URL.Query().Get("timeoutSeconds"), 10, 64); seconds > 0 {
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		timeoutCh = t.C
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Transfer-Encoding", "chunked")
+	rw.WriteHeader(http.StatusOK)
+
+	flusher, _ := rw.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	encoder := json.NewEncoder(rw)
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-timeoutCh:
+			return
+		case e := <-events:
+			if !matches(e.Object.(*corev1.Pod)) {
+				continue
+			}
+			raw, err := json.Marshal(e.Object)
+			if err != nil {
+				return
+			}
+			if err := encoder.Encode(&metav1.WatchEvent{Type: string(e.Type), Object: runtime.RawExtension{Raw: raw}}); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// createPod creates the pod, which is not persisted when dryRun=All
+func (s *APIServer) createPod(rw http.ResponseWriter, req *http.Request) {
+	pod := corev1.Pod{}
+	if err := json.NewDecoder(req.Body).Decode(&pod); err != nil {
+		writeStatus(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	pod.Namespace = mux.Vars(req)["namespace"]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.pods[key(pod.Namespace, pod.Name)]; ok {
+		writeStatus(rw, http.StatusConflict, fmt.Sprintf("pods %q already exists", pod.Name))
+		return
+	}
+
+	if req.URL.Query().Get("dryRun") == "All" {
+		pod.TypeMeta = metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}
+		writeJSON(rw, http.StatusCreated, &pod)
+		return
+	}
+
+	pod = s.addPod(pod)
+	writeJSON(rw, http.StatusCreated, &pod)
+}
+
+func (s *APIServer) getPod(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	s.mu.RLock()
+	pod, ok := s.pods[key(vars["namespace"], vars["name"])]
+	s.mu.RUnlock()
+
+	if !ok {
+		writeStatus(rw, http.StatusNotFound, fmt.Sprintf("pods %q not found", vars["name"]))
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, &pod)
+}
+
+// podLogs responds one plain text line of the pod
+func (s *APIServer) podLogs(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	s.mu.RLock()
+	_, ok := s.pods[key(vars["namespace"], vars["name"])]
+	s.mu.RUnlock()
+
+	if !ok {
+		writeStatus(rw, http.StatusNotFound, fmt.Sprintf("pods %q not found", vars["name"]))
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/plain")
+	rw.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprintf(rw, "log of %s/%s\n", vars["namespace"], vars["name"])
+}
+
+// upgrade echoes all bytes of the upgraded connection
+func (s *APIServer) upgrade(rw http.ResponseWriter, req *http.Request) {
+	if !httpstream.IsUpgradeRequest(req) {
+		writeStatus(rw, http.StatusBadRequest, "upgrade request required")
+		return
+	}
+
+	hj, ok := rw.(http.Hijacker)
+	if !ok {
+		writeStatus(rw, http.StatusInternalServerError, "hijack not supported")
+		return
+	}
+
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	_, _ = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", req.Header.Get("Upgrade"))
+
+	_, _ = io.Copy(conn, buf.Reader)
+}
+
+func writeJSON(rw http.ResponseWriter, statusCode int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(statusCode)
+	_ = json.NewEncoder(rw).Encode(v)
+}
+
+func writeStatus(rw http.ResponseWriter, statusCode int, message string) {
+	writeJSON(rw, statusCode, &metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Message:  message,
+		Code:     int32(statusCode),
+	})
+}
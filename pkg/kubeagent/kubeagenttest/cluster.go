@@ -0,0 +1,262 @@
+package kubeagenttest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/octohelm/kube-agent/pkg/kubeagent"
+	"github.com/octohelm/kube-agent/pkg/timeutil"
+)
+
+type Options struct {
+	// Gateways number of gateway members, 1 by default
+	Gateways int
+	// AgentHosts ["local"] by default
+	AgentHosts []string
+	// AgentsPerHost number of agents of each agent host, 1 by default
+	AgentsPerHost int
+
+	// GatewayOpt customizes opt of each gateway, ports and member seeds are set already
+	GatewayOpt func(i int, opt *kubeagent.GatewayOpt)
+	// AgentOpt customizes opt of each agent, host and gateway address are set already
+	AgentOpt       func(i int, opt *kubeagent.AgentOpt)
+	GatewayOptions []kubeagent.GatewayOption
+
+	// WaitTimeout for members joined and tunnels registered, 10s by default
+	WaitTimeout time.Duration
+}
+
+// Cluster of gateways and agents, all agents proxy to the same fake apiserver
+type Cluster struct {
+	APIServer    *APIServer
+	Gateways     []*kubeagent.Gateway
+	GatewayAddrs []string
+	Agents       []*kubeagent.Agent
+
+	waitTimeout  time.Duration
+	stopAgents   func()
+	stopGateways func()
+	closeOnce    sync.Once
+}
+
+// Start starts the cluster, and waits until members joined and tunnels of all agents registered,
+// the cluster will be closed when test finished.
+func Start(t testing.TB, o Options) *Cluster {
+	t.Helper()
+
+	if o.Gateways <= 0 {
+		o.Gateways = 1
+	}
+	if len(o.AgentHosts) == 0 {
+		o.AgentHosts = []string{"local"}
+	}
+	if o.AgentsPerHost <= 0 {
+		o.AgentsPerHost = 1
+	}
+	if o.WaitTimeout <= 0 {
+		o.WaitTimeout = 10 * time.Second
+	}
+
+	c := &Cluster{
+		APIServer:   NewAPIServer(),
+		waitTimeout: o.WaitTimeout,
+	}
+	t.Cleanup(c.Close)
+
+	memberPorts := make([]int, o.Gateways)
+	for i := range memberPorts {
+		memberPorts[i] = freePort(t)
+	}
+
+	stops := make([]func(), 0, o.Gateways)
+
+	// stop one by one, members leave faster when others alive
+	c.stopGateways = func() {
+		for i := len(stops) - 1; i >= 0; i-- {
+			stops[i]()
+		}
+	}
+
+	for i := 0; i < o.Gateways; i++ {
+		opt := kubeagent.GatewayOpt{
+			IP:             net.ParseIP("127.0.0.1"),
+			Port:           freePort(t),
+			MemberPort:     memberPorts[i],
+			ServiceName:    fmt.Sprintf("127.0.0.1:%d", memberPorts[0]),
+			AllowAnonymous: true,
+			DrainTimeout:   timeutil.Duration(time.Second),
+		}
+
+		if o.GatewayOpt != nil {
+			o.GatewayOpt(i, &opt)
+		}
+
+		g, err := kubeagent.NewGateway(opt, o.GatewayOptions...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.Gateways = append(c.Gateways, g)
+		c.GatewayAddrs = append(c.GatewayAddrs, g.Addr())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+
+		stops = append(stops, func() {
+			cancel()
+			<-done
+		})
+
+		go func() {
+			defer close(done)
+			_ = g.Serve(ctx)
+		}()
+	}
+
+	if err := c.waitMembersJoined(o.WaitTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	agentCtx, cancelAgents := context.WithCancel(context.Background())
+	agentsDone := &sync.WaitGroup{}
+
+	c.stopAgents = func() {
+		cancelAgents()
+		agentsDone.Wait()
+	}
+
+	for _, agentHost := range o.AgentHosts {
+		for j := 0; j < o.AgentsPerHost; j++ {
+			i := len(c.Agents)
+
+			opt := kubeagent.AgentOpt{
+				Host: agentHost,
+				// spread agents to gateways
+				GatewayAddress:  c.GatewayAddrs[i%len(c.GatewayAddrs)],
+				RetryInterval:   timeutil.Duration(100 * time.Millisecond),
+				ShutdownTimeout: timeutil.Duration(time.Second),
+			}
+
+			if o.AgentOpt != nil {
+				o.AgentOpt(i, &opt)
+			}
+
+			a, err := kubeagent.NewAgent(opt, kubeagent.WithRestConfig(c.APIServer.RestConfig()))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c.Agents = append(c.Agents, a)
+
+			agentsDone.Add(1)
+			go func() {
+				defer agentsDone.Done()
+				_ = a.Serve(agentCtx)
+			}()
+		}
+	}
+
+	if err := c.WaitTunnels(o.AgentHosts, o.AgentsPerHost); err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+// GatewayURL returns the base url of the i-th gateway
+func (c *Cluster) GatewayURL(i int) string {
+	return "http://" + c.GatewayAddrs[i]
+}
+
+// RandGatewayURL returns the base url of any gateway
+func (c *Cluster) RandGatewayURL() string {
+	return c.GatewayURL(rand.Intn(len(c.GatewayAddrs)))
+}
+
+// Close stops agents first, then gateways and the fake apiserver
+func (c *Cluster) Close() {
+	c.closeOnce.Do(func() {
+		if c.stopAgents != nil {
+			c.stopAgents()
+		}
+		if c.stopGateways != nil {
+			c.stopGateways()
+		}
+		c.APIServer.Close()
+	})
+}
+
+func (c *Cluster) waitMembersJoined(timeout time.Duration) error {
+	return poll(timeout, func() error {
+		for i := range c.GatewayAddrs {
+			status := kubeagent.GatewayStatus{}
+			if err := getJSON(c.GatewayURL(i)+"/.sys/status", &status); err != nil {
+				return err
+			}
+			if len(status.Members) != len(c.GatewayAddrs) {
+				return fmt.Errorf("gateway %s joined %d members, but expect %d", c.GatewayAddrs[i], len(status.Members), len(c.GatewayAddrs))
+			}
+		}
+		return nil
+	})
+}
+
+// WaitTunnels waits until tunnels of each agent host registered, for agents started out of the cluster
+func (c *Cluster) WaitTunnels(agentHosts []string, agentsPerHost int) error {
+	return poll(c.waitTimeout, func() error {
+		tunnels := map[string][]string{}
+		if err := getJSON(c.GatewayURL(0)+"/.sys/agents", &tunnels); err != nil {
+			return err
+		}
+		for _, agentHost := range agentHosts {
+			if len(tunnels[agentHost]) != agentsPerHost {
+				return fmt.Errorf("%d tunnels of %s registered, but expect %d", len(tunnels[agentHost]), agentHost, agentsPerHost)
+			}
+		}
+		return nil
+	})
+}
+
+func poll(timeout time.Duration, check func() error) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		err := check()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func getJSON(url string, v interface{}) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func freePort(t testing.TB) int {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	return lis.Addr().(*net.TCPAddr).Port
+}
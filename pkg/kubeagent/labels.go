@@ -0,0 +1,32 @@
+package kubeagent
+
+import (
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	HTTP_HEADER_KUBE_AGENT_LABELS = "X-Kube-Agent-Labels"
+)
+
+// AgentLabels in format of env=staging,region=eu
+type AgentLabels labels.Set
+
+func (l AgentLabels) String() string {
+	return labels.Set(l).String()
+}
+
+func (l *AgentLabels) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		return nil
+	}
+	m, err := labels.ConvertSelectorToLabelsMap(string(text))
+	if err != nil {
+		return err
+	}
+	*l = AgentLabels(m)
+	return nil
+}
+
+func (l AgentLabels) MarshalText() (text []byte, err error) {
+	return []byte(l.String()), nil
+}
@@ -0,0 +1,41 @@
+package kubeagent
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	requestClaimsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kube_agent",
+		Subsystem: "gateway",
+		Name:      "request_claims_rejected_total",
+		Help:      "Total number of rejected pulls of requests, reason could be claimed or invalid_proof",
+	}, []string{"agent_host", "reason"})
+
+	agentRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kube_agent",
+		Subsystem: "agent",
+		Name:      "requests_total",
+		Help:      "Total number of requests served by agent, by agent host and status code",
+	}, []string{"agent_host", "code"})
+
+	agentTunnels = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "kube_agent",
+		Subsystem: "agent",
+		Name:      "tunnels",
+		Help:      "Number of tunnels registered by agent, by agent host",
+	}, []string{"agent_host"})
+)
+
+func init() {
+	prometheus.MustRegister(requestClaimsRejected, agentRequests, agentTunnels)
+}
+
+func metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/.sys/metrics", promhttp.Handler())
+	return mux
+}
@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"io"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -15,6 +17,8 @@ func NewRequestTransit(req *http.Request) *RequestTransit {
 type RequestTransit struct {
 	*http.Request
 	ResponseOnce chan *http.Response
+
+	claimed int32
 }
 
 func (r *RequestTransit) Dispatch(c *websocket.Conn) error {
@@ -44,17 +48,24 @@ func (r *RequestTransit) Wait(c *websocket.Conn) error {
 		return err
 	}
 
-	resp, err := http.ReadResponse(bufio.NewReader(respReader), r.Request)
+	br := bufio.NewReader(&messageStreamReader{conn: c, r: respReader})
+
+	resp, err := http.ReadResponse(br, r.Request)
 	if err != nil {
 		return err
 	}
 
-	resp.Body = &ReaderCloser{
-		Reader: resp.Body,
-		Closes: []CloseFn{
-			resp.Body.Close,
-			c.Close,
-		},
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// like net/http, body of 101 is writable for the upgraded stream
+		resp.Body = &messageStream{conn: c, r: br}
+	} else {
+		resp.Body = &ReaderCloser{
+			Reader: resp.Body,
+			Closes: []CloseFn{
+				resp.Body.Close,
+				c.Close,
+			},
+		}
 	}
 
 	//defer func() {
@@ -83,3 +94,96 @@ func (c *ReaderCloser) Close() error {
 	}
 	return nil
 }
+
+// messageStreamReader reads the messages as one stream, until the connection closed normally,
+// the response of the agent could be flushed by message, like watch events.
+type messageStreamReader struct {
+	conn *websocket.Conn
+	r    io.Reader
+}
+
+func (m *messageStreamReader) Read(p []byte) (int, error) {
+	for {
+		if m.r == nil {
+			_, r, err := m.conn.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			m.r = r
+		}
+
+		n, err := m.r.Read(p)
+		if err == io.EOF {
+			m.r = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// messageStream is the upgraded stream, each write sends a message
+type messageStream struct {
+	conn      *websocket.Conn
+	r         io.Reader
+	closeOnce sync.Once
+}
+
+func (m *messageStream) Read(p []byte) (int, error) {
+	return m.r.Read(p)
+}
+
+func (m *messageStream) Write(p []byte) (int, error) {
+	_ = m.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := m.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (m *messageStream) Close() (err error) {
+	m.closeOnce.Do(func() {
+		_ = m.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeWait))
+		err = m.conn.Close()
+	})
+	return
+}
+
+// messageStreamWriter writes the stream as messages, each flush sends a message
+type messageStreamWriter struct {
+	conn *websocket.Conn
+	w    io.WriteCloser
+}
+
+func (m *messageStreamWriter) Write(p []byte) (int, error) {
+	if m.w == nil {
+		w, err := m.conn.NextWriter(websocket.BinaryMessage)
+		if err != nil {
+			return 0, err
+		}
+		m.w = w
+	}
+	return m.w.Write(p)
+}
+
+func (m *messageStreamWriter) Flush() error {
+	if m.w == nil {
+		return nil
+	}
+	err := m.w.Close()
+	m.w = nil
+	return err
+}
+
+// Close flushes and closes the stream normally
+func (m *messageStreamWriter) Close() error {
+	if err := m.Flush(); err != nil {
+		return err
+	}
+	return m.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeWait))
+}
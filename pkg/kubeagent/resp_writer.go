@@ -26,6 +26,9 @@ func (f *respWriter) Header() http.Header {
 }
 
 func (f *respWriter) WriteHeader(statusCode int) {
+	if f.statusCode != 0 {
+		return
+	}
 	f.statusCode = statusCode
 
 	text := http.StatusText(statusCode)
@@ -39,5 +42,16 @@ func (f *respWriter) WriteHeader(statusCode int) {
 }
 
 func (f *respWriter) Write(bytes []byte) (int, error) {
+	// like net/http, status line and headers should be written before body
+	if f.statusCode == 0 {
+		f.WriteHeader(http.StatusOK)
+	}
 	return f.w.Write(bytes)
 }
+
+// Flush sends the written, when the underlying writer supports
+func (f *respWriter) Flush() {
+	if fl, ok := f.w.(interface{ Flush() error }); ok {
+		_ = fl.Flush()
+	}
+}
@@ -0,0 +1,329 @@
+package kubeagent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/octohelm/kube-agent/pkg/kubeagent/auth"
+	"github.com/octohelm/kube-agent/pkg/statuserr"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+func NewRestrictedFilter(r *auth.Restriction, attrs authorizer.Attributes) *RestrictedFilter {
+	return &RestrictedFilter{
+		Restriction: r,
+		listOrWatch: auth.IsListOrWatch(attrs),
+		watch:       attrs.GetVerb() == "watch",
+		// namespace objects have no namespace, match by name instead
+		matchName: attrs.GetResource() == "namespaces",
+	}
+}
+
+// RestrictedFilter filters object, items of list or events of watch down to the restriction
+type RestrictedFilter struct {
+	*auth.Restriction
+	listOrWatch bool
+	watch       bool
+	matchName   bool
+}
+
+type contextKeyRestrictedFilter struct{}
+
+func WithRestrictedFilter(ctx context.Context, f *RestrictedFilter) context.Context {
+	return context.WithValue(ctx, contextKeyRestrictedFilter{}, f)
+}
+
+func RestrictedFilterFromContext(ctx context.Context) (*RestrictedFilter, bool) {
+	f, ok := ctx.Value(contextKeyRestrictedFilter{}).(*RestrictedFilter)
+	return f, ok
+}
+
+// restrictedRoundTripper filters responses by the restricted filter in context of the request
+type restrictedRoundTripper struct {
+	rt http.RoundTripper
+}
+
+func (t *restrictedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if f, ok := RestrictedFilterFromContext(req.Context()); ok {
+		if err := f.WrapResponse(resp); err != nil {
+			// responds the error as is, which status would be lost when wrapped by the proxy transport
+			return statusErrResponse(req, statuserr.New(http.StatusInternalServerError, err))
+		}
+	}
+
+	return resp, nil
+}
+
+func statusErrResponse(req *http.Request, se *statuserr.StatusErr) (*http.Response, error) {
+	data, err := json.Marshal(se)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		StatusCode:    se.Code,
+		Status:        fmt.Sprintf("%d %s", se.Code, http.StatusText(se.Code)),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json; charset=utf-8"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+		Request:       req,
+	}, nil
+}
+
+func (f *RestrictedFilter) WrapRequest(req *http.Request) {
+	if f.DryRun {
+		auth.EnforceDryRun(req)
+	}
+
+	if !f.FiltersObjects() {
+		return
+	}
+
+	// only json could be filtered
+	accepts := make([]string, 0)
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		accept = strings.TrimSpace(accept)
+		if accept == "" || strings.Contains(accept, "protobuf") || strings.Contains(accept, "yaml") {
+			continue
+		}
+		accepts = append(accepts, accept)
+	}
+	if len(accepts) == 0 {
+		accepts = append(accepts, "application/json")
+	}
+	req.Header.Set("Accept", strings.Join(accepts, ","))
+
+	// make sure response not compressed
+	req.Header.Del("Accept-Encoding")
+
+	if f.listOrWatch && f.LabelSelector != nil && !f.LabelSelector.Empty() {
+		query := req.URL.Query()
+
+		labelSelector := f.LabelSelector.String()
+		requested := query.Get("labelSelector")
+
+		// wrapped by gateway already
+		if requested != labelSelector && !strings.HasSuffix(requested, ","+labelSelector) {
+			if requested != "" {
+				labelSelector = requested + "," + labelSelector
+			}
+			query.Set("labelSelector", labelSelector)
+
+			req.URL.RawQuery = query.Encode()
+		}
+	}
+}
+
+func (f *RestrictedFilter) WrapResponse(resp *http.Response) error {
+	if !f.FiltersObjects() {
+		return nil
+	}
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		// non-object responses like logs pass through, but objects in other encodings could not be filtered
+		if !f.listOrWatch && !isObjectEncoding(mediaType) {
+			return nil
+		}
+		_ = resp.Body.Close()
+		return fmt.Errorf("restricted response could not be filtered, unsupported content type %s", mediaType)
+	}
+
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+
+	if f.watch {
+		resp.Body = f.filterWatchEvents(resp.Body)
+		return nil
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	obj := map[string]interface{}{}
+	if err := decodeJSON(resp.Body, &obj); err != nil {
+		return err
+	}
+
+	filtered, ok := f.FilterObject(obj)
+	if !ok {
+		return statuserr.New(http.StatusForbidden, fmt.Errorf("no access to the object"))
+	}
+
+	data, err := json.Marshal(filtered)
+	if err != nil {
+		return err
+	}
+
+	resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	resp.ContentLength = int64(len(data))
+	resp.Body = ioutil.NopCloser(bytes.NewBuffer(data))
+
+	return nil
+}
+
+func isObjectEncoding(mediaType string) bool {
+	return strings.Contains(mediaType, "json") || strings.Contains(mediaType, "yaml") || strings.Contains(mediaType, "protobuf")
+}
+
+func (f *RestrictedFilter) filterWatchEvents(body io.ReadCloser) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		d := json.NewDecoder(body)
+		d.UseNumber()
+		e := json.NewEncoder(pw)
+
+		for {
+			event := struct {
+				Type   string                 `json:"type"`
+				Object map[string]interface{} `json:"object"`
+			}{}
+
+			if err := d.Decode(&event); err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				_ = pw.CloseWithError(err)
+				return
+			}
+
+			obj, ok := f.FilterObject(event.Object)
+			if !ok {
+				continue
+			}
+			event.Object = obj
+
+			if err := e.Encode(event); err != nil {
+				_ = pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+
+	return &ReaderCloser{
+		Reader: pr,
+		Closes: []CloseFn{
+			pr.Close,
+			body.Close,
+		},
+	}
+}
+
+// FilterObject filters items of List or rows of Table, and returns false when the object should be dropped
+func (f *RestrictedFilter) FilterObject(obj map[string]interface{}) (map[string]interface{}, bool) {
+	if items, ok := obj["items"].([]interface{}); ok {
+		obj["items"] = f.filterList(items, func(item map[string]interface{}) map[string]interface{} {
+			return item
+		})
+		return obj, true
+	}
+
+	if kind, _ := obj["kind"].(string); kind == "Table" {
+		rows, _ := obj["rows"].([]interface{})
+		if len(rows) == 0 {
+			return obj, true
+		}
+		filtered := f.filterList(rows, func(row map[string]interface{}) map[string]interface{} {
+			o, _ := row["object"].(map[string]interface{})
+			return o
+		})
+		obj["rows"] = filtered
+		// empty table for list like empty items, only the table of single object or watch event dropped
+		if f.listOrWatch && !f.watch {
+			return obj, true
+		}
+		return obj, len(filtered) > 0
+	}
+
+	return obj, f.allows(obj)
+}
+
+func (f *RestrictedFilter) filterList(list []interface{}, objectOf func(item map[string]interface{}) map[string]interface{}) []interface{} {
+	filtered := make([]interface{}, 0, len(list))
+
+	for i := range list {
+		item, ok := list[i].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if obj := objectOf(item); obj != nil && f.allows(obj) {
+			filtered = append(filtered, item)
+		}
+	}
+
+	return filtered
+}
+
+func (f *RestrictedFilter) allows(obj map[string]interface{}) bool {
+	metadata, _ := obj["metadata"].(map[string]interface{})
+
+	return f.labelsMatches(metadata) && f.namespaceMatches(metadata)
+}
+
+func (f *RestrictedFilter) labelsMatches(metadata map[string]interface{}) bool {
+	if f.LabelSelector == nil || f.LabelSelector.Empty() {
+		return true
+	}
+
+	// bookmarks or status
+	if name, _ := metadata["name"].(string); name == "" {
+		return true
+	}
+
+	objectLabels := labels.Set{}
+
+	if values, ok := metadata["labels"].(map[string]interface{}); ok {
+		for k := range values {
+			objectLabels[k], _ = values[k].(string)
+		}
+	}
+
+	return f.LabelSelector.Matches(objectLabels)
+}
+
+func (f *RestrictedFilter) namespaceMatches(metadata map[string]interface{}) bool {
+	if len(f.Namespaces) == 0 {
+		return true
+	}
+
+	namespace, _ := metadata["namespace"].(string)
+	if f.matchName {
+		namespace, _ = metadata["name"].(string)
+	}
+
+	// cluster scoped objects, bookmarks or status
+	if namespace == "" {
+		return true
+	}
+
+	return auth.NamespaceMatches(f.Namespaces, namespace)
+}
+
+func decodeJSON(r io.Reader, v interface{}) error {
+	d := json.NewDecoder(r)
+	d.UseNumber()
+	return d.Decode(v)
+}
@@ -0,0 +1,246 @@
+package kubeagent
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/octohelm/kube-agent/pkg/kubeagent/auth"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func restrictedFilterFor(method string, rawURL string, namespaces ...string) *RestrictedFilter {
+	u, _ := url.Parse(rawURL)
+	attrs, _ := auth.RequestAttributesFromRequest(&http.Request{Method: method, URL: u})
+	return NewRestrictedFilter(&auth.Restriction{Namespaces: namespaces}, attrs)
+}
+
+func jsonResponse(body string) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+	}
+}
+
+func namesOf(items []interface{}) (names []string) {
+	for _, item := range items {
+		o := item.(map[string]interface{})
+		if obj, ok := o["object"].(map[string]interface{}); ok {
+			o = obj
+		}
+		names = append(names, o["metadata"].(map[string]interface{})["name"].(string))
+	}
+	return
+}
+
+func TestRestrictedFilter(t *testing.T) {
+	t.Run("dry run", func(t *testing.T) {
+		u, _ := url.Parse("/apis/apps/v1/namespaces/default/deployments")
+		req := &http.Request{Method: http.MethodPost, URL: u, Header: http.Header{"Accept": {"application/vnd.kubernetes.protobuf"}}}
+
+		attrs, _ := auth.RequestAttributesFromRequest(req)
+		f := NewRestrictedFilter(&auth.Restriction{DryRun: true}, attrs)
+		f.WrapRequest(req)
+
+		NewWithT(t).Expect(req.URL.Query().Get("dryRun")).To(Equal("All"))
+		// response not filtered
+		NewWithT(t).Expect(req.Header.Get("Accept")).To(Equal("application/vnd.kubernetes.protobuf"))
+	})
+
+	t.Run("list", func(t *testing.T) {
+		f := restrictedFilterFor(http.MethodGet, "/api/v1/pods", "team-a", "team-b")
+
+		resp := jsonResponse(`{"kind":"PodList","items":[
+{"metadata":{"name":"a","namespace":"team-a"}},
+{"metadata":{"name":"b","namespace":"team-b"}},
+{"metadata":{"name":"c","namespace":"team-c"}}
+]}`)
+		NewWithT(t).Expect(f.WrapResponse(resp)).To(Succeed())
+
+		list := map[string]interface{}{}
+		NewWithT(t).Expect(json.NewDecoder(resp.Body).Decode(&list)).To(Succeed())
+		NewWithT(t).Expect(namesOf(list["items"].([]interface{}))).To(Equal([]string{"a", "b"}))
+	})
+
+	t.Run("table", func(t *testing.T) {
+		f := restrictedFilterFor(http.MethodGet, "/api/v1/pods", "team-a")
+
+		resp := jsonResponse(`{"kind":"Table","rows":[
+{"cells":["a"],"object":{"metadata":{"name":"a","namespace":"team-a"}}},
+{"cells":["c"],"object":{"metadata":{"name":"c","namespace":"team-c"}}}
+]}`)
+		NewWithT(t).Expect(f.WrapResponse(resp)).To(Succeed())
+
+		table := map[string]interface{}{}
+		NewWithT(t).Expect(json.NewDecoder(resp.Body).Decode(&table)).To(Succeed())
+		NewWithT(t).Expect(namesOf(table["rows"].([]interface{}))).To(Equal([]string{"a"}))
+
+		t.Run("all rows out of scope", func(t *testing.T) {
+			resp := jsonResponse(`{"kind":"Table","rows":[
+{"cells":["c"],"object":{"metadata":{"name":"c","namespace":"team-c"}}}
+]}`)
+			NewWithT(t).Expect(f.WrapResponse(resp)).To(Succeed())
+
+			table := map[string]interface{}{}
+			NewWithT(t).Expect(json.NewDecoder(resp.Body).Decode(&table)).To(Succeed())
+			NewWithT(t).Expect(table["rows"]).To(BeEmpty())
+		})
+
+		t.Run("watch event out of scope", func(t *testing.T) {
+			w := restrictedFilterFor(http.MethodGet, "/api/v1/pods?watch=true", "team-a")
+
+			_, ok := w.FilterObject(map[string]interface{}{"kind": "Table", "rows": []interface{}{
+				map[string]interface{}{"object": map[string]interface{}{"metadata": map[string]interface{}{"name": "c", "namespace": "team-c"}}},
+			}})
+			NewWithT(t).Expect(ok).To(BeFalse())
+		})
+	})
+
+	t.Run("namespaces", func(t *testing.T) {
+		f := restrictedFilterFor(http.MethodGet, "/api/v1/namespaces", "team-a")
+
+		resp := jsonResponse(`{"kind":"NamespaceList","items":[
+{"metadata":{"name":"team-a"}},
+{"metadata":{"name":"team-c"}}
+]}`)
+		NewWithT(t).Expect(f.WrapResponse(resp)).To(Succeed())
+
+		list := map[string]interface{}{}
+		NewWithT(t).Expect(json.NewDecoder(resp.Body).Decode(&list)).To(Succeed())
+		NewWithT(t).Expect(namesOf(list["items"].([]interface{}))).To(Equal([]string{"team-a"}))
+	})
+
+	t.Run("watch", func(t *testing.T) {
+		f := restrictedFilterFor(http.MethodGet, "/api/v1/pods?watch=true", "team-a")
+
+		resp := jsonResponse(`{"type":"ADDED","object":{"metadata":{"name":"a","namespace":"team-a"}}}
+{"type":"ADDED","object":{"metadata":{"name":"c","namespace":"team-c"}}}
+{"type":"BOOKMARK","object":{"metadata":{"resourceVersion":"12"}}}
+`)
+		NewWithT(t).Expect(f.WrapResponse(resp)).To(Succeed())
+
+		data, err := ioutil.ReadAll(resp.Body)
+		NewWithT(t).Expect(err).To(BeNil())
+		NewWithT(t).Expect(string(data)).To(Equal(`{"type":"ADDED","object":{"metadata":{"name":"a","namespace":"team-a"}}}
+{"type":"BOOKMARK","object":{"metadata":{"resourceVersion":"12"}}}
+`))
+	})
+
+	t.Run("label selector", func(t *testing.T) {
+		f := restrictedFilterFor(http.MethodGet, "/api/v1/namespaces/default/pods")
+		f.LabelSelector, _ = labels.Parse("app=web")
+
+		req, _ := http.NewRequest(http.MethodGet, "/api/v1/namespaces/default/pods?labelSelector=tier%3Dfrontend", nil)
+		f.WrapRequest(req)
+		NewWithT(t).Expect(req.URL.Query().Get("labelSelector")).To(Equal("tier=frontend,app=web"))
+
+		resp := jsonResponse(`{"kind":"PodList","items":[
+{"metadata":{"name":"a","namespace":"default","labels":{"app":"web"}}},
+{"metadata":{"name":"b","namespace":"default"}}
+]}`)
+		NewWithT(t).Expect(f.WrapResponse(resp)).To(Succeed())
+
+		list := map[string]interface{}{}
+		NewWithT(t).Expect(json.NewDecoder(resp.Body).Decode(&list)).To(Succeed())
+		NewWithT(t).Expect(namesOf(list["items"].([]interface{}))).To(Equal([]string{"a"}))
+
+		get := restrictedFilterFor(http.MethodGet, "/api/v1/namespaces/default/pods/b")
+		get.LabelSelector = f.LabelSelector
+		NewWithT(t).Expect(get.WrapResponse(jsonResponse(`{"kind":"Pod","metadata":{"name":"b","namespace":"default"}}`))).NotTo(Succeed())
+	})
+
+	t.Run("non-object response", func(t *testing.T) {
+		f := restrictedFilterFor(http.MethodGet, "/api/v1/namespaces/team-a/pods/a/log", "team-a")
+
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+			Body:       ioutil.NopCloser(strings.NewReader("log line\n")),
+		}
+		NewWithT(t).Expect(f.WrapResponse(resp)).To(Succeed())
+
+		data, _ := ioutil.ReadAll(resp.Body)
+		NewWithT(t).Expect(string(data)).To(Equal("log line\n"))
+
+		get := restrictedFilterFor(http.MethodGet, "/api/v1/namespaces/team-a/pods/a", "team-a")
+		NewWithT(t).Expect(get.WrapResponse(&http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"application/yaml"}},
+			Body:       ioutil.NopCloser(strings.NewReader("kind: Pod\n")),
+		})).NotTo(Succeed())
+
+		list := restrictedFilterFor(http.MethodGet, "/api/v1/pods", "team-a")
+		NewWithT(t).Expect(list.WrapResponse(&http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+		})).NotTo(Succeed())
+	})
+
+	t.Run("protobuf not accepted", func(t *testing.T) {
+		f := restrictedFilterFor(http.MethodGet, "/api/v1/pods", "team-a")
+
+		req, _ := http.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+		req.Header.Set("Accept", "application/vnd.kubernetes.protobuf, */*")
+		req.Header.Set("Accept-Encoding", "gzip")
+		f.WrapRequest(req)
+
+		NewWithT(t).Expect(req.Header.Get("Accept")).To(Equal("*/*"))
+		NewWithT(t).Expect(req.Header.Get("Accept-Encoding")).To(Equal(""))
+	})
+}
+
+func TestRestrictedRoundTripper(t *testing.T) {
+	rt := &restrictedRoundTripper{
+		rt: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return jsonResponse(`{"kind":"PodList","items":[
+{"metadata":{"name":"a","namespace":"team-a"}},
+{"metadata":{"name":"b","namespace":"kube-system"}}
+]}`), nil
+		}),
+	}
+
+	list := func(req *http.Request) []string {
+		resp, err := rt.RoundTrip(req)
+		NewWithT(t).Expect(err).To(BeNil())
+		defer resp.Body.Close()
+
+		obj := map[string]interface{}{}
+		NewWithT(t).Expect(json.NewDecoder(resp.Body).Decode(&obj)).To(Succeed())
+		return namesOf(obj["items"].([]interface{}))
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+	NewWithT(t).Expect(list(req)).To(Equal([]string{"a", "b"}))
+
+	f := restrictedFilterFor(http.MethodGet, "/api/v1/pods", "team-*")
+	NewWithT(t).Expect(list(req.WithContext(WithRestrictedFilter(req.Context(), f)))).To(Equal([]string{"a"}))
+
+	t.Run("object dropped", func(t *testing.T) {
+		rt := &restrictedRoundTripper{
+			rt: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				return jsonResponse(`{"kind":"Pod","metadata":{"name":"b","namespace":"kube-system"}}`), nil
+			}),
+		}
+
+		req, _ := http.NewRequest(http.MethodGet, "/api/v1/namespaces/kube-system/pods/b", nil)
+		f := restrictedFilterFor(http.MethodGet, "/api/v1/namespaces/kube-system/pods/b", "team-*")
+
+		resp, err := rt.RoundTrip(req.WithContext(WithRestrictedFilter(req.Context(), f)))
+		NewWithT(t).Expect(err).To(BeNil())
+		_ = resp.Body.Close()
+		NewWithT(t).Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+	})
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (fn roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return fn(req)
+}
@@ -2,6 +2,10 @@ package kubeagent
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -16,12 +20,27 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/octohelm/kube-agent/pkg/idgen"
 	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 const (
 	HTTP_KUBE_AGENT_REQUEST_ID = "X-Kube-Agent-Request-ID"
+	// HTTP_KUBE_AGENT_TUNNEL_SECRET responded when tunnel registered, only known by gateway and the agent of the tunnel
+	HTTP_KUBE_AGENT_TUNNEL_SECRET = "X-Kube-Agent-Tunnel-Secret"
+	// HTTP_KUBE_AGENT_REQUEST_PROOF hmac of request id by tunnel secret, required when pulling request
+	HTTP_KUBE_AGENT_REQUEST_PROOF = "X-Kube-Agent-Request-Proof"
 )
 
+const nonceSize = 16
+
+// TUNNEL_CONTROL_RECONNECT notifies the agent to register a new tunnel, may to other gateway member,
+// the current tunnel will be closed by gateway after in-flight requests done.
+// could not conflict with request ids, which always contains @
+const TUNNEL_CONTROL_RECONNECT = "reconnect"
+
+// TUNNEL_CONTROL_GOING_AWAY sent by the agent before shutdown, gateway will not dispatch requests to the tunnel any more
+const TUNNEL_CONTROL_GOING_AWAY = "going-away"
+
 const (
 	writeWait  = 10 * time.Second
 	pongWait   = 60 * time.Second
@@ -31,17 +50,24 @@ const (
 var (
 	ErrTunnelClosed     = errors.New("tunnel closed")
 	ErrTunnelNotFound   = errors.New("tunnel not found")
-	ErrInvalidRequestID = errors.New("invalid request id ID@AGENT_HOST@GATEWAY_ADDRESS")
+	ErrInvalidRequestID = errors.New("invalid request id ID.NONCE@AGENT_HOST@GATEWAY_ADDRESS")
 	ErrRequestNotFound  = errors.New("request not found")
+	ErrRequestClaimed   = errors.New("request already claimed")
+	ErrInvalidProof     = errors.New("invalid request proof")
 )
 
 type TunnelMeta struct {
 	GatewayAddress string
 	AgentHost      string
+	AgentLabels    labels.Set
 }
 
-func (m TunnelMeta) NewRequestID(id uint64) *KubeAgentRequestID {
-	return &KubeAgentRequestID{TunnelMeta: m, RequestID: id}
+func (m TunnelMeta) NewRequestID(id uint64) (*KubeAgentRequestID, error) {
+	nonce, err := randomHex(nonceSize)
+	if err != nil {
+		return nil, err
+	}
+	return &KubeAgentRequestID{TunnelMeta: m, RequestID: id, Nonce: nonce}, nil
 }
 
 func ParseKubeAgentRequestID(requestID string) (*KubeAgentRequestID, error) {
@@ -50,12 +76,22 @@ func ParseKubeAgentRequestID(requestID string) (*KubeAgentRequestID, error) {
 		return nil, errors.Wrapf(ErrInvalidRequestID, "but got %s", requestID)
 	}
 
+	idAndNonce := strings.Split(parts[0], ".")
+	if len(idAndNonce) != 2 {
+		return nil, errors.Wrapf(ErrInvalidRequestID, "but got %s", requestID)
+	}
+
 	kar := &KubeAgentRequestID{}
-	kar.RequestID, _ = strconv.ParseUint(parts[0], 10, 64)
+	kar.RequestID, _ = strconv.ParseUint(idAndNonce[0], 10, 64)
 
 	if kar.RequestID == 0 {
 		return nil, errors.Wrapf(ErrInvalidRequestID, "but got %s", requestID)
 	}
+
+	if nonce, err := hex.DecodeString(idAndNonce[1]); err != nil || len(nonce) != nonceSize {
+		return nil, errors.Wrapf(ErrInvalidRequestID, "but got %s", requestID)
+	}
+	kar.Nonce = idAndNonce[1]
 	kar.AgentHost = parts[1]
 	kar.GatewayAddress = parts[2]
 
@@ -65,25 +101,47 @@ func ParseKubeAgentRequestID(requestID string) (*KubeAgentRequestID, error) {
 type KubeAgentRequestID struct {
 	TunnelMeta
 	RequestID uint64
+	Nonce     string
 }
 
 func (i *KubeAgentRequestID) String() string {
-	return fmt.Sprintf("%d@%s@%s", i.RequestID, i.AgentHost, i.GatewayAddress)
+	return fmt.Sprintf("%d.%s@%s@%s", i.RequestID, i.Nonce, i.AgentHost, i.GatewayAddress)
+}
+
+func NewTunnelSecret() (string, error) {
+	return randomHex(32)
+}
+
+// RequestProof proves the puller of the request holds the secret of the tunnel which notified
+func RequestProof(secret string, requestID string) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(requestID))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
 
-func NewTunnel(conn *websocket.Conn, gen idgen.IDGen, meta TunnelMeta) (*Tunnel, error) {
+func NewTunnel(conn *websocket.Conn, gen idgen.IDGen, meta TunnelMeta, secret string) (*Tunnel, error) {
 	id, err := gen.ID()
 	if err != nil {
 		return nil, err
 	}
 
 	return &Tunnel{
-		Meta: meta,
-		ID:   id,
+		Meta:   meta,
+		ID:     id,
+		secret: secret,
 
 		idGen:      gen,
 		wsConn:     conn,
 		dispatcher: make(chan string),
+		closing:    make(chan struct{}),
 	}, nil
 }
 
@@ -93,31 +151,110 @@ type Tunnel struct {
 
 	idGen  idgen.IDGen
 	wsConn *websocket.Conn
+	secret string
 
 	requests sync.Map
 
 	dispatcher chan string
+	closing    chan struct{}
+	closeOnce  sync.Once
 
-	closed int64
+	closed    int64
+	goingAway int32
 
 	WillClose func()
+	// Seal signs the request before dispatched
+	Seal func(req *http.Request, agentHost string, requestID string) error
+}
+
+// Claim resolves the request for the puller with valid proof, each request could only be claimed once
+func (c *Tunnel) Claim(requestID string, proof string) (*RequestTransit, error) {
+	v, ok := c.requests.Load(requestID)
+	if !ok {
+		return nil, ErrRequestNotFound
+	}
+
+	if !hmac.Equal([]byte(RequestProof(c.secret, requestID)), []byte(proof)) {
+		return nil, ErrInvalidProof
+	}
+
+	rs := v.(*RequestTransit)
+	if !atomic.CompareAndSwapInt32(&rs.claimed, 0, 1) {
+		return nil, ErrRequestClaimed
+	}
+	return rs, nil
 }
 
 func (c *Tunnel) IsClosed() bool {
-	return atomic.LoadInt64(&c.closed) > 0
+	select {
+	case <-c.closing:
+		return true
+	default:
+		return atomic.LoadInt64(&c.closed) > 0
+	}
 }
 
 func (c *Tunnel) Close() (err error) {
+	if !atomic.CompareAndSwapInt64(&c.closed, 0, 1) {
+		return nil
+	}
+
 	if c.WillClose != nil {
 		c.WillClose()
 	}
 
-	close(c.dispatcher)
+	c.closeOnce.Do(func() {
+		close(c.closing)
+	})
 
 	return c.wsConn.Close()
 }
 
+// Shutdown closes the tunnel with close message sent to the agent
+func (c *Tunnel) Shutdown() {
+	c.closeOnce.Do(func() {
+		close(c.closing)
+	})
+}
+
+// Available returns false when the tunnel closed or the agent is going away
+func (c *Tunnel) Available() bool {
+	return !c.IsClosed() && atomic.LoadInt32(&c.goingAway) == 0
+}
+
+// Reconnect notifies the agent to register a new tunnel
+func (c *Tunnel) Reconnect() {
+	c.dispatch(TUNNEL_CONTROL_RECONNECT)
+}
+
+func (c *Tunnel) dispatch(msg string) {
+	select {
+	case c.dispatcher <- msg:
+	case <-c.closing:
+	}
+}
+
+// read handles control frames and messages from the agent, the tunnel will be closed when the agent disconnected
+func (c *Tunnel) read(ctx context.Context) {
+	defer func() {
+		_ = c.Close()
+	}()
+
+	for {
+		t, data, err := c.wsConn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if t == websocket.TextMessage && string(data) == TUNNEL_CONTROL_GOING_AWAY {
+			atomic.StoreInt32(&c.goingAway, 1)
+			logr.FromContext(ctx).Info("agent %s is going away", c.Meta.AgentHost)
+		}
+	}
+}
+
 func (c *Tunnel) Wait(ctx context.Context) {
+	go c.read(ctx)
+
 	ticker := time.NewTicker(pingPeriod)
 
 	defer func() {
@@ -127,12 +264,12 @@ func (c *Tunnel) Wait(ctx context.Context) {
 
 	for {
 		select {
-		case requestID, ok := <-c.dispatcher:
+		case <-c.closing:
+			_ = c.wsConn.SetWriteDeadline(time.Now().Add(writeWait))
+			_ = c.wsConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+			return
+		case requestID := <-c.dispatcher:
 			_ = c.wsConn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				_ = c.wsConn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
 
 			func(requestID string) {
 				w, err := c.wsConn.NextWriter(websocket.TextMessage)
@@ -154,7 +291,7 @@ func (c *Tunnel) Wait(ctx context.Context) {
 }
 
 func (c *Tunnel) RoundTrip(req *http.Request) (*http.Response, error) {
-	if c == nil {
+	if c == nil || !c.Available() {
 		return nil, ErrTunnelClosed
 	}
 
@@ -162,10 +299,20 @@ func (c *Tunnel) RoundTrip(req *http.Request) (*http.Response, error) {
 	if err != nil {
 		return nil, err
 	}
-	requestID := c.Meta.NewRequestID(id).String()
+	rid, err := c.Meta.NewRequestID(id)
+	if err != nil {
+		return nil, err
+	}
+	requestID := rid.String()
 
 	req.Header.Set(HTTP_KUBE_AGENT_REQUEST_ID, requestID)
 
+	if c.Seal != nil {
+		if err := c.Seal(req, c.Meta.AgentHost, requestID); err != nil {
+			return nil, err
+		}
+	}
+
 	kubeAgentRequest := NewRequestTransit(req)
 
 	c.requests.Store(requestID, kubeAgentRequest)
@@ -174,9 +321,7 @@ func (c *Tunnel) RoundTrip(req *http.Request) (*http.Response, error) {
 		c.requests.Delete(requestID)
 	}()
 
-	go func() {
-		c.dispatcher <- requestID
-	}()
+	go c.dispatch(requestID)
 
 	ctx := req.Context()
 
@@ -188,13 +333,29 @@ func (c *Tunnel) RoundTrip(req *http.Request) (*http.Response, error) {
 	}
 }
 
-func NewReceiver(conn *websocket.Conn, do func(ctx context.Context, id string)) *Receiver {
-	return &Receiver{conn: conn, do: do}
+func NewReceiver(conn *websocket.Conn, secret string, do func(ctx context.Context, id string, proof string)) *Receiver {
+	return &Receiver{conn: conn, secret: secret, do: do}
 }
 
 type Receiver struct {
-	conn *websocket.Conn
-	do   func(ctx context.Context, id string)
+	conn   *websocket.Conn
+	secret string
+	do     func(ctx context.Context, id string, proof string)
+	// OnReconnect called when gateway asks to register a new tunnel
+	OnReconnect func()
+	// InFlight counts dispatched requests, added before the request goroutine started
+	InFlight *sync.WaitGroup
+}
+
+// GoingAway tells gateway not to dispatch requests to the tunnel any more
+func (r *Receiver) GoingAway() error {
+	_ = r.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return r.conn.WriteMessage(websocket.TextMessage, []byte(TUNNEL_CONTROL_GOING_AWAY))
+}
+
+func (r *Receiver) Close() error {
+	_ = r.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(writeWait))
+	return r.conn.Close()
 }
 
 func (r *Receiver) Start(ctx context.Context) {
@@ -214,7 +375,22 @@ func (r *Receiver) Start(ctx context.Context) {
 			if err != nil {
 				continue
 			}
-			go r.do(ctx, string(data))
+			requestID := string(data)
+			if requestID == TUNNEL_CONTROL_RECONNECT {
+				if r.OnReconnect != nil {
+					r.OnReconnect()
+				}
+				continue
+			}
+			if r.InFlight != nil {
+				r.InFlight.Add(1)
+			}
+			go func() {
+				if r.InFlight != nil {
+					defer r.InFlight.Done()
+				}
+				r.do(ctx, requestID, RequestProof(r.secret, requestID))
+			}()
 		}
 	}
 }
@@ -0,0 +1,185 @@
+package kubeagent
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/octohelm/kube-agent/pkg/idgen"
+	. "github.com/onsi/gomega"
+)
+
+func TestKubeAgentRequestID(t *testing.T) {
+	rid, err := TunnelMeta{AgentHost: "local", GatewayAddress: "127.0.0.1:80"}.NewRequestID(1)
+	NewWithT(t).Expect(err).To(BeNil())
+
+	parsed, err := ParseKubeAgentRequestID(rid.String())
+	NewWithT(t).Expect(err).To(BeNil())
+	NewWithT(t).Expect(parsed).To(Equal(rid))
+
+	other, _ := TunnelMeta{AgentHost: "local", GatewayAddress: "127.0.0.1:80"}.NewRequestID(1)
+	NewWithT(t).Expect(other.String()).NotTo(Equal(rid.String()))
+
+	for _, invalid := range []string{
+		"1@local@127.0.0.1:80",
+		"1.xxx@local@127.0.0.1:80",
+		"0." + rid.Nonce + "@local@127.0.0.1:80",
+	} {
+		_, err := ParseKubeAgentRequestID(invalid)
+		NewWithT(t).Expect(err).NotTo(BeNil())
+	}
+}
+
+func TestTunnelClaim(t *testing.T) {
+	secret, _ := NewTunnelSecret()
+
+	c := &Tunnel{secret: secret}
+
+	rid, _ := TunnelMeta{AgentHost: "local", GatewayAddress: "127.0.0.1:80"}.NewRequestID(1)
+	requestID := rid.String()
+
+	c.requests.Store(requestID, NewRequestTransit(&http.Request{}))
+
+	_, err := c.Claim("1.00@local@127.0.0.1:80", RequestProof(secret, requestID))
+	NewWithT(t).Expect(err).To(Equal(ErrRequestNotFound))
+
+	otherSecret, _ := NewTunnelSecret()
+	_, err = c.Claim(requestID, RequestProof(otherSecret, requestID))
+	NewWithT(t).Expect(err).To(Equal(ErrInvalidProof))
+
+	rs, err := c.Claim(requestID, RequestProof(secret, requestID))
+	NewWithT(t).Expect(err).To(BeNil())
+	NewWithT(t).Expect(rs).NotTo(BeNil())
+
+	_, err = c.Claim(requestID, RequestProof(secret, requestID))
+	NewWithT(t).Expect(err).To(Equal(ErrRequestClaimed))
+}
+
+func TestTunnelReconnect(t *testing.T) {
+	gen, _ := idgen.FromIP(net.ParseIP("127.0.0.1"))
+
+	tunnels := make(chan *Tunnel, 1)
+
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		c, err := (&websocket.Upgrader{}).Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		tunnel, _ := NewTunnel(c, gen, TunnelMeta{AgentHost: "local"}, "secret")
+		tunnels <- tunnel
+		tunnel.Wait(context.Background())
+	}))
+	defer s.Close()
+
+	c, _, err := websocket.DefaultDialer.Dial(strings.Replace(s.URL, "http", "ws", 1), nil)
+	NewWithT(t).Expect(err).To(BeNil())
+
+	reconnect := make(chan struct{}, 1)
+
+	r := NewReceiver(c, "secret", func(ctx context.Context, id string, proof string) {})
+	r.OnReconnect = func() {
+		reconnect <- struct{}{}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		r.Start(context.Background())
+		close(done)
+	}()
+
+	tunnel := <-tunnels
+	tunnel.Reconnect()
+
+	select {
+	case <-reconnect:
+	case <-time.After(time.Second):
+		t.Fatal("reconnect not received")
+	}
+
+	tunnel.Shutdown()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("receiver not stopped")
+	}
+
+	NewWithT(t).Expect(tunnel.IsClosed()).To(BeTrue())
+	_, err = tunnel.RoundTrip(&http.Request{Header: http.Header{}})
+	NewWithT(t).Expect(err).To(Equal(ErrTunnelClosed))
+}
+
+func TestTunnelGoingAway(t *testing.T) {
+	gen, _ := idgen.FromIP(net.ParseIP("127.0.0.1"))
+
+	tunnels := make(chan *Tunnel, 1)
+
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		c, err := (&websocket.Upgrader{}).Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		tunnel, _ := NewTunnel(c, gen, TunnelMeta{AgentHost: "local"}, "secret")
+		tunnels <- tunnel
+		tunnel.Wait(context.Background())
+	}))
+	defer s.Close()
+
+	c, _, err := websocket.DefaultDialer.Dial(strings.Replace(s.URL, "http", "ws", 1), nil)
+	NewWithT(t).Expect(err).To(BeNil())
+
+	r := NewReceiver(c, "secret", func(ctx context.Context, id string, proof string) {})
+	go r.Start(context.Background())
+
+	tunnel := <-tunnels
+	NewWithT(t).Expect(tunnel.Available()).To(BeTrue())
+
+	NewWithT(t).Expect(r.GoingAway()).To(Succeed())
+	NewWithT(t).Eventually(tunnel.Available).Should(BeFalse())
+	NewWithT(t).Expect(tunnel.IsClosed()).To(BeFalse())
+
+	_ = r.Close()
+	NewWithT(t).Eventually(tunnel.IsClosed).Should(BeTrue())
+}
+
+func TestReceiverInFlight(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		c, err := (&websocket.Upgrader{}).Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		_ = c.WriteMessage(websocket.TextMessage, []byte("1@local@127.0.0.1:80"))
+		_ = c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		_ = c.Close()
+	}))
+	defer s.Close()
+
+	c, _, err := websocket.DefaultDialer.Dial(strings.Replace(s.URL, "http", "ws", 1), nil)
+	NewWithT(t).Expect(err).To(BeNil())
+
+	release := make(chan struct{})
+	done := int32(0)
+
+	r := NewReceiver(c, "secret", func(ctx context.Context, id string, proof string) {
+		<-release
+		atomic.StoreInt32(&done, 1)
+	})
+	r.InFlight = &sync.WaitGroup{}
+
+	// requests counted once received, even the request goroutine not scheduled yet
+	r.Start(context.Background())
+
+	time.AfterFunc(100*time.Millisecond, func() {
+		close(release)
+	})
+
+	r.InFlight.Wait()
+	NewWithT(t).Expect(atomic.LoadInt32(&done)).To(Equal(int32(1)))
+}
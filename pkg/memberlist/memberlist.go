@@ -2,13 +2,11 @@ package memberlist
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
-	"os"
-	"os/signal"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/hashicorp/memberlist"
@@ -30,9 +28,74 @@ func (m Member) Addr() string {
 
 type MemberList struct {
 	Member
+	// State to share across members, should be set before Serve
+	State    SharedState
 	seeds    []string
 	list     *memberlist.Memberlist
 	nodeLock sync.RWMutex
+	delegate *delegate
+}
+
+// MemberMeta gossiped with the member
+type MemberMeta struct {
+	Draining bool `json:"draining,omitempty"`
+}
+
+// Broadcast gossips the partial state to other members,
+// full state will be synced by push/pull periodically.
+func (l *MemberList) Broadcast(data []byte) {
+	l.nodeLock.RLock()
+	d := l.delegate
+	l.nodeLock.RUnlock()
+
+	if d == nil || d.state == nil {
+		return
+	}
+	d.broadcasts.QueueBroadcast(broadcast(data))
+}
+
+// Drain marks the member as draining, other members should prefer the others
+func (l *MemberList) Drain() error {
+	l.nodeLock.RLock()
+	d, list := l.delegate, l.list
+	l.nodeLock.RUnlock()
+
+	if d == nil || list == nil {
+		return nil
+	}
+
+	d.setMeta(MemberMeta{Draining: true})
+
+	return list.UpdateNode(5 * time.Second)
+}
+
+// IsDraining returns true when the member is draining
+func (l *MemberList) IsDraining(name string) bool {
+	l.nodeLock.RLock()
+	defer l.nodeLock.RUnlock()
+
+	if l.list == nil {
+		return false
+	}
+
+	for _, n := range l.list.Members() {
+		if n.Name == name {
+			meta := MemberMeta{}
+			_ = json.Unmarshal(n.Meta, &meta)
+			return meta.Draining
+		}
+	}
+	return false
+}
+
+func (l *MemberList) numMembers() int {
+	l.nodeLock.RLock()
+	defer l.nodeLock.RUnlock()
+
+	if l.list == nil {
+		return 1
+	}
+	return l.list.NumMembers()
 }
 
 func (l *MemberList) SetMemberList(list *memberlist.Memberlist) {
@@ -46,6 +109,10 @@ func (l *MemberList) Members() (list []string) {
 	l.nodeLock.Lock()
 	defer l.nodeLock.Unlock()
 
+	if l.list == nil {
+		return nil
+	}
+
 	members := l.list.Members()
 	for i := range members {
 		list = append(list, members[i].Name)
@@ -53,6 +120,7 @@ func (l *MemberList) Members() (list []string) {
 	return
 }
 
+// Serve joins the members until ctx canceled, then leaves
 func (l *MemberList) Serve(ctx context.Context) error {
 	c := memberlist.DefaultLocalConfig()
 
@@ -61,6 +129,20 @@ func (l *MemberList) Serve(ctx context.Context) error {
 	c.AdvertisePort = l.Member.BindPort
 	c.LogOutput = io.Discard
 
+	d := &delegate{
+		state: l.State,
+		broadcasts: &memberlist.TransmitLimitedQueue{
+			NumNodes:       l.numMembers,
+			RetransmitMult: c.RetransmitMult,
+		},
+	}
+
+	l.nodeLock.Lock()
+	l.delegate = d
+	l.nodeLock.Unlock()
+
+	c.Delegate = d
+
 	list, err := memberlist.Create(c)
 	if err != nil {
 		return err
@@ -71,21 +153,22 @@ func (l *MemberList) Serve(ctx context.Context) error {
 	go func() {
 		for {
 			//try to join member until ready
-			if _, err := l.list.Join(append(l.seeds, l.Member.Addr())); err != nil {
-				time.Sleep(1 * time.Second)
+			if _, err := list.Join(append(l.seeds, l.Member.Addr())); err != nil {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(1 * time.Second):
+				}
 				continue
 			}
 			return
 		}
 	}()
 
-	stopCh := make(chan os.Signal, 1)
-	signal.Notify(stopCh, os.Interrupt, syscall.SIGTERM)
-	<-stopCh
+	<-ctx.Done()
 
-	timeout := 5 * time.Second
-	_, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
+	// notify others before shutdown, failure could be ignored, others will detect it later
+	_ = list.Leave(5 * time.Second)
 
 	return list.Shutdown()
 }
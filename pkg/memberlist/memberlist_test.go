@@ -3,6 +3,7 @@ package memberlist
 import (
 	"context"
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -14,6 +15,14 @@ func TestMemberList(t *testing.T) {
 
 	ports := []int{3456, 3457, 3458}
 
+	ctx, cancel := context.WithCancel(context.Background())
+
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
 	for i := range ports {
 		port := ports[i]
 
@@ -25,8 +34,12 @@ func TestMemberList(t *testing.T) {
 
 		ml := NewMemberList(opt, []string{"localhost:3456"})
 
+		wg.Add(1)
+
 		go func() {
-			if err := ml.Serve(context.Background()); err != nil {
+			defer wg.Done()
+
+			if err := ml.Serve(ctx); err != nil {
 				fmt.Println(err)
 			}
 		}()
@@ -0,0 +1,81 @@
+package memberlist
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// SharedState is shared across members through gossip,
+// MergeRemoteState should be idempotent, because the same state could be received many times.
+type SharedState interface {
+	LocalState() []byte
+	MergeRemoteState(data []byte)
+}
+
+type delegate struct {
+	state      SharedState
+	broadcasts *memberlist.TransmitLimitedQueue
+
+	mu   sync.RWMutex
+	meta []byte
+}
+
+func (d *delegate) setMeta(meta MemberMeta) {
+	data, _ := json.Marshal(meta)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.meta = data
+}
+
+func (d *delegate) NodeMeta(limit int) []byte {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if len(d.meta) > limit {
+		return nil
+	}
+	return d.meta
+}
+
+func (d *delegate) NotifyMsg(data []byte) {
+	if len(data) == 0 || d.state == nil {
+		return
+	}
+	// data will be reused by memberlist
+	d.state.MergeRemoteState(append([]byte(nil), data...))
+}
+
+func (d *delegate) GetBroadcasts(overhead, limit int) [][]byte {
+	return d.broadcasts.GetBroadcasts(overhead, limit)
+}
+
+func (d *delegate) LocalState(join bool) []byte {
+	if d.state == nil {
+		return nil
+	}
+	return d.state.LocalState()
+}
+
+func (d *delegate) MergeRemoteState(data []byte, join bool) {
+	if len(data) == 0 || d.state == nil {
+		return
+	}
+	d.state.MergeRemoteState(data)
+}
+
+type broadcast []byte
+
+func (b broadcast) Invalidates(other memberlist.Broadcast) bool {
+	return false
+}
+
+func (b broadcast) Message() []byte {
+	return b
+}
+
+func (b broadcast) Finished() {
+}